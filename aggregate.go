@@ -0,0 +1,231 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Aggregates over walks and scans: counts, groups, extremes, and
+// degrees.  They stream.  A walk's paths (or a scan's triples) are
+// counted as they arrive, and only the results are kept.  Results are
+// plain maps, so they're easy to marshal to JSON or to hand to
+// Javascript.
+//
+// A walk's "position" is a tag from As() or, if it's "", the path's
+// current vertex.  A scan's position is "s", "p", "o", or "g".
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PathGroups is a walk's paths grouped by a position (see GroupBy()).
+type PathGroups struct {
+	it *PathIterator
+	by string
+}
+
+// compareValues compares two values as numbers if they both are
+// numbers and as strings otherwise.
+func compareValues(x, y string) int {
+	xf, xerr := strconv.ParseFloat(x, 64)
+	yf, yerr := strconv.ParseFloat(y, 64)
+	if xerr != nil || yerr != nil {
+		return strings.Compare(x, y)
+	}
+	switch {
+	case xf < yf:
+		return -1
+	case yf < xf:
+		return 1
+	}
+	return 0
+}
+
+// at returns the vertex at the position of the path Next() returned
+// last.  Returns false if the path doesn't have that tag.
+func (it *PathIterator) at(path Path, by string) (Vertex, bool) {
+	if by == "" {
+		return it.end(path, it.from), true
+	}
+	return it.last.lookup(by)
+}
+
+// Count returns the number of paths and then closes the iterator.
+// It counts the frames that reach the end of the walk, so it doesn't
+// hand out any paths.
+func (it *PathIterator) Count() (int64, error) {
+	defer it.Close()
+	n := int64(0)
+	for f, _ := it.nextFrame(); f != nil; f, _ = it.nextFrame() {
+		n++
+	}
+	return n, it.Err()
+}
+
+// Min returns the least vertex at the position (or nil if there
+// aren't any) and then closes the iterator.  Numbers compare as
+// numbers.
+func (it *PathIterator) Min(by string) (Vertex, error) {
+	return it.extreme(by, -1)
+}
+
+// Max returns the greatest vertex at the position (see Min()).
+func (it *PathIterator) Max(by string) (Vertex, error) {
+	return it.extreme(by, 1)
+}
+
+func (it *PathIterator) extreme(by string, sign int) (Vertex, error) {
+	var acc Vertex
+	it.Do(func(path Path) {
+		if v, ok := it.at(path, by); ok && (acc == nil || sign*compareValues(string(v), string(acc)) > 0) {
+			acc = v
+		}
+	})
+	return acc, it.Err()
+}
+
+// GroupBy groups the paths by the vertex at the position.  Paths
+// without that tag are left out.
+func (it *PathIterator) GroupBy(by string) *PathGroups {
+	return &PathGroups{it, by}
+}
+
+// Count returns the number of paths in each group and then closes the
+// iterator.
+func (gs *PathGroups) Count() (map[string]int64, error) {
+	acc := make(map[string]int64)
+	gs.it.Do(func(path Path) {
+		if k, ok := gs.it.at(path, gs.by); ok {
+			acc[string(k)]++
+		}
+	})
+	return acc, gs.it.Err()
+}
+
+// Min returns each group's least vertex at the position 'of' and
+// then closes the iterator.
+func (gs *PathGroups) Min(of string) (map[string]string, error) {
+	return gs.extreme(of, -1)
+}
+
+// Max returns each group's greatest vertex at the position 'of'.
+func (gs *PathGroups) Max(of string) (map[string]string, error) {
+	return gs.extreme(of, 1)
+}
+
+func (gs *PathGroups) extreme(of string, sign int) (map[string]string, error) {
+	acc := make(map[string]string)
+	gs.it.Do(func(path Path) {
+		k, ok := gs.it.at(path, gs.by)
+		if !ok {
+			return
+		}
+		v, ok := gs.it.at(path, of)
+		if !ok {
+			return
+		}
+		if have, ok := acc[string(k)]; !ok || sign*compareValues(string(v), have) > 0 {
+			acc[string(k)] = string(v)
+		}
+	})
+	return acc, gs.it.Err()
+}
+
+// Degree returns the degree (see Graph.Degree()) of each vertex the
+// walk reaches and then closes the iterator.
+func (it *PathIterator) Degree(in bool, p []byte) (map[string]int64, error) {
+	acc := make(map[string]int64)
+	var err error
+	it.Do(func(path Path) {
+		v := it.end(path, it.from)
+		if _, have := acc[string(v)]; have || err != nil {
+			return
+		}
+		acc[string(v)], err = it.g.Degree(v, in, p)
+	})
+	if err == nil {
+		err = it.Err()
+	}
+	return acc, err
+}
+
+// CountMatching returns the number of triples that match the pattern
+// (see DoMatching()).  Unlike EstimateMatching(), it's exact, and it
+// visits every match.
+func (g *Graph) CountMatching(on *Triple) (int64, error) {
+	n := int64(0)
+	err := g.DoMatching(on, nil, func(*Triple) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// GroupMatching returns the number of triples that match the pattern
+// for each term at the position ("s", "p", "o", or "g").
+func (g *Graph) GroupMatching(on *Triple, position string) (map[string]int64, error) {
+	var term func(t *Triple) []byte
+	switch position {
+	case "s":
+		term = func(t *Triple) []byte { return t.S }
+	case "p":
+		term = func(t *Triple) []byte { return t.P }
+	case "o":
+		term = func(t *Triple) []byte { return t.O }
+	case "g":
+		term = func(t *Triple) []byte { return t.V }
+	default:
+		return nil, fmt.Errorf("Bad position %q (want s, p, o, or g)", position)
+	}
+	acc := make(map[string]int64)
+	err := g.DoMatching(on, nil, func(t *Triple) bool {
+		acc[string(term(t))]++
+		return true
+	})
+	return acc, err
+}
+
+// Degree returns the number of edges out of the vertex (or into it if
+// 'in') with the given property (or any property if p is empty).  Uses
+// the stats (see EnableStats()) when it can and they're current.
+// Otherwise it counts.
+func (g *Graph) Degree(v Vertex, in bool, p []byte) (int64, error) {
+	if len(p) == 0 && g.HasStats() {
+		var n int64
+		var err error
+		if in {
+			n, err = g.InDegree(v)
+		} else {
+			n, err = g.OutDegree(v)
+		}
+		if err != ErrStaleStats {
+			return n, err
+		}
+	}
+	on := &Triple{S: v, P: p}
+	if in {
+		on = &Triple{P: p, O: v}
+	}
+	return g.CountMatching(on)
+}
+
+// Histogram returns the number of keys with each count.  For example,
+// the histogram of out-degrees from GroupMatching(&Triple{}, "s").
+func Histogram(counts map[string]int64) map[int64]int64 {
+	acc := make(map[int64]int64)
+	for _, n := range counts {
+		acc[n]++
+	}
+	return acc
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAggregates(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// Synsets with hyponyms, and each hyponym's size.
+	for _, ts := range [][3]string{
+		{"animal", "hyponym", "dog"}, {"animal", "hyponym", "cat"}, {"animal", "hyponym", "fish"},
+		{"dog", "hyponym", "puppy"}, {"dog", "size", "40"}, {"cat", "size", "9"},
+		{"fish", "size", "100"}, {"puppy", "size", "12"}, {"dog", "label", "Dog"},
+	} {
+		g.WriteIndexedTriple(TripleFromStrings(ts[0], ts[1], ts[2]), nil)
+	}
+	hyponym, size := []byte("hyponym"), []byte("size")
+
+	if n, err := Out(hyponym).Paths(g, Vertex("animal")).Count(); err != nil || n != 3 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if n, _ := Out(size).Paths(g, Vertex("nothing")).Count(); n != 0 {
+		t.Errorf("Unexpected %d", n)
+	}
+
+	// Numbers compare as numbers.
+	s := Out(hyponym).Out(size)
+	if v, _ := s.Paths(g, Vertex("animal")).Min(""); string(v) != "9" {
+		t.Errorf("Unexpected min %s", v)
+	}
+	if v, _ := s.Paths(g, Vertex("animal")).Max(""); string(v) != "100" {
+		t.Errorf("Unexpected max %s", v)
+	}
+	if v, _ := s.Paths(g, Vertex("nothing")).Max(""); v != nil {
+		t.Errorf("Unexpected max %s", v)
+	}
+
+	// Hyponyms per synset.
+	s = OutStar(hyponym).As("synset").Out(hyponym)
+	counts, err := s.Paths(g, Vertex("animal")).GroupBy("synset").Count()
+	if got := fmt.Sprint(counts); err != nil || got != "map[animal:3 dog:1]" {
+		t.Errorf("Unexpected %s (%v)", got, err)
+	}
+	if got := fmt.Sprint(Histogram(counts)); got != "map[1:1 3:1]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	s = OutStar(hyponym).As("synset").Out(hyponym).Out(size).As("size")
+	mins, _ := s.Paths(g, Vertex("animal")).GroupBy("synset").Min("size")
+	maxes, _ := s.Paths(g, Vertex("animal")).GroupBy("synset").Max("size")
+	if got := fmt.Sprint(mins, maxes); got != "map[animal:9 dog:12] map[animal:100 dog:12]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Degrees of the vertexes a walk reaches.
+	degrees, err := Out(hyponym).Paths(g, Vertex("animal")).Degree(false, nil)
+	if got := fmt.Sprint(degrees); err != nil || got != "map[cat:1 dog:3 fish:1]" {
+		t.Errorf("Unexpected %s (%v)", got, err)
+	}
+	if n, _ := g.Degree(Vertex("dog"), true, hyponym); n != 1 {
+		t.Errorf("Unexpected in-degree %d", n)
+	}
+
+	// Scans.
+	if n, err := g.CountMatching(&Triple{P: size}); err != nil || n != 4 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	counts, err = g.GroupMatching(&Triple{S: []byte("dog")}, "p")
+	if got := fmt.Sprint(counts); err != nil || got != "map[hyponym:1 label:1 size:1]" {
+		t.Errorf("Unexpected %s (%v)", got, err)
+	}
+	counts, _ = g.GroupMatching(&Triple{P: hyponym}, "s")
+	if got := fmt.Sprint(counts); got != "map[animal:3 dog:1]" {
+		t.Errorf("Unexpected %s", got)
+	}
+	if _, err := g.GroupMatching(&Triple{}, "x"); err == nil {
+		t.Errorf("Expected an error")
+	}
+
+	// Degree() uses current stats.  Here they're wrong, so it's clear
+	// which it used.
+	if err := g.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	g.Store().Put(nil, statsKey(statsOutDegree, []byte("dog")), []byte("7"))
+	if n, err := g.Degree(Vertex("dog"), false, nil); err != nil || n != 7 {
+		t.Errorf("Unexpected degree %d (%v)", n, err)
+	}
+	// It counts when the stats are stale.
+	g.IndexTriple(SPO, TripleFromStrings("dog", "size", "41"), nil)
+	if n, err := g.Degree(Vertex("dog"), false, nil); err != nil || n != 4 {
+		t.Errorf("Unexpected degree %d (%v)", n, err)
+	}
+	if n, err := g.Degree(Vertex("cat"), true, nil); err != nil || n != 1 {
+		t.Errorf("Unexpected degree %d (%v)", n, err)
+	}
+	if err := g.RebuildStats(); err != nil {
+		t.Fatal(err)
+	}
+	g.Store().Put(nil, statsKey(statsOutDegree, []byte("dog")), []byte("5"))
+	if n, err := g.Degree(Vertex("dog"), false, nil); err != nil || n != 5 {
+		t.Errorf("Unexpected degree %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,502 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Online backups and checkpoints.
+//
+// A BackupEngine keeps numbered backups of one database in a
+// directory, with backup N described by N.meta (JSON).  How the
+// backups are made depends on the store.
+//
+// A store that has its own backups (a BackupStore) makes them.
+// RocksStore uses RocksDB's BackupEngine, which shares SST files
+// between backups: each backup copies only the files that the
+// previous ones don't have, and restoring copies files back instead
+// of writing keys.
+//
+// Other stores (like MemoryStore) get logical backups.  Backup N's
+// data is then in N.data.  A full backup's data is every key in a
+// snapshot of the store.  When the graph has a changelog that still
+// has every change since the previous backup, the backup is
+// incremental: its data is just those changes.  Restore loads the
+// last full backup at or before the requested one and then replays
+// the incremental backups after it through the graph.
+//
+// A directory has one kind of backup or the other.  Either way,
+// writes can continue while a backup runs.
+//
+// A data file is a sequence of records: uvarint length, key, uvarint
+// length, value.  The meta file (written last) has a CRC-32 of the
+// data file.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Number of keys per write batch when restoring.
+const restoreBatchSize = 1000
+
+type BackupInfo struct {
+	ID      int    `json:"id"`
+	Full    bool   `json:"full"`
+	Seq     uint64 `json:"seq"` // Last change included (if there's a changelog).
+	Indexes string `json:"indexes"`
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	CRC     uint32 `json:"crc"`
+	Created string `json:"created"`
+	// The BackupStore's kind of backup (like "rocksdb"), or empty
+	// for a logical backup.
+	Store string `json:"store,omitempty"`
+}
+
+type BackupEngine struct {
+	dir string
+}
+
+// OpenBackupEngine uses (and maybe creates) the given directory.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BackupEngine{dir}, nil
+}
+
+// OpenBackupDir uses an existing backup directory without creating
+// it, for listing or restoring backups.  If the directory doesn't
+// exist, the error satisfies os.IsNotExist.
+func OpenBackupDir(dir string) (*BackupEngine, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s isn't a directory", dir)
+	}
+	return &BackupEngine{dir}, nil
+}
+
+func (e *BackupEngine) filename(id int, suffix string) string {
+	return filepath.Join(e.dir, strconv.Itoa(id)+suffix)
+}
+
+// Backups returns the complete backups ordered by ID.
+func (e *BackupEngine) Backups() ([]BackupInfo, error) {
+	names, err := filepath.Glob(filepath.Join(e.dir, "*.meta"))
+	if err != nil {
+		return nil, err
+	}
+	acc := make([]BackupInfo, 0, len(names))
+	for _, name := range names {
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var info BackupInfo
+		if err = json.Unmarshal(bs, &info); err != nil {
+			return nil, fmt.Errorf("Bad backup meta %s: %v", name, err)
+		}
+		acc = append(acc, info)
+	}
+	sort.Slice(acc, func(i, j int) bool { return acc[i].ID < acc[j].ID })
+	return acc, nil
+}
+
+func writeRecord(w io.Writer, k []byte, v []byte) error {
+	bs := make([]byte, binary.MaxVarintLen64)
+	for _, part := range [][]byte{k, v} {
+		if _, err := w.Write(bs[0:binary.PutUvarint(bs, uint64(len(part)))]); err != nil {
+			return err
+		}
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecord returns io.EOF at the end.
+func readRecord(r *bufio.Reader) ([]byte, []byte, error) {
+	var parts [2][]byte
+	for i := range parts {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			if i == 1 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+		parts[i] = make([]byte, n)
+		if _, err = io.ReadFull(r, parts[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return parts[0], parts[1], nil
+}
+
+// lastSeq returns the last change in the graph's changelog.  Reads
+// with the graph's read options, so it works on a snapshot.
+func (g *Graph) lastSeq() (uint64, error) {
+	bs, err := g.db.Get(g.ropts, changelogKey)
+	if err != nil || bs == nil {
+		return 0, err
+	}
+	next, err := strconv.ParseUint(string(bs), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return next - 1, nil
+}
+
+// CreateBackup backs up the current state of the graph.
+func (e *BackupEngine) CreateBackup(g *Graph) (*BackupInfo, error) {
+	backups, err := e.Backups()
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{ID: 1, Full: true, Indexes: JoinIndexes(g.indexes), Created: NowStringMillis()}
+	if 0 < len(backups) {
+		info.ID = backups[len(backups)-1].ID + 1
+	}
+
+	if bs, ok := g.db.(BackupStore); ok {
+		if 0 < len(backups) && backups[len(backups)-1].Store == "" {
+			return nil, fmt.Errorf("Backup directory %s has logical backups", e.dir)
+		}
+		return e.createStoreBackup(g.live(), bs, info)
+	}
+	if 0 < len(backups) && backups[len(backups)-1].Store != "" {
+		return nil, fmt.Errorf("Backup directory %s has %s backups", e.dir, backups[len(backups)-1].Store)
+	}
+
+	snap := g.live().Snapshot()
+	defer snap.Release()
+
+	// Incremental if the changelog goes back far enough and nothing
+	// has written around it since the previous backup.
+	from := []byte{}
+	to := []byte(nil)
+	if snap.changes != nil {
+		if info.Seq, err = snap.lastSeq(); err != nil {
+			return nil, err
+		}
+		unlogged, hasUnlogged, err := snap.lastUnlogged()
+		if err != nil {
+			return nil, err
+		}
+		if 0 < len(backups) {
+			prev := backups[len(backups)-1]
+			if hasUnlogged && prev.Seq <= unlogged {
+				log.Printf("CreateBackup: full because of unlogged writes after change %d", unlogged)
+			} else if 0 < prev.Seq && prev.Seq <= info.Seq {
+				changes, err := snap.Changes(prev.Seq+1, 1)
+				if err != nil {
+					return nil, err
+				}
+				if prev.Seq == info.Seq || (0 < len(changes) && changes[0].Seq == prev.Seq+1) {
+					info.Full = false
+					from = changeKey(prev.Seq + 1)
+					to = changeKey(info.Seq + 1)
+				}
+			}
+		}
+	}
+
+	f, tmp, err := e.reserve(info)
+	if err != nil {
+		return nil, err
+	}
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	i := snap.db.NewIterator(snap.ropts)
+	for i.Seek(from); i.Valid(); i.Next() {
+		k := i.Key()
+		if to != nil && string(to) <= string(k) {
+			break
+		}
+		if err = writeRecord(w, k, i.Value()); err != nil {
+			break
+		}
+		info.Records++
+	}
+	i.Close()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err = os.Rename(tmp, e.filename(info.ID, ".data")); err != nil {
+		return nil, err
+	}
+
+	info.CRC = crc.Sum32()
+	if fi, err := os.Stat(e.filename(info.ID, ".data")); err == nil {
+		info.Bytes = fi.Size()
+	}
+	if err = e.writeMeta(info); err != nil {
+		return nil, err
+	}
+	log.Printf("CreateBackup %d full=%v records=%d seq=%d", info.ID, info.Full, info.Records, info.Seq)
+	return info, nil
+}
+
+// createStoreBackup has the store make the backup.  The backup has at
+// least the changes up to info.Seq.
+func (e *BackupEngine) createStoreBackup(g *Graph, bs BackupStore, info *BackupInfo) (*BackupInfo, error) {
+	if g.changes != nil {
+		var err error
+		if info.Seq, err = g.lastSeq(); err != nil {
+			return nil, err
+		}
+	}
+	if err := bs.CreateBackup(e.dir, info); err != nil {
+		return nil, err
+	}
+	if err := e.writeMeta(info); err != nil {
+		return nil, err
+	}
+	log.Printf("CreateBackup %d store=%s bytes=%d seq=%d", info.ID, info.Store, info.Bytes, info.Seq)
+	return info, nil
+}
+
+func (e *BackupEngine) writeMeta(info *BackupInfo) error {
+	bs, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.filename(info.ID, ".meta"), bs, 0644)
+}
+
+// reserve picks the backup's ID by creating its temporary data file,
+// which fails if another backup has the same ID.  Skips IDs that
+// concurrent backups have taken (or that crashed backups left
+// behind).
+func (e *BackupEngine) reserve(info *BackupInfo) (*os.File, string, error) {
+	for ; ; info.ID++ {
+		tmp := e.filename(info.ID, ".data.tmp")
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// A concurrent backup might have finished with this ID.
+		if _, err = os.Stat(e.filename(info.ID, ".data")); err == nil {
+			f.Close()
+			os.Remove(tmp)
+			continue
+		}
+		return f, tmp, nil
+	}
+}
+
+// checkBackup compares the backup's data with its checksum.
+func (e *BackupEngine) checkBackup(info *BackupInfo) error {
+	in, err := os.Open(e.filename(info.ID, ".data"))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	crc := crc32.NewIEEE()
+	if _, err = io.Copy(crc, in); err != nil {
+		return err
+	}
+	if crc.Sum32() != info.CRC {
+		return fmt.Errorf("Backup %d has a bad checksum", info.ID)
+	}
+	return nil
+}
+
+// readBackup calls f on each record in the backup's data.  Checks the
+// data first.
+func (e *BackupEngine) readBackup(info *BackupInfo, f func(k []byte, v []byte) error) error {
+	if err := e.checkBackup(info); err != nil {
+		return err
+	}
+	in, err := os.Open(e.filename(info.ID, ".data"))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	for {
+		k, v, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = f(k, v); err != nil {
+			return err
+		}
+	}
+}
+
+// Restore restores the given backup (0 means the latest) into the
+// given store, which should be empty.  Doesn't close the store.
+func (e *BackupEngine) Restore(id int, db Store) error {
+	backups, err := e.Backups()
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("No backups in %s", e.dir)
+	}
+	if id == 0 {
+		id = backups[len(backups)-1].ID
+	}
+	target := -1
+	full := -1
+	for n, info := range backups {
+		if info.ID <= id && info.Full {
+			full = n
+		}
+		if info.ID == id {
+			target = n
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("No backup %d in %s", id, e.dir)
+	}
+	if full < 0 {
+		return fmt.Errorf("No full backup before %d in %s", id, e.dir)
+	}
+
+	i := db.NewIterator(nil)
+	i.Seek([]byte{})
+	empty := !i.Valid()
+	i.Close()
+	if !empty {
+		return fmt.Errorf("Can't restore into a store that has data")
+	}
+
+	if store := backups[target].Store; store != "" {
+		bs, ok := db.(BackupStore)
+		if !ok {
+			return fmt.Errorf("Backup %d is a %s backup, which store %T can't restore", id, store, db)
+		}
+		if err = bs.RestoreBackup(e.dir, id); err != nil {
+			return err
+		}
+		log.Printf("Restore restored %s backup %d", store, id)
+		return nil
+	}
+
+	batch := db.NewBatch()
+	pending := 0
+	err = e.readBackup(&backups[full], func(k []byte, v []byte) error {
+		batch.Put(k, v)
+		pending++
+		if pending == restoreBatchSize {
+			pending = 0
+			err := db.Write(nil, batch)
+			batch.Clear()
+			return err
+		}
+		return nil
+	})
+	if err == nil && 0 < pending {
+		err = db.Write(nil, batch)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Restore loaded full backup %d", backups[full].ID)
+
+	g, err := NewGraphWithStore(db)
+	if err != nil {
+		return err
+	}
+	if g.indexes, err = ParseIndexes(backups[full].Indexes); err != nil {
+		return err
+	}
+	for n := full + 1; n <= target; n++ {
+		if err = e.replay(g, &backups[n]); err != nil {
+			return err
+		}
+		log.Printf("Restore applied incremental backup %d", backups[n].ID)
+	}
+	return nil
+}
+
+// replay applies an incremental backup's changes.  Consecutive
+// changes of the same kind are written together.
+func (e *BackupEngine) replay(g *Graph, info *BackupInfo) error {
+	triples := make([]*Triple, 0, restoreBatchSize)
+	del := false
+	flush := func() error {
+		if len(triples) == 0 {
+			return nil
+		}
+		var err error
+		if del {
+			err = g.DeleteIndexedTriples(triples, nil)
+		} else {
+			err = g.WriteIndexedTriples(triples, nil)
+		}
+		triples = triples[0:0]
+		return err
+	}
+	err := e.readBackup(info, func(k []byte, v []byte) error {
+		c, err := decodeChange(k, v)
+		if err != nil {
+			return err
+		}
+		if c.Delete != del || len(triples) == restoreBatchSize {
+			if err = flush(); err != nil {
+				return err
+			}
+			del = c.Delete
+		}
+		triples = append(triples, &c.Triple)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Checkpoint writes a consistent copy of the database to the given
+// directory, which can then be opened like any other database.  The
+// store has to support checkpoints (see Checkpointer).
+func (g *Graph) Checkpoint(dir string) error {
+	cp, ok := g.db.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("Store %T can't checkpoint", g.db)
+	}
+	return cp.Checkpoint(dir)
+}
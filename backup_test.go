@@ -0,0 +1,213 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygraph-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	engine, err := OpenBackupEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.indexes = []Index{SPO, OPS, POS}
+	if err = g.EnableChangelog(); err != nil {
+		t.Fatal(err)
+	}
+	g.WriteIndexedTriple(TripleFromStrings("bk1", "bkp", "bk2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("bk2", "bkp", "bk3"), nil)
+
+	first, err := engine.CreateBackup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Full {
+		t.Error("First backup should be full")
+	}
+
+	g.DeleteIndexedTriple(TripleFromStrings("bk1", "bkp", "bk2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("bk3", "bkp", "bk4"), nil)
+	second, err := engine.CreateBackup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Full || second.Records != 2 {
+		t.Errorf("Expected an incremental backup of %d records but got %v", 2, second)
+	}
+
+	restore := func(id int) *Graph {
+		db := NewMemoryStore()
+		if err := engine.Restore(id, db); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewGraphWithStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := restore(first.ID)
+	if n := len(r.Scan(SPO, nil, nil)); n != 2 {
+		t.Errorf("Expected %d triples but got %d", 2, n)
+	}
+	r = restore(0)
+	if got := r.Scan(SPO, nil, nil); len(got) != 2 || string(got[0].S) != "bk2" {
+		t.Errorf("Unexpected %v", got)
+	}
+	// POS came back too.
+	if n := len(r.Scan(POS, TripleFromStrings("bkp", "bk4"), nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+	if n := r.LastChange(); n != g.LastChange() {
+		t.Errorf("Expected last change %d but got %d", g.LastChange(), n)
+	}
+
+	// After a write that isn't logged, the next backup is full.  An
+	// ID that's taken (here, by a crashed backup) is skipped.
+	if _, err = g.Reindex(SPO, PSO); err != nil {
+		t.Fatal(err)
+	}
+	g.WriteIndexedTriple(TripleFromStrings("bk4", "bkp", "bk5"), nil)
+	ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.data.tmp", second.ID+1)), nil, 0644)
+	third, err := engine.CreateBackup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !third.Full || third.ID != second.ID+2 {
+		t.Errorf("Expected a full backup %d but got %v", second.ID+2, third)
+	}
+	r = restore(0)
+	if n := len(r.Scan(PSO, TripleFromStrings("bkp"), nil)); n != 3 {
+		t.Errorf("Expected %d triples but got %d", 3, n)
+	}
+
+	if _, err = OpenBackupDir(filepath.Join(dir, "nope")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing directory but got %v", err)
+	}
+
+	if err = engine.Restore(0, r.Store()); err == nil {
+		t.Error("Restore should want an empty store")
+	}
+	if err = g.Checkpoint(dir); err == nil {
+		t.Error("The memory store shouldn't checkpoint")
+	}
+}
+
+// copyingStore is a MemoryStore that makes its own backups by copying
+// every key.
+type copyingStore struct {
+	*MemoryStore
+	backups map[int]map[string][]byte
+}
+
+func (s *copyingStore) CreateBackup(dir string, info *BackupInfo) error {
+	data := make(map[string][]byte)
+	i := s.NewIterator(nil)
+	for i.Seek([]byte{}); i.Valid(); i.Next() {
+		data[string(i.Key())] = i.Value()
+	}
+	i.Close()
+	info.ID = len(s.backups) + 1
+	info.Store = "copying"
+	s.backups[info.ID] = data
+	return nil
+}
+
+func (s *copyingStore) RestoreBackup(dir string, id int) error {
+	for k, v := range s.backups[id] {
+		if err := s.Put(nil, []byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStoreBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygraph-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	engine, err := OpenBackupEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups := make(map[int]map[string][]byte)
+	g, err := NewGraphWithStore(&copyingStore{NewMemoryStore(), backups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.WriteIndexedTriple(TripleFromStrings("sb1", "sbp", "sb2"), nil)
+	if _, err = engine.CreateBackup(g); err != nil {
+		t.Fatal(err)
+	}
+	g.WriteIndexedTriple(TripleFromStrings("sb2", "sbp", "sb3"), nil)
+	info, err := engine.CreateBackup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != 2 || info.Store != "copying" {
+		t.Errorf("Unexpected %v", info)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "2.data")); !os.IsNotExist(err) {
+		t.Errorf("Expected no logical data but got %v", err)
+	}
+	if listed, err := engine.Backups(); err != nil || len(listed) != 2 || listed[1].Store != "copying" {
+		t.Errorf("Unexpected %v (%v)", listed, err)
+	}
+
+	db := &copyingStore{NewMemoryStore(), backups}
+	if err = engine.Restore(1, db); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewGraphWithStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.Scan(SPO, nil, nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+
+	// A store without its own backups can't use them.
+	if err = engine.Restore(0, NewMemoryStore()); err == nil {
+		t.Error("A MemoryStore shouldn't restore a copying backup")
+	}
+	m, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = engine.CreateBackup(m); err == nil {
+		t.Error("A logical backup shouldn't join copying backups")
+	}
+}
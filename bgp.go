@@ -0,0 +1,371 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Basic graph patterns: sets of triple patterns with variables.
+//
+//   ?x label "Africa" . ?x part_holonym ?y . ?y label ?name
+//
+// Each pattern has a subject, predicate, object, and (optionally) a
+// graph.  Each of those is a variable (?name), a quoted string, an
+// <IRI> (without the brackets), or a bare word.  Patterns are separated
+// by '.'.
+//
+// Matching is a nested-loop join: pick a pattern, look up its matches
+// with DoMatching() (which picks an index), bind its variables, and go
+// on to the next pattern with those bindings.  The order is chosen
+// once, up front: next is the pattern with the most positions bound
+// (by constants or by variables bound earlier), with ties going to the
+// pattern whose constants match the fewest triples (see
+// EstimateMatching()).
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A PatternTerm is a variable (if Var isn't empty) or a constant.
+type PatternTerm struct {
+	Var   string
+	Value []byte
+}
+
+// A TriplePattern is a triple (and optional graph) of PatternTerms.
+type TriplePattern struct {
+	S PatternTerm
+	P PatternTerm
+	O PatternTerm
+	G PatternTerm
+}
+
+// A BGP is a basic graph pattern: all its patterns have to match.
+type BGP []TriplePattern
+
+// Bindings map variable names (without the '?') to values.
+type Bindings map[string][]byte
+
+func (t PatternTerm) String() string {
+	if t.Var != "" {
+		return "?" + t.Var
+	}
+	return strconv.Quote(string(t.Value))
+}
+
+func (tp TriplePattern) terms() []PatternTerm {
+	return []PatternTerm{tp.S, tp.P, tp.O, tp.G}
+}
+
+func (tp TriplePattern) String() string {
+	acc := tp.S.String() + " " + tp.P.String() + " " + tp.O.String()
+	if tp.G.Var != "" || tp.G.Value != nil {
+		acc += " " + tp.G.String()
+	}
+	return acc
+}
+
+func (b BGP) String() string {
+	acc := make([]string, 0, len(b))
+	for _, tp := range b {
+		acc = append(acc, tp.String())
+	}
+	return strings.Join(acc, " . ")
+}
+
+// Vars returns the BGP's variables in the order they first appear.
+func (b BGP) Vars() []string {
+	acc := make([]string, 0, 4)
+	seen := make(map[string]bool)
+	for _, tp := range b {
+		for _, t := range tp.terms() {
+			if t.Var != "" && !seen[t.Var] {
+				seen[t.Var] = true
+				acc = append(acc, t.Var)
+			}
+		}
+	}
+	return acc
+}
+
+// Strings returns the bindings as strings.
+func (bs Bindings) Strings() map[string]string {
+	acc := make(map[string]string, len(bs))
+	for k, v := range bs {
+		acc[k] = string(v)
+	}
+	return acc
+}
+
+func (bs Bindings) copy() Bindings {
+	acc := make(Bindings, len(bs))
+	for k, v := range bs {
+		acc[k] = v
+	}
+	return acc
+}
+
+// patternTokens splits a pattern string into terms and '.'s.
+func patternTokens(s string) ([]string, error) {
+	acc := make([]string, 0, 8)
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if len(s) <= j {
+				return nil, fmt.Errorf("Unterminated string at %d in %q", i, s)
+			}
+			acc = append(acc, s[i:j+1])
+			i = j + 1
+		case c == '<':
+			j := strings.IndexByte(s[i:], '>')
+			if j < 0 {
+				return nil, fmt.Errorf("Unterminated IRI at %d in %q", i, s)
+			}
+			acc = append(acc, s[i:i+j+1])
+			i += j + 1
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t\n\r", rune(s[j])); j++ {
+			}
+			token := s[i:j]
+			// "?y." is "?y" and then ".".
+			if 1 < len(token) && token[0] == '?' && strings.HasSuffix(token, ".") {
+				acc = append(acc, token[:len(token)-1], ".")
+			} else {
+				acc = append(acc, token)
+			}
+			i = j
+		}
+	}
+	return acc, nil
+}
+
+func parseTerm(token string) (PatternTerm, error) {
+	switch {
+	case strings.HasPrefix(token, "?"):
+		if len(token) == 1 {
+			return PatternTerm{}, fmt.Errorf("Variable without a name")
+		}
+		return PatternTerm{Var: token[1:]}, nil
+	case strings.HasPrefix(token, `"`):
+		s, err := strconv.Unquote(token)
+		if err != nil {
+			return PatternTerm{}, fmt.Errorf("Bad string %s", token)
+		}
+		return PatternTerm{Value: []byte(s)}, nil
+	case strings.HasPrefix(token, "<"):
+		return PatternTerm{Value: []byte(token[1 : len(token)-1])}, nil
+	}
+	return PatternTerm{Value: []byte(token)}, nil
+}
+
+// ParseBGP parses triple patterns like '?x label "Africa" . ?x
+// part_holonym ?y'.
+func ParseBGP(s string) (BGP, error) {
+	tokens, err := patternTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	acc := make(BGP, 0, 4)
+	terms := make([]PatternTerm, 0, 4)
+	end := func() error {
+		switch len(terms) {
+		case 0:
+			return nil
+		case 3, 4:
+			tp := TriplePattern{terms[0], terms[1], terms[2], PatternTerm{}}
+			if len(terms) == 4 {
+				tp.G = terms[3]
+			}
+			acc = append(acc, tp)
+			terms = terms[:0]
+			return nil
+		}
+		return fmt.Errorf("Pattern with %d terms (want 3 or 4) in %q", len(terms), s)
+	}
+	for _, token := range tokens {
+		if token == "." {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		term, err := parseTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	if len(acc) == 0 {
+		return nil, fmt.Errorf("No patterns in %q", s)
+	}
+	return acc, nil
+}
+
+// value returns the term's value given the bindings (or nil).
+func (t PatternTerm) value(bs Bindings) []byte {
+	if t.Var != "" {
+		return bs[t.Var]
+	}
+	return t.Value
+}
+
+// query returns the triple to give DoMatching().
+func (tp TriplePattern) query(bs Bindings) *Triple {
+	return &Triple{tp.S.value(bs), tp.P.value(bs), tp.O.value(bs), tp.G.value(bs)}
+}
+
+// bound counts the pattern's positions that are constants or bound
+// variables.
+func (tp TriplePattern) bound(vars map[string]bool) int {
+	n := 0
+	for _, t := range tp.terms() {
+		if (t.Var == "" && t.Value != nil) || vars[t.Var] {
+			n++
+		}
+	}
+	return n
+}
+
+// order returns the patterns in the order to join them, given the
+// variables that are already bound.
+func (g *Graph) order(b BGP, bound Bindings) BGP {
+	vars := make(map[string]bool, len(bound))
+	for k := range bound {
+		vars[k] = true
+	}
+	counts := make([]int64, len(b))
+	for i, tp := range b {
+		n, _, err := g.EstimateMatching(tp.query(nil))
+		if err != nil {
+			n = 0
+		}
+		counts[i] = n
+	}
+
+	acc := make(BGP, 0, len(b))
+	used := make([]bool, len(b))
+	for len(acc) < len(b) {
+		best := -1
+		for i, tp := range b {
+			if used[i] {
+				continue
+			}
+			if best < 0 || b[best].bound(vars) < tp.bound(vars) ||
+				(b[best].bound(vars) == tp.bound(vars) && counts[i] < counts[best]) {
+				best = i
+			}
+		}
+		used[best] = true
+		acc = append(acc, b[best])
+		for _, t := range b[best].terms() {
+			if t.Var != "" {
+				vars[t.Var] = true
+			}
+		}
+	}
+	return acc
+}
+
+// bind extends the bindings with the triple's values for the pattern's
+// unbound variables.  Returns the variables it bound, and false if the
+// triple doesn't fit (when a variable appears twice in the pattern).
+func (tp TriplePattern) bind(t *Triple, bs Bindings) ([]string, bool) {
+	added := make([]string, 0, 3)
+	terms := tp.terms()
+	for i, value := range [][]byte{t.S, t.P, t.O, t.V} {
+		term := terms[i]
+		if term.Var == "" {
+			continue
+		}
+		if have, ok := bs[term.Var]; ok {
+			if string(have) != string(value) {
+				for _, v := range added {
+					delete(bs, v)
+				}
+				return nil, false
+			}
+			continue
+		}
+		bs[term.Var] = value
+		added = append(added, term.Var)
+	}
+	return added, true
+}
+
+// DoBGP calls f with the bindings for each match of the BGP, starting
+// with the given bindings (which can be nil).  Stops if f returns
+// false.  f can keep the bindings it gets.
+func (g *Graph) DoBGP(b BGP, bound Bindings, f func(Bindings) bool) error {
+	bs := Bindings{}
+	for k, v := range bound {
+		bs[k] = v
+	}
+	_, err := g.join(g.order(b, bound), bs, f)
+	return err
+}
+
+// join matches the first pattern and joins the rest.  Returns false
+// when it's time to stop.
+func (g *Graph) join(b BGP, bs Bindings, f func(Bindings) bool) (bool, error) {
+	if len(b) == 0 {
+		return f(bs.copy()), nil
+	}
+	if err := g.context().Err(); err != nil {
+		return false, err
+	}
+	tp := b[0]
+	more := true
+	var failed error
+	err := g.DoMatching(tp.query(bs), nil, func(t *Triple) bool {
+		added, ok := tp.bind(t, bs)
+		if !ok {
+			return true
+		}
+		more, failed = g.join(b[1:], bs, f)
+		for _, v := range added {
+			delete(bs, v)
+		}
+		return more && failed == nil
+	})
+	if err == nil {
+		err = failed
+	}
+	return more && err == nil, err
+}
+
+// MatchBGP returns the bindings for at most 'limit' matches of the
+// BGP (all of them if 'limit' is negative).
+func (g *Graph) MatchBGP(b BGP, limit int64) ([]Bindings, error) {
+	acc := make([]Bindings, 0, 0)
+	if limit == 0 {
+		return acc, nil
+	}
+	err := g.DoBGP(b, nil, func(bs Bindings) bool {
+		acc = append(acc, bs)
+		return limit < 0 || int64(len(acc)) < limit
+	})
+	return acc, err
+}
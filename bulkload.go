@@ -0,0 +1,339 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Offline bulk loading.
+//
+// Instead of pushing every triple through write batches, BulkLoad
+// works in phases:
+//
+// 1. sort: Parse the files and generate the keys for every index.
+//    Sort them in runs of 'runSize' keys and write each run to a file
+//    in a scratch directory.
+//
+// 2. ingest: Merge the runs into a single sorted stream of keys
+//    (dropping duplicates) and give that stream to the store.  A
+//    store that's a SortedIngester can build its files directly
+//    (RocksStore writes SST files and then uses IngestExternalFile).
+//    Otherwise the keys are written in order in big batches.
+//
+// Since all keys arrive in order, the store doesn't have to sort
+// anything.  Bulk loads aren't recorded in the changelog.  If the
+// graph keeps stats, a final "stats" phase rebuilds them.
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultBulkLoadRunSize is the default number of keys sorted in
+// memory at a time.
+const DefaultBulkLoadRunSize = 1 << 22
+
+// Number of keys per write batch when a store can't ingest.
+const bulkLoadBatchSize = 10000
+
+// A SortedIngester is a Store that can load keys given in sorted
+// order without going through its usual write path.  'next' returns
+// false when there are no more keys.
+type SortedIngester interface {
+	IngestSorted(next func() ([]byte, []byte, bool)) (int, error)
+}
+
+type BulkLoadPhase struct {
+	Name    string
+	Elapsed time.Duration
+}
+
+type BulkLoadStats struct {
+	Triples int
+	Keys    int
+	Runs    int
+	Phases  []BulkLoadPhase
+}
+
+func (s *BulkLoadStats) String() string {
+	acc := fmt.Sprintf("triples %d keys %d runs %d", s.Triples, s.Keys, s.Runs)
+	for _, phase := range s.Phases {
+		acc += fmt.Sprintf(" %s %v", phase.Name, phase.Elapsed)
+	}
+	return acc
+}
+
+// BulkLoad loads the given triple files using the scratch directory
+// for sorted runs.  Use 0 for DefaultBulkLoadRunSize.
+func (g *Graph) BulkLoad(filenames []string, scratch string, runSize int) (*BulkLoadStats, error) {
+	if g.snapshot != nil {
+		return nil, ErrSnapshotWrite
+	}
+	if runSize <= 0 {
+		runSize = DefaultBulkLoadRunSize
+	}
+	if g.changes != nil {
+		log.Printf("BulkLoad warning: changes won't be in the changelog")
+		if err := g.noteUnlogged(); err != nil {
+			return nil, err
+		}
+	}
+	// Stale until the "stats" phase.
+	if err := g.staleStats(); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(scratch, "bulkload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	stats := &BulkLoadStats{}
+	then := time.Now()
+	phase := func(name string) {
+		now := time.Now()
+		stats.Phases = append(stats.Phases, BulkLoadPhase{name, now.Sub(then)})
+		log.Printf("BulkLoad %s done in %v", name, now.Sub(then))
+		then = now
+	}
+
+	runs, err := g.bulkSort(filenames, dir, runSize, stats)
+	if err != nil {
+		return stats, err
+	}
+	stats.Runs = len(runs)
+	phase("sort")
+
+	m, err := newRunMerger(runs)
+	if err != nil {
+		return stats, err
+	}
+	defer m.close()
+
+	if ingester, ok := g.db.(SortedIngester); ok {
+		stats.Keys, err = ingester.IngestSorted(m.next)
+	} else {
+		stats.Keys, err = writeSorted(g.db, m.next, g.wopts)
+	}
+	if err == nil {
+		err = m.err
+	}
+	phase("ingest")
+
+	if err == nil && g.stats != nil {
+		err = g.rebuildStats()
+		phase("stats")
+	}
+
+	return stats, err
+}
+
+// bulkSort writes sorted runs of index keys.  Returns the run
+// filenames.
+func (g *Graph) bulkSort(filenames []string, dir string, runSize int, stats *BulkLoadStats) ([]string, error) {
+	runs := make([]string, 0, 16)
+	keys := make([]string, 0, runSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		sort.Strings(keys)
+		name := filepath.Join(dir, fmt.Sprintf("run%06d", len(runs)))
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		for _, k := range keys {
+			if err = writeRecord(w, []byte(k), nil); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		runs = append(runs, name)
+		keys = keys[0:0]
+		return err
+	}
+
+	batch := make([]*Triple, 0, 1000)
+	add := func() error {
+		interned, err := g.internTriples(batch)
+		if err != nil {
+			return err
+		}
+		for _, t := range interned {
+			for _, index := range g.indexes {
+				keys = append(keys, string(t.IndexKey(index)))
+			}
+			if runSize <= len(keys) {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		}
+		stats.Triples += len(batch)
+		batch = batch[0:0]
+		return nil
+	}
+
+	for _, filename := range filenames {
+		log.Printf("BulkLoad reading %s", filename)
+		c := make(chan *Triple)
+		read := make(chan error, 1)
+		go func(filename string) {
+			read <- ReadTriplesFile(c, filename)
+		}(filename)
+		var err error
+		for t := range c {
+			if err != nil {
+				continue // Drain.
+			}
+			batch = append(batch, t)
+			if len(batch) == cap(batch) {
+				err = add()
+			}
+		}
+		if rerr := <-read; err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return runs, err
+		}
+	}
+	if err := add(); err != nil {
+		return runs, err
+	}
+	return runs, flush()
+}
+
+// A runMerger merges sorted runs.
+type runMerger struct {
+	runs []*bufio.Reader
+	fs   []*os.File
+	h    runHeap
+	last []byte
+	err  error
+}
+
+type runHead struct {
+	k   []byte
+	run int
+}
+
+type runHeap []runHead
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return string(h[i].k) < string(h[j].k) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(runHead)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[0 : len(old)-1]
+	return x
+}
+
+func newRunMerger(names []string) (*runMerger, error) {
+	m := &runMerger{}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.fs = append(m.fs, f)
+		m.runs = append(m.runs, bufio.NewReader(f))
+		if err = m.advance(len(m.runs) - 1); err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// advance pushes the next key from the given run (if any).
+func (m *runMerger) advance(run int) error {
+	k, _, err := readRecord(m.runs[run])
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	heap.Push(&m.h, runHead{k, run})
+	return nil
+}
+
+// next returns the next distinct key.  Check m.err at the end.
+func (m *runMerger) next() ([]byte, []byte, bool) {
+	for 0 < m.h.Len() {
+		head := heap.Pop(&m.h).(runHead)
+		if err := m.advance(head.run); err != nil {
+			m.err = err
+			return nil, nil, false
+		}
+		if m.last != nil && string(m.last) == string(head.k) {
+			continue
+		}
+		m.last = head.k
+		return head.k, nil, true
+	}
+	return nil, nil, false
+}
+
+func (m *runMerger) close() {
+	for _, f := range m.fs {
+		f.Close()
+	}
+}
+
+// writeSorted writes keys in big batches.
+func writeSorted(db Store, next func() ([]byte, []byte, bool), opts *WriteOptions) (int, error) {
+	n := 0
+	pending := 0
+	batch := db.NewBatch()
+	for {
+		k, v, ok := next()
+		if !ok {
+			break
+		}
+		batch.Put(k, v)
+		n++
+		pending++
+		if pending == bulkLoadBatchSize {
+			if err := db.Write(opts, batch); err != nil {
+				return n, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+	if 0 < pending {
+		if err := db.Write(opts, batch); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
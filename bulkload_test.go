@@ -0,0 +1,96 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBulkLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygraph-bulkload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "triples.nt")
+	err = ioutil.WriteFile(filename, []byte(`<bl1> <blp> <bl2> .
+<bl2> <blp> <bl3> <g1> .
+<bl3> <blq> "three" .
+<bl1> <blp> <bl2> .
+<bl4> <blp> <bl1> .
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err = g.EnableDictionary(10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tiny runs, so there's merging to do.
+	stats, err := g.BulkLoad([]string{filename}, dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Triples != 5 || stats.Keys != 12 || stats.Runs < 3 || len(stats.Phases) != 2 {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+
+	if n := len(g.Scan(SPO, nil, nil)); n != 4 {
+		t.Errorf("Expected %d triples but got %d", 4, n)
+	}
+	paths := Out([]byte("blp")).Out([]byte("blp")).Walk(g, Vertex("bl4")).Collect()
+	if len(paths) != 1 || string(paths[0][1].V) != "" {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+	if got := g.ScanGraph([]byte("g1"), nil, nil); len(got) != 1 || string(got[0].S) != "bl2" {
+		t.Errorf("Unexpected %v", got)
+	}
+	if n := len(g.Scan(OPS, TripleFromStrings("three"), nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+}
+
+func TestBulkLoadReadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinygraph-bulkload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Not really gzipped.
+	gz := filepath.Join(dir, "triples.nt.gz")
+	if err = ioutil.WriteFile(gz, []byte("<bl1> <blp> <bl2> .\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for _, filename := range []string{"/nonexistent/file.nt", gz} {
+		if _, err = g.BulkLoad([]string{filename}, dir, 0); err == nil {
+			t.Errorf("Expected an error from %s", filename)
+		}
+	}
+}
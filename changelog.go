@@ -0,0 +1,372 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// An optional changelog (change data capture).  When a graph has a
+// changelog, every triple written or deleted through
+// WriteIndexedTriple(s), DeleteIndexedTriple(s), DeleteMatching,
+// DropGraph, and Txn.Commit gets a sequence number.  The changes are
+// written in their own key range in the same batch as the index
+// changes, so the log and the indexes can't disagree.  IndexTriple,
+// WriteTriple, and WriteBatch, which write just one index or no index
+// at all, return ErrUnloggedWrite instead.
+//
+// Sequence numbers start at 1 and increase without gaps.  A delete
+// is logged even if the triple didn't exist.  Triples in the log
+// have terms rather than dictionary IDs, so consumers don't need the
+// dictionary.
+//
+// The log grows until TruncateChanges() trims it.
+//
+// BulkLoad, Reindex, DropIndex, and Repair change keys without logging
+// them.  They record the last change before they started (see
+// noteUnlogged), and CreateBackup makes a full backup when there's
+// been such a write since the previous backup.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+const changePrefix = byte(0x20) // sequence number -> change
+
+// Number of changes a ChangeFeed reads at a time.
+const changeFeedBatchSize = 1000
+
+// The next sequence number.  Its presence means the database has a
+// changelog.
+var changelogKey = []byte("\xff\xfftinygraph.changelog")
+
+// The last change before the latest write that wasn't logged.
+var unloggedKey = []byte("\xff\xfftinygraph.unlogged")
+
+var ErrNoChangelog = errors.New("Graph doesn't have a changelog")
+
+var ErrUnloggedWrite = errors.New("Can't write around the changelog")
+
+// A Change is a triple written (or deleted) at some point in the
+// changelog.
+type Change struct {
+	Seq    uint64
+	Delete bool
+	Triple Triple
+}
+
+type changelog struct {
+	sync.Mutex // Held while assigning sequence numbers.
+	next       uint64
+	wake       chan struct{} // Closed (and replaced) after each write.
+	closed     chan struct{}
+}
+
+func changeKey(seq uint64) []byte {
+	bs := make([]byte, 9)
+	bs[0] = changePrefix
+	binary.BigEndian.PutUint64(bs[1:], seq)
+	return bs
+}
+
+func encodeChange(c *Change) []byte {
+	op := byte('P')
+	if c.Delete {
+		op = 'D'
+	}
+	return append([]byte{op}, c.Triple.Key()...)
+}
+
+func decodeChange(k []byte, v []byte) (*Change, error) {
+	if len(k) != 9 || k[0] != changePrefix || len(v) == 0 {
+		return nil, fmt.Errorf("Bad change %q %q", k, v)
+	}
+	t, err := TripleFromBytes(v[1:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Change{binary.BigEndian.Uint64(k[1:]), v[0] == 'D', *t}, nil
+}
+
+// MarshalJSON gives a change as
+// {"seq":3,"op":"put","s":"a","p":"p","o":"b","g":""}.
+func (c Change) MarshalJSON() ([]byte, error) {
+	op := "put"
+	if c.Delete {
+		op = "delete"
+	}
+	return json.Marshal(struct {
+		Seq uint64 `json:"seq"`
+		Op  string `json:"op"`
+		S   string `json:"s"`
+		P   string `json:"p"`
+		O   string `json:"o"`
+		G   string `json:"g"`
+	}{c.Seq, op, string(c.Triple.S), string(c.Triple.P), string(c.Triple.O), string(c.Triple.V)})
+}
+
+// EnableChangelog starts logging changes.  Changes made before the
+// changelog was enabled aren't in it.
+func (g *Graph) EnableChangelog() error {
+	if g.changes != nil {
+		return nil
+	}
+	bs, err := g.db.Get(g.ropts, changelogKey)
+	if err != nil {
+		return err
+	}
+	next := uint64(1)
+	if bs == nil {
+		if g.snapshot != nil {
+			return ErrSnapshotWrite
+		}
+		if err = g.db.Put(g.wopts, changelogKey, []byte(strconv.FormatUint(next, 10))); err != nil {
+			return err
+		}
+	} else {
+		if next, err = strconv.ParseUint(string(bs), 10, 64); err != nil {
+			return err
+		}
+	}
+	g.changes = &changelog{next: next, wake: make(chan struct{}), closed: make(chan struct{})}
+	return nil
+}
+
+// openChangelog enables the changelog if the database has one.
+func (g *Graph) openChangelog() error {
+	bs, err := g.db.Get(g.ropts, changelogKey)
+	if err != nil || bs == nil {
+		return err
+	}
+	return g.EnableChangelog()
+}
+
+// HasChangelog reports whether this graph logs changes.
+func (g *Graph) HasChangelog() bool {
+	return g.changes != nil
+}
+
+// noteUnlogged records that a write that won't be in the changelog is
+// about to happen.  Does nothing if the graph doesn't have a
+// changelog.
+func (g *Graph) noteUnlogged() error {
+	if g.changes == nil {
+		return nil
+	}
+	return g.db.Put(g.wopts, unloggedKey, []byte(strconv.FormatUint(g.LastChange(), 10)))
+}
+
+// lastUnlogged returns the change before the latest unlogged write
+// and false if there hasn't been one.  Reads with the graph's read
+// options, so it works on a snapshot.
+func (g *Graph) lastUnlogged() (uint64, bool, error) {
+	bs, err := g.db.Get(g.ropts, unloggedKey)
+	if err != nil || bs == nil {
+		return 0, false, err
+	}
+	seq, err := strconv.ParseUint(string(bs), 10, 64)
+	return seq, err == nil, err
+}
+
+// logged returns the changes for writing (or deleting) the given
+// triples.  Returns nil if the graph has neither a changelog nor
+// stats.
+func (g *Graph) logged(del bool, triples []*Triple) []Change {
+	if g.changes == nil && g.stats == nil {
+		return nil
+	}
+	acc := make([]Change, len(triples))
+	for i, t := range triples {
+		acc[i] = Change{0, del, *t}
+	}
+	return acc
+}
+
+// write adds the changes to the batch and writes it.
+func (cl *changelog) write(db Store, opts *WriteOptions, batch Batch, changes []Change) error {
+	cl.Lock()
+	defer cl.Unlock()
+	seq := cl.next
+	for i := range changes {
+		changes[i].Seq = seq
+		batch.Put(changeKey(seq), encodeChange(&changes[i]))
+		seq++
+	}
+	batch.Put(changelogKey, []byte(strconv.FormatUint(seq, 10)))
+	if err := db.Write(opts, batch); err != nil {
+		return err
+	}
+	cl.next = seq
+	close(cl.wake)
+	cl.wake = make(chan struct{})
+	return nil
+}
+
+// waiter returns a channel that's closed after the next write.
+func (cl *changelog) waiter() chan struct{} {
+	cl.Lock()
+	defer cl.Unlock()
+	return cl.wake
+}
+
+func (cl *changelog) close() {
+	cl.Lock()
+	defer cl.Unlock()
+	select {
+	case <-cl.closed:
+	default:
+		close(cl.closed)
+	}
+}
+
+// LastChange returns the sequence number of the most recent change.
+// Returns 0 if there haven't been any changes.
+func (g *Graph) LastChange() uint64 {
+	if g.changes == nil {
+		return 0
+	}
+	g.changes.Lock()
+	defer g.changes.Unlock()
+	return g.changes.next - 1
+}
+
+// Changes returns up to 'limit' changes starting at sequence number
+// 'from'.
+func (g *Graph) Changes(from uint64, limit int) ([]Change, error) {
+	if g.changes == nil {
+		return nil, ErrNoChangelog
+	}
+	acc := make([]Change, 0, 64)
+	i := g.db.NewIterator(g.ropts)
+	defer i.Close()
+	for i.Seek(changeKey(from)); i.Valid() && len(acc) < limit; i.Next() {
+		k := i.Key()
+		if k[0] != changePrefix {
+			break
+		}
+		c, err := decodeChange(k, i.Value())
+		if err != nil {
+			return acc, err
+		}
+		acc = append(acc, *c)
+	}
+	return acc, nil
+}
+
+// TruncateChanges removes the changes before the given sequence
+// number.  Returns the number of changes removed.
+func (g *Graph) TruncateChanges(before uint64) (int, error) {
+	if g.snapshot != nil {
+		return 0, ErrSnapshotWrite
+	}
+	if g.changes == nil {
+		return 0, ErrNoChangelog
+	}
+	i := g.db.NewIterator(g.ropts)
+	defer i.Close()
+	n := 0
+	batch := g.db.NewBatch()
+	pending := 0
+	for i.Seek(changeKey(0)); i.Valid(); i.Next() {
+		k := i.Key()
+		if k[0] != changePrefix || len(k) != 9 || before <= binary.BigEndian.Uint64(k[1:]) {
+			break
+		}
+		batch.Delete(k)
+		pending++
+		if pending == deleteBatchSize {
+			if err := g.db.Write(g.wopts, batch); err != nil {
+				return n, err
+			}
+			n += pending
+			pending = 0
+			batch.Clear()
+		}
+	}
+	if 0 < pending {
+		if err := g.db.Write(g.wopts, batch); err != nil {
+			return n, err
+		}
+		n += pending
+	}
+	return n, nil
+}
+
+// A ChangeFeed delivers changes in order on C, waiting for new ones
+// as needed.  C is closed when the feed (or the graph) is closed.
+type ChangeFeed struct {
+	C    chan Change
+	done chan struct{}
+	once sync.Once
+}
+
+// Subscribe starts a feed of changes beginning with sequence number
+// 'from'.  Close the feed when you are done with it.
+func (g *Graph) Subscribe(from uint64) (*ChangeFeed, error) {
+	if g.changes == nil {
+		return nil, ErrNoChangelog
+	}
+	f := &ChangeFeed{make(chan Change, *chanBufferSize), make(chan struct{}), sync.Once{}}
+	go f.run(g.live(), from)
+	return f, nil
+}
+
+func (f *ChangeFeed) run(g *Graph, from uint64) {
+	defer close(f.C)
+	for {
+		wake := g.changes.waiter()
+
+		// Hold the graph's read lock so it's not closed under us.
+		g.lock.RLock()
+		select {
+		case <-g.changes.closed:
+			g.lock.RUnlock()
+			return
+		default:
+		}
+		changes, err := g.Changes(from, changeFeedBatchSize)
+		g.lock.RUnlock()
+		if err != nil {
+			log.Printf("ChangeFeed stopping at %d: %v", from, err)
+			return
+		}
+
+		for _, c := range changes {
+			select {
+			case f.C <- c:
+			case <-f.done:
+				return
+			}
+			from = c.Seq + 1
+		}
+
+		if len(changes) == 0 {
+			select {
+			case <-wake:
+			case <-f.done:
+				return
+			case <-g.changes.closed:
+				return
+			}
+		}
+	}
+}
+
+// Close stops the feed.
+func (f *ChangeFeed) Close() {
+	f.once.Do(func() { close(f.done) })
+}
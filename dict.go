@@ -0,0 +1,317 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// An optional dictionary that interns terms as compact IDs.  When a
+// graph has a dictionary, index keys hold IDs instead of terms.
+// Writes intern terms, NewIndexIterator translates patterns to IDs,
+// and Iterator.Triple() translates IDs back to terms.  So callers
+// never see IDs.
+//
+// The dictionary has two key ranges: term -> ID and ID -> term.  IDs
+// are uvarints.  Terms are cached in memory (crudely), so a load only
+// reads the dictionary for terms it hasn't seen recently.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	termPrefix = byte(0x10) // term -> ID
+	idPrefix   = byte(0x11) // ID -> term
+
+	DefaultDictionaryCacheSize = 1 << 20
+)
+
+// The next unassigned ID.  Its presence means the database uses a
+// dictionary.
+var dictionaryKey = []byte("\xff\xfftinygraph.dictionary")
+
+type Dictionary struct {
+	sync.Mutex // Held while assigning IDs.
+	g          *Graph
+	next       uint64
+	ids        *termCache // term -> ID
+	terms      *termCache // ID -> term
+}
+
+// termCache is a map that just forgets everything when it gets too
+// big.
+type termCache struct {
+	sync.RWMutex
+	m     map[string][]byte
+	limit int
+}
+
+func newTermCache(limit int) *termCache {
+	return &termCache{m: make(map[string][]byte), limit: limit}
+}
+
+func (c *termCache) get(k []byte) ([]byte, bool) {
+	c.RLock()
+	v, ok := c.m[string(k)]
+	c.RUnlock()
+	return v, ok
+}
+
+func (c *termCache) set(k []byte, v []byte) {
+	c.Lock()
+	if c.limit <= len(c.m) {
+		c.m = make(map[string][]byte)
+	}
+	c.m[string(k)] = v
+	c.Unlock()
+}
+
+func dictKey(prefix byte, k []byte) []byte {
+	bs := make([]byte, 0, len(k)+1)
+	bs = append(bs, prefix)
+	return append(bs, k...)
+}
+
+func encodeID(id uint64) []byte {
+	bs := make([]byte, binary.MaxVarintLen64)
+	return bs[0:binary.PutUvarint(bs, id)]
+}
+
+// EnableDictionary turns on term interning.  A database that has
+// data without a dictionary can't start using one.
+func (g *Graph) EnableDictionary(cacheSize int) error {
+	if g.dict != nil {
+		return nil
+	}
+	bs, err := g.db.Get(g.ropts, dictionaryKey)
+	if err != nil {
+		return err
+	}
+	next := uint64(0)
+	if bs == nil {
+		if g.hasIndexedData() {
+			return fmt.Errorf("Can't add a dictionary to a database that has data")
+		}
+		if err = g.db.Put(g.wopts, dictionaryKey, []byte("0")); err != nil {
+			return err
+		}
+	} else {
+		if next, err = strconv.ParseUint(string(bs), 10, 64); err != nil {
+			return err
+		}
+	}
+	g.dict = &Dictionary{g: g, next: next, ids: newTermCache(cacheSize), terms: newTermCache(cacheSize)}
+	return nil
+}
+
+// openDictionary enables the dictionary (with caches of the given
+// size) if the database has one.
+func (g *Graph) openDictionary(cacheSize int) error {
+	bs, err := g.db.Get(g.ropts, dictionaryKey)
+	if err != nil || bs == nil {
+		return err
+	}
+	return g.EnableDictionary(cacheSize)
+}
+
+// HasDictionary reports whether this graph interns terms.
+func (g *Graph) HasDictionary() bool {
+	return g.dict != nil
+}
+
+// Dictionary returns the graph's dictionary, which is nil if the
+// graph doesn't intern terms.
+func (g *Graph) Dictionary() *Dictionary {
+	return g.dict
+}
+
+func (g *Graph) hasIndexedData() bool {
+	i := g.db.NewIterator(g.ropts)
+	defer i.Close()
+	for _, index := range AllIndexes {
+		i.Seek([]byte{byte(index)})
+		if i.Valid() && i.Key()[0] == byte(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// ID returns the ID for the given term.  Returns false if the term
+// hasn't been interned.
+func (d *Dictionary) ID(term []byte) ([]byte, bool, error) {
+	if id, ok := d.ids.get(term); ok {
+		return id, true, nil
+	}
+	id, err := d.g.db.Get(d.g.ropts, dictKey(termPrefix, term))
+	if err != nil || id == nil {
+		return nil, false, err
+	}
+	d.ids.set(term, id)
+	return id, true, nil
+}
+
+// Term returns the term for the given ID.
+func (d *Dictionary) Term(id []byte) ([]byte, error) {
+	if term, ok := d.terms.get(id); ok {
+		return term, nil
+	}
+	term, err := d.g.db.Get(d.g.ropts, dictKey(idPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+	if term == nil {
+		return nil, fmt.Errorf("Unknown term ID %x", id)
+	}
+	d.terms.set(id, term)
+	return term, nil
+}
+
+// Intern returns IDs for all of the given terms, assigning new IDs
+// as needed.  New assignments are written in a single batch.
+func (d *Dictionary) Intern(terms [][]byte) ([][]byte, error) {
+	acc := make([][]byte, len(terms))
+	missing := false
+	for i, term := range terms {
+		if id, ok := d.ids.get(term); ok {
+			acc[i] = id
+		} else {
+			missing = true
+		}
+	}
+	if !missing {
+		return acc, nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	batch := d.g.db.NewBatch()
+	assigned := make(map[string][]byte)
+	for i, term := range terms {
+		if acc[i] != nil {
+			continue
+		}
+		if id, ok := assigned[string(term)]; ok {
+			acc[i] = id
+			continue
+		}
+		id, ok, err := d.ID(term)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			id = encodeID(d.next)
+			d.next++
+			batch.Put(dictKey(termPrefix, term), id)
+			batch.Put(dictKey(idPrefix, id), term)
+			assigned[string(term)] = id
+		}
+		acc[i] = id
+	}
+
+	if 0 < len(assigned) {
+		batch.Put(dictionaryKey, []byte(strconv.FormatUint(d.next, 10)))
+		if err := d.g.db.Write(d.g.wopts, batch); err != nil {
+			return nil, err
+		}
+		for term, id := range assigned {
+			d.ids.set([]byte(term), id)
+			d.terms.set(id, []byte(term))
+		}
+	}
+
+	return acc, nil
+}
+
+// internTriples returns copies of the given triples with IDs
+// instead of terms.  An empty graph label stays empty.
+func (g *Graph) internTriples(triples []*Triple) ([]*Triple, error) {
+	if g.dict == nil {
+		return triples, nil
+	}
+	terms := make([][]byte, 0, 4*len(triples))
+	for _, t := range triples {
+		terms = append(terms, t.S, t.P, t.O)
+		if 0 < len(t.V) {
+			terms = append(terms, t.V)
+		}
+	}
+	ids, err := g.dict.Intern(terms)
+	if err != nil {
+		return nil, err
+	}
+	acc := make([]*Triple, len(triples))
+	at := 0
+	for i, t := range triples {
+		acc[i] = &Triple{ids[at], ids[at+1], ids[at+2], nil}
+		at += 3
+		if 0 < len(t.V) {
+			acc[i].V = ids[at]
+			at++
+		}
+	}
+	return acc, nil
+}
+
+// encodePattern returns a copy of the given pattern with IDs instead
+// of terms.  Empty components stay empty.  Returns false if some
+// term isn't known, in which case nothing can match.
+func (g *Graph) encodePattern(on *Triple) (*Triple, bool, error) {
+	if g.dict == nil || on == nil {
+		return on, true, nil
+	}
+	acc := &Triple{}
+	for _, c := range []struct {
+		from []byte
+		to   *[]byte
+	}{{on.S, &acc.S}, {on.P, &acc.P}, {on.O, &acc.O}, {on.V, &acc.V}} {
+		if len(c.from) == 0 {
+			continue
+		}
+		id, ok, err := g.dict.ID(c.from)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		*c.to = id
+	}
+	return acc, true, nil
+}
+
+// decodeTerm returns the term for the given ID.
+func (g *Graph) decodeTerm(bs []byte) ([]byte, error) {
+	if g.dict == nil {
+		return bs, nil
+	}
+	return g.dict.Term(bs)
+}
+
+// decodeTriple replaces IDs with terms in place.
+func (g *Graph) decodeTriple(t *Triple) error {
+	if g.dict == nil {
+		return nil
+	}
+	for _, c := range []*[]byte{&t.S, &t.P, &t.O, &t.V} {
+		if c == &t.V && len(t.V) == 0 {
+			continue
+		}
+		term, err := g.dict.Term(*c)
+		if err != nil {
+			return err
+		}
+		*c = term
+	}
+	return nil
+}
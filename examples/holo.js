@@ -1,16 +1,12 @@
 function holonyms(term) {
     var label = G.Bs("http://www.w3.org/2000/01/rdf-schema#label");
     var holo = G.Bs("http://wordnet-rdf.princeton.edu/ontology#part_holonym");
-    var paths = G.In(label).Out(holo).Out(label).Walk(G.Graph(), G.Vertex(term)).Collect();
-    var uniq = {};
+    var rows = G.Select(G.In(label).Out(holo).Out(label).As("name").Dedup().Paths(G.Graph(), G.Vertex(term)), "name");
     var acc = [];
-    for (var i=0; i<paths.length; i++) {
-	var h = paths[i][2].Strings()[2];
+    for (var i=0; i<rows.length; i++) {
+	var h = rows[i].name;
 	console.log(h);
-	if (!uniq[h]) {
-            uniq[h] = true;
-	    acc.push(h);
-	}
+	acc.push(h);
     }
     return acc;
 }
@@ -20,22 +20,17 @@ function labels(id) {
     return acc;
 }
 
-function collect(rel, id, acc, uniq, recursive, reverse, maxDepth, depth) {
-    console.log("collect", id, "depth", depth, "labels", labels(id));
-    var paths;
-    if (reverse) {
-	paths = G.In(rel).Walk(G.Graph(), G.Vertex(id)).Collect();
-    } else {
-	paths = G.Out(rel).Walk(G.Graph(), G.Vertex(id)).Collect();
-    }
+function collect(rel, id, acc, uniq, reverse, maxDepth) {
+    console.log("collect", id, "labels", labels(id));
+    var step = reverse ? G.In(rel) : G.Out(rel);
+    // Repeat() doesn't revisit vertexes, and path.length is the depth.
+    var paths = G.Repeat(step, 1, maxDepth).Emit().Walk(G.Graph(), G.Vertex(id)).Collect();
     for (var i=0; i<paths.length; i++) {
-	var h = paths[i][0].Strings()[2];
+	var path = paths[i];
+	var h = path[path.length-1].Strings()[2];
 	if (!uniq[h]) {
             uniq[h] = true;
-	    acc.push({labels: labels(h), depth: depth});
-	    if (recursive && depth <= maxDepth) {
-		collect(rel, h, acc, uniq, recursive, reverse, maxDepth, depth+1);
-	    }
+	    acc.push({labels: labels(h), depth: path.length-1});
 	}
     }
 }
@@ -45,7 +40,7 @@ function recurse(rel, reverse, maxDepth, term) {
     var uniq = {};
     var ids = find(term);
     for (var i=0; i<ids.length; i++) {
-	collect(G.Bs(rel), ids[i], acc, uniq, true, reverse, maxDepth, 0);
+	collect(G.Bs(rel), ids[i], acc, uniq, reverse, maxDepth);
     }
     return acc;
 }
@@ -18,34 +18,121 @@ package tinygraph
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
-
-	rocks "github.com/jsccast/rocksdb"
 )
 
+// Number of triples per write batch when deleting by pattern.
+const deleteBatchSize = 1000
+
 type Graph struct {
-	db     *rocks.DB
-	opts   *rocks.Options
-	wopts  *rocks.WriteOptions
-	ropts  *rocks.ReadOptions
-	writes uint64
+	db       Store
+	wopts    *WriteOptions
+	ropts    *ReadOptions
+	writes   uint64
+	indexes  []Index
+	dict     *Dictionary
+	changes  *changelog
+	stats    *stats
+	snapshot *graphSnapshot
+	lock     *sync.RWMutex
+	ctx      context.Context // For walks.  See WithContext.
 }
 
-func NewGraph(path string, opts *rocks.Options) (*Graph, error) {
-	db, err := rocks.Open(path, opts)
-	if err != nil {
+// NewGraphWithStore makes a graph on the given store.  Also see
+// NewGraph() and GetGraph().
+func NewGraphWithStore(db Store) (*Graph, error) {
+	return openGraph(db, DefaultDictionaryCacheSize)
+}
+
+// openGraph is NewGraphWithStore() with the size of the dictionary's
+// caches (if the database has a dictionary).
+func openGraph(db Store, cacheSize int) (*Graph, error) {
+	g := newGraph(db)
+	if err := g.checkFormat(); err != nil {
+		return nil, err
+	}
+	if err := g.openIndexes(); err != nil {
+		return nil, err
+	}
+	if err := g.openDictionary(cacheSize); err != nil {
+		return nil, err
+	}
+	if err := g.openChangelog(); err != nil {
+		return nil, err
+	}
+	if err := g.openStats(); err != nil {
 		return nil, err
 	}
-	return &Graph{db, opts, nil, nil, uint64(0)}, nil
+	return g, nil
+}
+
+func newGraph(db Store) *Graph {
+	return &Graph{db, nil, nil, uint64(0), DefaultIndexes, nil, nil, nil, nil, new(sync.RWMutex), nil}
+}
+
+// Store returns the graph's underlying store.
+func (g *Graph) Store() Store {
+	return g.db
+}
+
+// WithContext returns a view of the graph whose walks stop when the
+// given context is done.  The HTTP server uses this so that a walk
+// stops when its client goes away.
+func (g *Graph) WithContext(ctx context.Context) *Graph {
+	view := *g
+	view.ctx = ctx
+	return &view
+}
+
+func (g *Graph) context() context.Context {
+	if g.ctx == nil {
+		return context.Background()
+	}
+	return g.ctx
+}
+
+// Indexes returns the indexes this graph maintains.
+func (g *Graph) Indexes() []Index {
+	return g.indexes
+}
+
+// HasIndex reports whether the graph maintains the given index.
+func (g *Graph) HasIndex(index Index) bool {
+	return hasIndex(g.indexes, index)
+}
+
+func hasIndex(indexes []Index, index Index) bool {
+	for _, have := range indexes {
+		if have == index {
+			return true
+		}
+	}
+	return false
+}
+
+// BestIndex returns the maintained index that covers the most leading
+// components of the given pattern.  Ties go to the index listed
+// first.
+func (g *Graph) BestIndex(on *Triple) Index {
+	best := g.indexes[0]
+	most := -1
+	for _, index := range g.indexes {
+		n := on.Copy().Permute(index).boundIn(index)
+		if most < n {
+			best = index
+			most = n
+		}
+	}
+	return best
 }
 
 func (g *Graph) Compact() {
 	log.Printf("starting initial compaction %s\n", NowStringMillis())
-	ff := byte(0xff)
-	r := rocks.Range{[]byte{}, []byte{ff, ff, ff, ff, ff, ff, ff, ff, ff}}
-	g.db.CompactRange(r)
+	g.db.Compact()
 	log.Printf("completed initial compaction %s\n", NowStringMillis())
 }
 
@@ -58,23 +145,45 @@ func (g *Graph) GetWrites() uint64 {
 }
 
 func (g *Graph) GetStats() string {
-	return g.db.PropertyValue("rocksdb.stats") + fmt.Sprintf("\nnewwrites %d\n", g.GetWrites())
+	return g.db.Stats() + fmt.Sprintf("\nnewwrites %d\n", g.GetWrites())
 }
 
 func (g *Graph) Close() error {
+	if g.snapshot != nil {
+		if g.snapshot.released {
+			return ErrSnapshotReleased
+		}
+		g.Release()
+		return nil
+	}
 	if g.db == nil {
 		return fmt.Errorf("Graph isn't open")
 	}
-	g.db.Close()
+	if g.changes != nil {
+		// Wait for change feeds to finish reading.
+		g.lock.Lock()
+		g.changes.close()
+		g.lock.Unlock()
+	}
+	err := g.db.Close()
 	g.db = nil
-	return nil
+	return err
 }
 
-func (g *Graph) WriteBatch(triples []Triple, opts *rocks.WriteOptions) error {
+// WriteBatch writes the triples' unindexed keys (see Triple.Key()).
+// These writes don't go in the changelog, so they return
+// ErrUnloggedWrite if the graph has one.
+func (g *Graph) WriteBatch(triples []Triple, opts *WriteOptions) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
+	if g.changes != nil {
+		return ErrUnloggedWrite
+	}
 	if opts == nil {
 		opts = g.wopts
 	}
-	batch := rocks.NewWriteBatch()
+	batch := g.db.NewBatch()
 	for _, triple := range triples {
 		batch.Put(triple.Key(), triple.Val())
 	}
@@ -85,9 +194,21 @@ func (g *Graph) WriteBatch(triples []Triple, opts *rocks.WriteOptions) error {
 	return err
 }
 
-func IndexedTripleFromBytes(index Index, bs []byte, v []byte) *Triple {
-	triple := TripleFromBytes(bs[1:], v)
-	return triple
+// IndexedTripleFromBytes decodes a key with an index prefix.  The
+// triple's components are left in the order of the index (except
+// that the graph label is always V).
+func IndexedTripleFromBytes(index Index, bs []byte, v []byte) (*Triple, error) {
+	if len(bs) == 0 || bs[0] != byte(index) {
+		return nil, fmt.Errorf("Key %q isn't in index %s", bs, index)
+	}
+	if index.IsGraphIndex() {
+		parts, err := decodeComponents(bs[1:], 4)
+		if err != nil {
+			return nil, err
+		}
+		return &Triple{parts[1], parts[2], parts[3], parts[0]}, nil
+	}
+	return TripleFromBytes(bs[1:], v)
 }
 
 func withIndex(index Index, k []byte) []byte {
@@ -97,11 +218,32 @@ func withIndex(index Index, k []byte) []byte {
 	return bs
 }
 
-func (g *Graph) IndexTriple(index Index, triple *Triple, opts *rocks.WriteOptions) error {
+// IndexTriple writes the triple to just the given index.  Like
+// WriteBatch(), it returns ErrUnloggedWrite if the graph has a
+// changelog.  Writing to SPO marks the stats (if any) stale.
+func (g *Graph) IndexTriple(index Index, triple *Triple, opts *WriteOptions) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
+	if g.changes != nil {
+		return ErrUnloggedWrite
+	}
 	if opts == nil {
 		opts = g.wopts
 	}
-	err := g.db.Put(opts, withIndex(index, triple.Key()), triple.Val())
+	interned, err := g.internTriples([]*Triple{triple})
+	if err != nil {
+		return err
+	}
+	triple = interned[0]
+	if index == SPO {
+		if err = g.staleStats(); err != nil {
+			return err
+		}
+	}
+	g.lock.RLock()
+	err = g.db.Put(opts, withIndex(index, triple.key(index)), nil)
+	g.lock.RUnlock()
 	if err == nil {
 		g.IncWrites(1)
 	}
@@ -117,7 +259,9 @@ const (
 )
 
 type Iterator struct {
-	i     *rocks.Iterator
+	g     *Graph
+	i     StoreIterator
+	index Index
 	from  []byte
 	to    []byte
 	state IteratorState
@@ -131,26 +275,49 @@ func (i *Iterator) Value() []byte {
 	return i.i.Value()
 }
 
+// Triple decodes the current key and value.  The triple's components
+// are in their natural (SPO) order.
+func (i *Iterator) Triple() (*Triple, error) {
+	t, err := IndexedTripleFromBytes(i.index, i.i.Key(), i.i.Value())
+	if err != nil {
+		return nil, err
+	}
+	if err = i.g.decodeTriple(t); err != nil {
+		return nil, err
+	}
+	return t.Unpermute(i.index), nil
+}
+
 func (i *Iterator) Release() {
 	i.i.Close()
 	i.state = Done
 }
 
-func (g *Graph) NewIndexIterator(index Index, on *Triple, opts *rocks.ReadOptions) *Iterator {
+func (g *Graph) NewIndexIterator(index Index, on *Triple, opts *ReadOptions) *Iterator {
 	if opts == nil {
 		opts = g.ropts
 	}
 	var from []byte
 	var to []byte
-	if on == nil {
+	state := IteratorState(Init)
+	on, known, err := g.encodePattern(on)
+	if err != nil || !known {
+		if err != nil {
+			log.Printf("NewIndexIterator pattern error %v", err)
+		}
+		// Nothing can match.
+		state = Done
+		on = nil
+	}
+	if on == nil || on.boundIn(index) == 0 {
 		zero := []byte{}
 		from = withIndex(index, zero)
 		to = withIndex(index, zero)
 	} else {
-		from = withIndex(index, on.StartKey())
-		to = withIndex(index, on.KeyPrefix())
+		from = withIndex(index, on.keyPrefix(index))
+		to = from
 	}
-	i := &Iterator{g.db.NewIterator(opts), from, to, Init}
+	i := &Iterator{g, g.db.NewIterator(opts), index, from, to, state}
 	return i
 }
 
@@ -181,7 +348,15 @@ func (i *Iterator) Next() bool {
 	return true
 }
 
-func (g *Graph) WriteTriple(triple *Triple, opts *rocks.WriteOptions) error {
+// WriteTriple writes the triple's unindexed key.  Like WriteBatch(),
+// it returns ErrUnloggedWrite if the graph has a changelog.
+func (g *Graph) WriteTriple(triple *Triple, opts *WriteOptions) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
+	if g.changes != nil {
+		return ErrUnloggedWrite
+	}
 	if opts == nil {
 		opts = g.wopts
 	}
@@ -192,50 +367,159 @@ func (g *Graph) WriteTriple(triple *Triple, opts *rocks.WriteOptions) error {
 	return err
 }
 
-func (g *Graph) WriteIndexedTriple(triple *Triple, opts *rocks.WriteOptions) error {
+func (g *Graph) WriteIndexedTriple(triple *Triple, opts *WriteOptions) error {
+	return g.WriteIndexedTriples([]*Triple{triple}, opts)
+}
+
+func (g *Graph) WriteIndexedTriples(triples []*Triple, opts *WriteOptions) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
 	if opts == nil {
 		opts = g.wopts
 	}
-	if opts == nil {
-		panic(fmt.Errorf("nil wopts"))
-	}
-	batch := rocks.NewWriteBatch()
-	v := triple.Val()
-	// ToDo: Optimize
-	batch.Put(withIndex(SPO, triple.Copy().Permute(SPO).Key()), v)
-	batch.Put(withIndex(OPS, triple.Copy().Permute(OPS).Key()), v)
-	batch.Put(withIndex(PSO, triple.Copy().Permute(PSO).Key()), v)
-	err := g.db.Write(opts, batch)
+	batch := g.db.NewBatch()
+	if err := g.batchPuts(batch, triples); err != nil {
+		return err
+	}
+	err := g.write(opts, batch, g.logged(false, triples))
 	if err == nil {
-		g.IncWrites(uint64(3))
+		g.IncWrites(uint64(len(g.indexes) * len(triples)))
 	}
 	return err
 }
 
-func (g *Graph) WriteIndexedTriples(triples []*Triple, opts *rocks.WriteOptions) error {
+// DeleteIndexedTriple removes the given triple from all indexes.
+func (g *Graph) DeleteIndexedTriple(triple *Triple, opts *WriteOptions) error {
+	return g.DeleteIndexedTriples([]*Triple{triple}, opts)
+}
+
+// DeleteIndexedTriples removes the given triples from all indexes in
+// a single write batch.  The graph label V is part of what's deleted:
+// deleting ("a","p","b","") doesn't touch ("a","p","b","g1").
+func (g *Graph) DeleteIndexedTriples(triples []*Triple, opts *WriteOptions) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
 	if opts == nil {
 		opts = g.wopts
 	}
-	batch := rocks.NewWriteBatch()
-	for _, triple := range triples {
-		v := triple.Val()
-		// ToDo: Optimize
-		batch.Put(withIndex(SPO, triple.Copy().Permute(SPO).Key()), v)
-		batch.Put(withIndex(OPS, triple.Copy().Permute(OPS).Key()), v)
-		batch.Put(withIndex(PSO, triple.Copy().Permute(PSO).Key()), v)
+	batch := g.db.NewBatch()
+	if err := g.batchDeletes(batch, triples); err != nil {
+		return err
 	}
-	err := g.db.Write(opts, batch)
+	err := g.write(opts, batch, g.logged(true, triples))
 	if err == nil {
-		g.IncWrites(uint64(3 * len(triples)))
+		g.IncWrites(uint64(len(g.indexes) * len(triples)))
 	}
 	return err
 }
 
-func (g *Graph) Scan(index Index, on *Triple, opts *rocks.ReadOptions) []Triple {
+// batchPuts adds the given triples to the batch for every index.
+func (g *Graph) batchPuts(batch Batch, triples []*Triple) error {
+	triples, err := g.internTriples(triples)
+	if err != nil {
+		return err
+	}
+	for _, triple := range triples {
+		// ToDo: Optimize
+		for _, index := range g.indexes {
+			batch.Put(triple.IndexKey(index), nil)
+		}
+	}
+	return nil
+}
+
+// batchDeletes adds deletions of the given triples from every index
+// to the batch.
+func (g *Graph) batchDeletes(batch Batch, triples []*Triple) error {
+	for _, triple := range triples {
+		triple, known, err := g.encodePattern(triple)
+		if err != nil {
+			return err
+		}
+		if !known {
+			continue
+		}
+		for _, index := range g.indexes {
+			batch.Delete(triple.IndexKey(index))
+		}
+	}
+	return nil
+}
+
+// write writes a batch of index changes.  Transactions hold the
+// graph's write lock while they check for conflicts and commit, so
+// other writes wait for them.
+func (g *Graph) write(opts *WriteOptions, batch Batch, changes []Change) error {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.writeLocked(opts, batch, changes)
+}
+
+// writeLocked is write() for callers that already hold the graph's
+// lock.  The changes are recorded in the changelog (if any) and
+// counted in the stats (if any) in the same batch.
+func (g *Graph) writeLocked(opts *WriteOptions, batch Batch, changes []Change) error {
+	if g.stats != nil {
+		return g.countAndCommit(opts, batch, changes)
+	}
+	return g.commit(opts, batch, changes)
+}
+
+// commit writes the batch and records the changes in the changelog
+// (if any).
+func (g *Graph) commit(opts *WriteOptions, batch Batch, changes []Change) error {
+	if g.changes != nil {
+		return g.changes.write(g.db, opts, batch, changes)
+	}
+	return g.db.Write(opts, batch)
+}
+
+// DeleteMatching removes every triple found by scanning the given
+// index with the given pattern.  For example, DeleteMatching(SPO,
+// TripleFromStrings("X"), nil) removes all edges out of "X", and
+// DeleteMatching(PSO, TripleFromStrings("P"), nil) removes all triples
+// with property "P".  Deletions are written in batches of
+// 'deleteBatchSize' triples.  Returns the number of triples deleted.
+func (g *Graph) DeleteMatching(index Index, on *Triple, opts *WriteOptions) (int, error) {
+	n := 0
+	batch := make([]*Triple, 0, deleteBatchSize)
+	i := g.NewIndexIterator(index, on, nil)
+	defer i.Release()
+	for i.Next() {
+		t, err := i.Triple()
+		if err != nil {
+			log.Printf("DeleteMatching skipping bad key: %v", err)
+			continue
+		}
+		batch = append(batch, t)
+		if len(batch) == deleteBatchSize {
+			if err := g.DeleteIndexedTriples(batch, opts); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[0:0]
+		}
+	}
+	if 0 < len(batch) {
+		if err := g.DeleteIndexedTriples(batch, opts); err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
+
+func (g *Graph) Scan(index Index, on *Triple, opts *ReadOptions) []Triple {
 	acc := make([]Triple, 0, 64)
 	i := g.NewIndexIterator(index, on, opts)
 	for i.Next() {
-		triple := IndexedTripleFromBytes(index, i.Key(), i.Value()).Permute(index)
+		triple, err := i.Triple()
+		if err != nil {
+			log.Printf("Scan skipping bad key: %v", err)
+			continue
+		}
 		acc = append(acc, *triple)
 	}
 	i.Release()
@@ -244,10 +528,15 @@ func (g *Graph) Scan(index Index, on *Triple, opts *rocks.ReadOptions) []Triple
 
 type TripleFun func(*Triple) bool
 
-func (g *Graph) Do(index Index, on *Triple, opts *rocks.ReadOptions, f TripleFun) error {
+func (g *Graph) Do(index Index, on *Triple, opts *ReadOptions, f TripleFun) error {
 	i := g.NewIndexIterator(index, on, opts)
 	for i.Next() {
-		if !f(IndexedTripleFromBytes(index, i.Key(), i.Value()).Permute(index)) {
+		t, err := i.Triple()
+		if err != nil {
+			log.Printf("Do skipping bad key: %v", err)
+			continue
+		}
+		if !f(t) {
 			break
 		}
 	}
@@ -255,11 +544,16 @@ func (g *Graph) Do(index Index, on *Triple, opts *rocks.ReadOptions, f TripleFun
 	return nil
 }
 
-func (g *Graph) DoAll(opts *rocks.ReadOptions, limit int, f TripleFun) error {
+func (g *Graph) DoAll(opts *ReadOptions, limit int, f TripleFun) error {
 	i := g.NewIndexIterator(SPO, nil, opts)
 	for i.Next() && 0 < limit {
 		limit--
-		if !f(IndexedTripleFromBytes(SPO, i.Key(), i.Value()).Permute(SPO)) {
+		t, err := i.Triple()
+		if err != nil {
+			log.Printf("DoAll skipping bad key: %v", err)
+			continue
+		}
+		if !f(t) {
 			break
 		}
 	}
@@ -290,7 +584,13 @@ func inc(bs []byte) []byte { // Copies
 	return acc[0:end]
 }
 
-func (g *Graph) DoVertexes(opts *rocks.ReadOptions, limit int, f func([]byte) bool) error {
+// nextVertexKey returns the first SPO key after all the keys for the
+// given subject.
+func nextVertexKey(s []byte) []byte {
+	return withIndex(SPO, inc(appendComponent(nil, s)))
+}
+
+func (g *Graph) DoVertexes(opts *ReadOptions, limit int, f func([]byte) bool) error {
 	// ToDo: Reimplement with iterators?
 	if opts == nil {
 		opts = g.ropts
@@ -298,10 +598,9 @@ func (g *Graph) DoVertexes(opts *rocks.ReadOptions, limit int, f func([]byte) bo
 
 	i := g.db.NewIterator(opts)
 	index := byte(SPO)
-	at := []byte{index, 0}
+	at := []byte{index}
 
 	for 0 <= limit {
-		limit--
 		i.Seek(at)
 		if !i.Valid() {
 			break
@@ -310,16 +609,22 @@ func (g *Graph) DoVertexes(opts *rocks.ReadOptions, limit int, f func([]byte) bo
 		if k[0] != index {
 			break
 		}
-		v := i.Value()
-		t := TripleFromBytes(k[1:], v)
-		s := t.S
-		if !f(s) {
+		t, err := IndexedTripleFromBytes(SPO, k, i.Value())
+		if err != nil {
+			log.Printf("DoVertexes skipping bad key: %v", err)
+			at = inc(k)
+			continue
+		}
+		limit--
+		at = nextVertexKey(t.S)
+		v, err := g.decodeTerm(t.S)
+		if err != nil {
+			log.Printf("DoVertexes skipping bad vertex: %v", err)
+			continue
+		}
+		if !f(v) {
 			break
 		}
-		s = inc(s)
-		at = make([]byte, len(s)+1)
-		copy(at[1:], s)
-		at[0] = index
 	}
 
 	i.Close()
@@ -327,14 +632,15 @@ func (g *Graph) DoVertexes(opts *rocks.ReadOptions, limit int, f func([]byte) bo
 }
 
 type VertexIterator struct {
-	i    *rocks.Iterator
+	g    *Graph
+	i    StoreIterator
 	at   []byte
 	done bool
 }
 
 func (g *Graph) NewVertexIterator() *VertexIterator {
 	opts := g.ropts
-	return &VertexIterator{g.db.NewIterator(opts), []byte{}, false}
+	return &VertexIterator{g, g.db.NewIterator(opts), []byte{}, false}
 }
 
 func (i *VertexIterator) Next() ([]byte, bool) {
@@ -346,32 +652,38 @@ func (i *VertexIterator) Next() ([]byte, bool) {
 	}
 
 	if len(at) == 0 {
-		at = []byte{index, 0}
-	}
-
-	i.i.Seek(at)
-	if !i.i.Valid() {
-		i.Release()
-		return nil, false
+		at = []byte{index}
 	}
 
-	k := i.i.Key()
-	if k[0] != index {
-		i.Release()
-		return nil, false
-	}
+	for {
+		i.i.Seek(at)
+		if !i.i.Valid() {
+			i.Release()
+			return nil, false
+		}
 
-	v := i.i.Value()
-	t := TripleFromBytes(k[1:], v)
-	s := t.S
+		k := i.i.Key()
+		if k[0] != index {
+			i.Release()
+			return nil, false
+		}
 
-	seek := inc(s)
-	to := make([]byte, len(seek)+1)
-	copy(to[1:], seek)
-	to[0] = index
-	i.at = to
+		t, err := IndexedTripleFromBytes(SPO, k, i.i.Value())
+		if err != nil {
+			log.Printf("VertexIterator skipping bad key: %v", err)
+			at = inc(k)
+			continue
+		}
 
-	return s, true
+		i.at = nextVertexKey(t.S)
+		v, err := i.g.decodeTerm(t.S)
+		if err != nil {
+			log.Printf("VertexIterator skipping bad vertex: %v", err)
+			at = i.at
+			continue
+		}
+		return v, true
+	}
 }
 
 // Really for Javscript.
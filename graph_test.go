@@ -0,0 +1,860 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("del1", "dp1", "del2", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("del1", "dp1", "del3", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("del1", "dp2", "del4", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("del5", "dp2", "del1", "today"), nil)
+
+	count := func(index Index, on *Triple) int {
+		return len(g.Scan(index, on, nil))
+	}
+
+	// Wrong graph.
+	if err := g.DeleteIndexedTriple(TripleFromStrings("del1", "dp1", "del2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(SPO, TripleFromStrings("del1", "dp1")); n != 2 {
+		t.Errorf("SPO expected %d triples but got %d", 2, n)
+	}
+
+	if err := g.DeleteIndexedTriple(TripleFromStrings("del1", "dp1", "del2", "today"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(SPO, TripleFromStrings("del1", "dp1")); n != 1 {
+		t.Errorf("SPO expected %d triples but got %d", 1, n)
+	}
+	if n := count(OPS, TripleFromStrings("del2")); n != 0 {
+		t.Errorf("OPS expected %d triples but got %d", 0, n)
+	}
+	if n := count(PSO, TripleFromStrings("dp1", "del1")); n != 1 {
+		t.Errorf("PSO expected %d triples but got %d", 1, n)
+	}
+
+	n, err := g.DeleteMatching(PSO, TripleFromStrings("dp2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeleteMatching expected %d deletions but got %d", 2, n)
+	}
+	if n := count(OPS, TripleFromStrings("del1")); n != 0 {
+		t.Errorf("OPS expected %d triples but got %d", 0, n)
+	}
+
+	if _, err = g.DeleteMatching(SPO, TripleFromStrings("del1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(SPO, TripleFromStrings("del1")); n != 0 {
+		t.Errorf("SPO expected %d triples but got %d", 0, n)
+	}
+	if n := count(PSO, TripleFromStrings("dp1")); n != 0 {
+		t.Errorf("PSO expected %d triples but got %d", 0, n)
+	}
+}
+
+func TestPermute(t *testing.T) {
+	for _, index := range AllIndexes {
+		triple := TripleFromStrings("s", "p", "o")
+		triple.Permute(index).Unpermute(index)
+		if got := triple.String(); got != "<'s','p','o',''>" {
+			t.Errorf("%s round trip gave %s", index, got)
+		}
+		name := index.String()
+		parsed, err := ParseIndex(name)
+		if err != nil || parsed != index {
+			t.Errorf("ParseIndex(%s) gave %v (%v)", name, parsed, err)
+		}
+	}
+
+	triple := TripleFromStrings("s", "p", "o").Permute(POS)
+	if got := triple.String(); got != "<'p','o','s',''>" {
+		t.Errorf("POS gave %s", got)
+	}
+
+	if _, err := ParseIndexes("ops,pso"); err == nil {
+		t.Error("ParseIndexes should require spo")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+	g.indexes = []Index{SPO, POS}
+
+	g.WriteIndexedTriple(TripleFromStrings("ix1", "ixp1", "ix2", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ix3", "ixp1", "ix2", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ix3", "ixp2", "ix2", "today"), nil)
+
+	if index := g.BestIndex(TripleFromStrings("", "ixp1", "ix2").Permute(OPS)); index != SPO {
+		t.Errorf("Expected %s but got %s", SPO, index)
+	}
+	if index := g.BestIndex(&Triple{nil, []byte("ixp1"), []byte("ix2"), nil}); index != POS {
+		t.Errorf("Expected %s but got %s", POS, index)
+	}
+	if n := len(g.Scan(POS, TripleFromStrings("ixp1", "ix2"), nil)); n != 2 {
+		t.Errorf("Expected %d triples but got %d", 2, n)
+	}
+
+	// In() should use POS.
+	paths := In([]byte("ixp1")).Walk(g, Vertex("ix2")).Collect()
+	if len(paths) != 2 {
+		t.Fatalf("Expected %d paths but got %d", 2, len(paths))
+	}
+	if string(paths[1][0].O) != "ix3" {
+		t.Errorf("Expected %s but got %s", "ix3", paths[1][0].O)
+	}
+
+	// AllIn() has to scan and filter.
+	paths = AllIn().Walk(g, Vertex("ix2")).Collect()
+	if len(paths) != 3 {
+		t.Fatalf("Expected %d paths but got %d", 3, len(paths))
+	}
+
+	// Earlier steps in a path should be left alone.
+	paths = In([]byte("ixp1")).Out([]byte("ixp2")).Walk(g, Vertex("ix2")).Collect()
+	if len(paths) != 1 {
+		t.Fatalf("Expected %d paths but got %d", 1, len(paths))
+	}
+	if got := paths[0][0].String(); got != "<'ix2','ixp1','ix3','today'>" {
+		t.Errorf("Unexpected first step %s", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := NewMemoryStore()
+	legacy := func(index Index, s, p, o string) {
+		k := withIndex(index, []byte(s+"\x00"+p+"\x00"+o+"\x00"))
+		db.Put(nil, k, []byte("today"))
+	}
+	legacy(SPO, "m1", "mp", "m2")
+	legacy(OPS, "m2", "mp", "m1")
+	legacy(PSO, "mp", "m1", "m2")
+
+	if _, err := NewGraphWithStore(db); err == nil {
+		t.Fatal("Expected a format error")
+	}
+	if err := MigrateGraph(db, 2); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGraphWithStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	paths := In([]byte("mp")).Walk(g, Vertex("m2")).Collect()
+	if len(paths) != 1 {
+		t.Fatalf("Expected %d paths but got %d", 1, len(paths))
+	}
+	if got := paths[0][0].String(); got != "<'m2','mp','m1','today'>" {
+		t.Errorf("Unexpected path %s", got)
+	}
+
+	// Version 2 had the graph label in the value.
+	db = NewMemoryStore()
+	db.Put(nil, formatKey, []byte("2"))
+	k := withIndex(SPO, []byte("m1\x00\x01mp\x00\x01m2\x00\x01"))
+	db.Put(nil, k, []byte("yesterday"))
+	if err := MigrateGraph(db, 2); err != nil {
+		t.Fatal(err)
+	}
+	if g, err = NewGraphWithStore(db); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if got := g.Scan(SPO, nil, nil); len(got) != 1 || got[0].String() != "<'m1','mp','m2','yesterday'>" {
+		t.Errorf("Unexpected %v", got)
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	db := NewMemoryStore()
+	g, err := NewGraphWithStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.EnableDictionary(2); err != nil {
+		t.Fatal(err)
+	}
+
+	g.WriteIndexedTriples([]*Triple{
+		TripleFromStrings("http://example.com/a", "http://example.com/p", "http://example.com/b", "today"),
+		TripleFromStrings("http://example.com/b", "http://example.com/p", "http://example.com/c", "today"),
+		TripleFromStrings("http://example.com/b", "http://example.com/q", "http://example.com/a", "today"),
+	}, nil)
+
+	// Keys should hold IDs rather than terms.
+	i := g.db.NewIterator(g.ropts)
+	for i.Seek([]byte{byte(SPO)}); i.Valid() && i.Key()[0] == byte(SPO); i.Next() {
+		if 16 < len(i.Key()) {
+			t.Errorf("Key %q looks too long", i.Key())
+		}
+	}
+	i.Close()
+
+	p := []byte("http://example.com/p")
+	paths := Out(p).Out(p).Walk(g, Vertex("http://example.com/a")).Collect()
+	if len(paths) != 1 {
+		t.Fatalf("Expected %d paths but got %d", 1, len(paths))
+	}
+	if got := paths[0][1].Strings()[2]; got != "http://example.com/c" {
+		t.Errorf("Expected %s but got %s", "http://example.com/c", got)
+	}
+
+	if n := len(In([]byte("http://example.com/nope")).Walk(g, Vertex("http://example.com/a")).Collect()); n != 0 {
+		t.Errorf("Expected %d paths but got %d", 0, n)
+	}
+
+	g.DeleteIndexedTriple(TripleFromStrings("http://example.com/b", "http://example.com/q", "http://example.com/a", "today"), nil)
+	g.Close()
+
+	// The dictionary should come back on its own, with the cache size
+	// it's given.
+	g, err = openGraph(db, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if !g.HasDictionary() {
+		t.Fatal("Expected a dictionary")
+	}
+	if g.dict.ids.limit != 7 || g.dict.terms.limit != 7 {
+		t.Errorf("Unexpected cache sizes %d, %d", g.dict.ids.limit, g.dict.terms.limit)
+	}
+	vs := make([]string, 0, 2)
+	g.DoVertexes(nil, 10, func(v []byte) bool {
+		vs = append(vs, string(v))
+		return true
+	})
+	if len(vs) != 2 || vs[0] != "http://example.com/a" {
+		t.Errorf("Unexpected vertexes %v", vs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("sn1", "snp", "sn2", "today"), nil)
+	snap := g.Snapshot()
+	g.WriteIndexedTriple(TripleFromStrings("sn2", "snp", "sn3", "today"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("sn4", "snp", "sn1", "today"), nil)
+
+	p := []byte("snp")
+	if n := len(Out(p).Out(p).Walk(g, Vertex("sn1")).Collect()); n != 1 {
+		t.Errorf("Expected %d paths but got %d", 1, n)
+	}
+	if n := len(Out(p).Out(p).Walk(snap, Vertex("sn1")).Collect()); n != 0 {
+		t.Errorf("Snapshot expected %d paths but got %d", 0, n)
+	}
+	if n := len(snap.Scan(OPS, TripleFromStrings("sn1"), nil)); n != 0 {
+		t.Errorf("Snapshot expected %d triples but got %d", 0, n)
+	}
+
+	vs := 0
+	i := snap.NewVertexIterator()
+	for {
+		if _, ok := i.Next(); !ok {
+			break
+		}
+		vs++
+	}
+	if vs != 1 {
+		t.Errorf("Snapshot expected %d vertexes but got %d", 1, vs)
+	}
+
+	if err := snap.WriteIndexedTriple(TripleFromStrings("sn5", "snp", "sn6"), nil); err != ErrSnapshotWrite {
+		t.Errorf("Expected %v but got %v", ErrSnapshotWrite, err)
+	}
+
+	// A released snapshot (and its views) can't write, read live data,
+	// or close the store.
+	view := snap.WithContext(context.Background())
+	snap.Release()
+	if err := view.WriteIndexedTriple(TripleFromStrings("sn5", "snp", "sn6"), nil); err != ErrSnapshotWrite {
+		t.Errorf("Expected %v but got %v", ErrSnapshotWrite, err)
+	}
+	if n := len(view.Scan(SPO, TripleFromStrings("sn1"), nil)); n != 0 {
+		t.Errorf("Released snapshot expected %d triples but got %d", 0, n)
+	}
+	if err := snap.Close(); err != ErrSnapshotReleased {
+		t.Errorf("Expected %v but got %v", ErrSnapshotReleased, err)
+	}
+	if n := len(g.Scan(SPO, TripleFromStrings("sn1"), nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("tx1", "txp", "tx2", "today"), nil)
+
+	// Read-your-writes.
+	txn := g.Txn()
+	txn.Put(TripleFromStrings("tx1", "txp", "tx3", "today"))
+	if n := len(txn.Scan(SPO, TripleFromStrings("tx1", "txp"))); n != 2 {
+		t.Errorf("Expected %d triples but got %d", 2, n)
+	}
+	if n := len(g.Scan(SPO, TripleFromStrings("tx1", "txp"), nil)); n != 1 {
+		t.Errorf("Uncommitted: expected %d triples but got %d", 1, n)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.Scan(SPO, TripleFromStrings("tx1", "txp"), nil)); n != 2 {
+		t.Errorf("Committed: expected %d triples but got %d", 2, n)
+	}
+	if n := len(g.Scan(OPS, TripleFromStrings("tx3"), nil)); n != 1 {
+		t.Errorf("Committed OPS: expected %d triples but got %d", 1, n)
+	}
+
+	// Compare-and-set.
+	a := g.Txn()
+	b := g.Txn()
+	if !a.Replace(TripleFromStrings("tx1", "txp", "tx2"), TripleFromStrings("tx1", "txp", "tx4", "today")) {
+		t.Error("Replace failed")
+	}
+	if !b.Replace(TripleFromStrings("tx1", "txp", "tx2"), TripleFromStrings("tx1", "txp", "tx5", "today")) {
+		t.Error("Replace failed")
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != ErrConflict {
+		t.Errorf("Expected %v but got %v", ErrConflict, err)
+	}
+	got := g.Scan(SPO, TripleFromStrings("tx1", "txp"), nil)
+	if len(got) != 2 || string(got[0].O) != "tx3" || string(got[1].O) != "tx4" {
+		t.Errorf("Unexpected %v", got)
+	}
+	if err := b.Commit(); err != ErrTxnDone {
+		t.Errorf("Expected %v but got %v", ErrTxnDone, err)
+	}
+
+	// Commit works from a snapshot.
+	snap := g.Snapshot()
+	defer snap.Release()
+	txn = snap.Txn()
+	txn.Delete(TripleFromStrings("tx1", "txp", "tx3", "today"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.Scan(SPO, TripleFromStrings("tx1", "txp"), nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+}
+
+func TestNamedGraphs(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+	g.indexes = []Index{SPO, OPS, GSPO}
+
+	g.WriteIndexedTriple(TripleFromStrings("ng1", "ngp", "ng2", "g1"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ng1", "ngp", "ng2", "g2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ng1", "ngp", "ng3", "g2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ng3", "ngp", "ng1"), nil)
+
+	// Same S, P, O in two graphs are two quads.
+	if n := len(g.Scan(SPO, TripleFromStrings("ng1", "ngp", "ng2"), nil)); n != 2 {
+		t.Errorf("Expected %d quads but got %d", 2, n)
+	}
+	if n := len(g.Scan(GSPO, TripleFromStrings("", "", "", "g2"), nil)); n != 2 {
+		t.Errorf("GSPO expected %d quads but got %d", 2, n)
+	}
+
+	if index := g.BestIndex(TripleFromStrings("ng1", "", "", "g1")); index != GSPO {
+		t.Errorf("Expected %s but got %s", GSPO, index)
+	}
+	if n := len(g.ScanGraph([]byte("g1"), TripleFromStrings("ng1"), nil)); n != 1 {
+		t.Errorf("Expected %d quads but got %d", 1, n)
+	}
+	// Has to filter.
+	if n := len(g.ScanGraph([]byte("g2"), TripleFromStrings("", "", "ng3"), nil)); n != 1 {
+		t.Errorf("Expected %d quads but got %d", 1, n)
+	}
+
+	n, err := g.DropGraph([]byte("g2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DropGraph expected %d deletions but got %d", 2, n)
+	}
+	if got := g.Scan(OPS, TripleFromStrings("ng2"), nil); len(got) != 1 || string(got[0].V) != "g1" {
+		t.Errorf("Unexpected %v", got)
+	}
+	if n := len(g.Scan(SPO, nil, nil)); n != 2 {
+		t.Errorf("Expected %d quads but got %d", 2, n)
+	}
+	if _, err := g.DropGraph(nil, nil); err == nil {
+		t.Error("DropGraph should need a name")
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err := g.Changes(1, 10); err != ErrNoChangelog {
+		t.Errorf("Expected %v but got %v", ErrNoChangelog, err)
+	}
+	if err = g.EnableChangelog(); err != nil {
+		t.Fatal(err)
+	}
+
+	g.WriteIndexedTriples([]*Triple{
+		TripleFromStrings("cl1", "clp", "cl2", "g1"),
+		TripleFromStrings("cl2", "clp", "cl3"),
+	}, nil)
+	feed, err := g.Subscribe(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+	g.DeleteIndexedTriple(TripleFromStrings("cl1", "clp", "cl2", "g1"), nil)
+	txn := g.Txn()
+	txn.Put(TripleFromStrings("cl3", "clp", "cl4"))
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes that can't be logged fail.
+	for _, err := range []error{
+		g.WriteTriple(TripleFromStrings("cl5", "clp", "cl6"), nil),
+		g.WriteBatch([]Triple{*TripleFromStrings("cl5", "clp", "cl6")}, nil),
+		g.IndexTriple(SPO, TripleFromStrings("cl5", "clp", "cl6"), nil),
+	} {
+		if err != ErrUnloggedWrite {
+			t.Errorf("Expected %v but got %v", ErrUnloggedWrite, err)
+		}
+	}
+
+	if n := g.LastChange(); n != 4 {
+		t.Errorf("Expected last change %d but got %d", 4, n)
+	}
+	changes, err := g.Changes(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("Expected %d changes but got %d", 4, len(changes))
+	}
+	if c := changes[2]; c.Seq != 3 || !c.Delete || string(c.Triple.V) != "g1" {
+		t.Errorf("Unexpected %v", c)
+	}
+	bs, _ := json.Marshal(changes[0])
+	if got := string(bs); got != `{"seq":1,"op":"put","s":"cl1","p":"clp","o":"cl2","g":"g1"}` {
+		t.Errorf("Unexpected JSON %s", got)
+	}
+
+	for seq := uint64(2); seq <= 4; seq++ {
+		c := <-feed.C
+		if c.Seq != seq {
+			t.Errorf("Feed expected %d but got %d", seq, c.Seq)
+		}
+	}
+	g.WriteIndexedTriple(TripleFromStrings("cl4", "clp", "cl5"), nil)
+	if c := <-feed.C; c.Seq != 5 || string(c.Triple.O) != "cl5" {
+		t.Errorf("Unexpected %v", c)
+	}
+
+	if n, err := g.TruncateChanges(3); err != nil || n != 2 {
+		t.Errorf("TruncateChanges gave %d (%v)", n, err)
+	}
+	if changes, _ = g.Changes(0, 10); len(changes) != 3 || changes[0].Seq != 3 {
+		t.Errorf("Unexpected %v", changes)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	g, _ := GetGraph("config.test")
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("vf1", "vfp", "vf2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("vf2", "vfp", "vf3"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("vf3", "vfp", "vf4"), nil)
+	if r, err := g.Verify(); err != nil || !r.OK() || r.Keys["ops"] != 3 {
+		t.Fatalf("Unexpected %v (%v)", r, err)
+	}
+
+	// Break things.
+	db := g.Store()
+	db.Delete(nil, TripleFromStrings("vf1", "vfp", "vf2").IndexKey(OPS))
+	db.Delete(nil, TripleFromStrings("vf2", "vfp", "vf3").IndexKey(SPO))
+	db.Put(nil, []byte{byte(PSO), 'z'}, nil)
+	// Strays that look like the graph's own keys.
+	db.Put(nil, []byte("\xff\xfftinygraph.bogus"), nil)
+	db.Put(nil, []byte{changePrefix, 1, 2}, nil)
+	db.Put(nil, []byte{statsPrefix, 'x'}, nil)
+	g.WriteTriple(TripleFromStrings("vf5", "vfp", "vf6"), nil)
+
+	r, err := g.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The deleted SPO entry leaves two orphans.
+	if r.OK() || r.Missing != 1 || r.Orphans != 2 || r.Bad != 1 || r.Stray != 4 {
+		t.Errorf("Unexpected %s %v", r, r.Problems)
+	}
+
+	if r, err = g.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Repaired != 4 {
+		t.Errorf("Expected %d repairs but got %d", 4, r.Repaired)
+	}
+	if r, err = g.Verify(); err != nil || r.Missing+r.Orphans+r.Bad != 0 || r.Stray != 4 {
+		t.Errorf("Unexpected %v (%v)", r, err)
+	}
+	if n := len(g.Scan(OPS, TripleFromStrings("vf2"), nil)); n != 1 {
+		t.Errorf("Expected %d triples but got %d", 1, n)
+	}
+	if n := len(g.Scan(OPS, TripleFromStrings("vf3"), nil)); n != 0 {
+		t.Errorf("Expected %d triples but got %d", 0, n)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("ri1", "rip", "ri2"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ri2", "rip", "ri3"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("ri3", "riq", "ri4"), nil)
+	if err = g.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	// The stats don't cover an index that isn't there yet.
+	if n, err := g.EstimateCount(POS, nil); err != nil || n != 0 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+
+	// Pretend an earlier Reindex stopped after the first key.
+	first := TripleFromStrings("ri1", "rip", "ri2").IndexKey(SPO)
+	g.Store().Put(nil, reindexKey, append([]byte{byte(SPO), byte(POS)}, first...))
+	if _, err = g.Reindex(PSO, POS); err == nil {
+		t.Error("Reindex should notice the unfinished reindex")
+	}
+	n, err := g.Reindex(SPO, POS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected %d keys but got %d", 2, n)
+	}
+	if n, err = g.Reindex(SPO, POS); err != nil || n != 3 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if !g.HasIndex(POS) {
+		t.Error("Graph should maintain pos")
+	}
+	if n := len(g.Scan(POS, TripleFromStrings("rip"), nil)); n != 2 {
+		t.Errorf("Expected %d triples but got %d", 2, n)
+	}
+	if r, err := g.Verify(); err != nil || !r.OK() || r.Keys["pos"] != 3 {
+		t.Errorf("Unexpected %v (%v)", r, err)
+	}
+	// The database remembers, and a configuration can leave pos out.
+	r, err := NewGraphWithStore(g.Store())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.configureIndexes([]Index{SPO, PSO}); err != nil {
+		t.Fatal(err)
+	}
+	if got := JoinIndexes(r.Indexes()); got != "spo,pso,ops,pos" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	if err = g.DropIndex(SPO); err == nil {
+		t.Error("DropIndex should refuse spo")
+	}
+	if err = g.DropIndex(POS); err != nil {
+		t.Fatal(err)
+	}
+	if g.HasIndex(POS) {
+		t.Error("Graph shouldn't maintain pos")
+	}
+	if r, err := g.Verify(); err != nil || !r.OK() || r.Keys["pos"] != 0 {
+		t.Errorf("Unexpected %v (%v)", r, err)
+	}
+	if n, err := g.EstimateCount(POS, nil); err != nil || n != 0 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if n, err := g.TripleCount(); err != nil || n != 3 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if r, err = NewGraphWithStore(g.Store()); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.configureIndexes([]Index{SPO, POS}); err == nil {
+		t.Error("A configuration with pos shouldn't open")
+	}
+
+	// A database that doesn't say takes the configuration's word.
+	m, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err = m.configureIndexes([]Index{SPO, GSPO}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = NewGraphWithStore(m.Store()); err != nil {
+		t.Fatal(err)
+	}
+	if got := JoinIndexes(r.Indexes()); got != "spo,gspo" {
+		t.Errorf("Unexpected %s", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// Stats computed when they're enabled.
+	g.WriteIndexedTriple(TripleFromStrings("st1", "stp", "st2"), nil)
+	if err = g.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	g.WriteIndexedTriples([]*Triple{
+		TripleFromStrings("st1", "stp", "st3"),
+		TripleFromStrings("st1", "stq", "st3"),
+		TripleFromStrings("st2", "stp", "st3"),
+		TripleFromStrings("st2", "stp", "st3"), // Duplicate
+	}, nil)
+	g.DeleteIndexedTriple(TripleFromStrings("st2", "stp", "st3"), nil)
+	g.DeleteIndexedTriple(TripleFromStrings("st2", "stp", "st9"), nil) // Missing
+
+	stats, err := g.TripleStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Triples != 3 || stats.Predicates["stp"] != 2 || stats.Predicates["stq"] != 1 {
+		t.Errorf("Unexpected %#v", stats)
+	}
+	// st1 has out-degree 3.  st2 and st3 have in-degrees 1 and 2.
+	if stats.OutDegrees[2] != 1 || stats.InDegrees[1] != 1 || stats.InDegrees[2] != 1 {
+		t.Errorf("Unexpected %#v", stats)
+	}
+	if n, err := g.InDegree([]byte("st3")); err != nil || n != 2 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+
+	for _, c := range []struct {
+		s, p, o string
+		n       int64
+	}{{"", "stp", "", 2}, {"st1", "", "", 3}, {"", "", "st3", 2}, {"st1", "stq", "", 1}, {"", "", "", 3}, {"", "nope", "", 0}} {
+		n, index, err := g.EstimateMatching(TripleFromStrings(c.s, c.p, c.o))
+		if err != nil || n != c.n {
+			t.Errorf("Expected %d for %v but got %d with %s (%v)", c.n, c, n, index, err)
+		}
+	}
+
+	// Rebuilding gets the same counts.
+	if err = g.RebuildStats(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := g.TripleStats(); err != nil || again.Triples != 3 || again.OutDegrees[2] != 1 {
+		t.Errorf("Unexpected %#v (%v)", again, err)
+	}
+}
+
+func TestStatsDeltas(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err = g.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent writers, with enough writes to fold a few times.
+	// Every writer writes sd0's edges, which should count once.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < statsFoldEvery; i++ {
+				g.WriteIndexedTriple(TripleFromStrings(fmt.Sprintf("sd%d", i%10), "sdp", fmt.Sprintf("sd%d-%d", w, i)), nil)
+				g.WriteIndexedTriple(TripleFromStrings("sd0", "sdq", fmt.Sprintf("sd%d", i%3)), nil)
+			}
+		}(w)
+	}
+	wg.Wait()
+	g.DeleteIndexedTriple(TripleFromStrings("sd0", "sdq", "sd2"), nil)
+
+	stats, err := g.TripleStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Triples != 4*statsFoldEvery+2 || stats.Predicates["sdq"] != 2 {
+		t.Errorf("Unexpected %d %v", stats.Triples, stats.Predicates)
+	}
+	if n, err := g.OutDegree([]byte("sd0")); err != nil || n != 4*26+2 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if err = g.RebuildStats(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := g.TripleStats(); err != nil || fmt.Sprint(again) != fmt.Sprint(stats) {
+		t.Errorf("Expected %v but got %v (%v)", stats, again, err)
+	}
+
+	// Writes around the counts make them stale.
+	if !g.StatsCurrent() {
+		t.Error("Stats should be current")
+	}
+	g.IndexTriple(SPO, TripleFromStrings("sd0", "sdr", "sd1"), nil)
+	if g.StatsCurrent() {
+		t.Error("Stats should be stale")
+	}
+	if _, err := g.TripleCount(); err != ErrStaleStats {
+		t.Errorf("Unexpected %v", err)
+	}
+	if n, _, err := g.EstimateMatching(TripleFromStrings("sd0")); err != nil || n != 4*26+3 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+	if err = g.RebuildStats(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := g.TripleCount(); err != nil || n != stats.Triples+1 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	triples := make([]*Triple, 0, 3*estimateSampleSize)
+	for i := 0; i < cap(triples); i++ {
+		triples = append(triples, TripleFromStrings(fmt.Sprintf("ec%05d", i), "ecp", "ec"))
+	}
+	g.WriteIndexedTriples(triples, nil)
+
+	n, err := g.EstimateCount(PSO, TripleFromStrings("ecp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 2*estimateSampleSize || 4*estimateSampleSize < n {
+		t.Errorf("Bad estimate %d", n)
+	}
+	if n, err = g.EstimateCount(SPO, TripleFromStrings("ec00001")); err != nil || n != 1 {
+		t.Errorf("Unexpected %d (%v)", n, err)
+	}
+}
+
+func TestBGP(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for _, ts := range [][3]string{
+		{"af", "label", "Africa"}, {"ke", "label", "Kenya"}, {"eg", "label", "Egypt"},
+		{"fr", "label", "France"}, {"ke", "part_holonym", "af"}, {"eg", "part_holonym", "af"},
+		{"fr", "part_holonym", "eu"}, {"loop", "knows", "loop"}, {"loop", "knows", "af"},
+	} {
+		g.WriteIndexedTriple(TripleFromStrings(ts[0], ts[1], ts[2]), nil)
+	}
+
+	rows := func(q string, vars ...string) string {
+		b, err := ParseBGP(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bss, err := g.MatchBGP(b, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := make([]string, 0, len(bss))
+		for _, bs := range bss {
+			row := ""
+			for _, v := range vars {
+				row += string(bs[v]) + ","
+			}
+			acc = append(acc, row)
+		}
+		sort.Strings(acc)
+		return fmt.Sprint(acc)
+	}
+
+	for _, c := range []struct {
+		q    string
+		vars []string
+		want string
+	}{
+		{`?x label "Africa" . ?y part_holonym ?x . ?y label ?name`, []string{"y", "name"}, "[eg,Egypt, ke,Kenya,]"},
+		{`?y <part_holonym> ?x. ?x label Africa`, []string{"y"}, "[eg, ke,]"},
+		{`?x knows ?x`, []string{"x"}, "[loop,]"},
+		{`?x ?p af`, []string{"x", "p"}, "[eg,part_holonym, ke,part_holonym, loop,knows,]"},
+		{`?x label "Atlantis"`, []string{"x"}, "[]"},
+	} {
+		if got := rows(c.q, c.vars...); got != c.want {
+			t.Errorf("%s: expected %s but got %s", c.q, c.want, got)
+		}
+	}
+
+	// Most bound first, then fewest matches.
+	b, _ := ParseBGP(`?y part_holonym ?x . ?x label "Africa"`)
+	if got := g.order(b, nil).String(); got != `?x "label" "Africa" . ?y "part_holonym" ?x` {
+		t.Errorf("Unexpected order %s", got)
+	}
+
+	b, _ = ParseBGP(`?x label ?name`)
+	if bss, err := g.MatchBGP(b, 2); err != nil || len(bss) != 2 {
+		t.Errorf("Unexpected %v (%v)", bss, err)
+	}
+	if bss, err := g.MatchBGP(b, -1); err != nil || len(bss) != 4 {
+		t.Errorf("Unexpected %v (%v)", bss, err)
+	}
+	for _, bad := range []string{"", "?x label", `?x label "Africa`, "? label x"} {
+		if _, err := ParseBGP(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
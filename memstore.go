@@ -0,0 +1,356 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// A pure-Go, in-memory Store.  Good for tests and small embedded
+// graphs.  Nothing is persisted.
+//
+// The data is a persistent (path-copying) treap, so a snapshot (or an
+// iterator) is just a pointer to a root.  Writers are serialized.
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+func init() {
+	RegisterStore("memory", func(config *Options) (Store, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
+type memNode struct {
+	k     []byte
+	v     []byte
+	prio  uint32
+	left  *memNode
+	right *memNode
+}
+
+func memPriority(k []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(k)
+	return h.Sum32()
+}
+
+// memInsert returns a new root.  Only the nodes on the path to k are
+// copied.
+func memInsert(n *memNode, k []byte, v []byte, prio uint32) *memNode {
+	if n == nil {
+		return &memNode{k, v, prio, nil, nil}
+	}
+	m := *n
+	switch c := bytes.Compare(k, n.k); {
+	case c == 0:
+		m.v = v
+	case c < 0:
+		m.left = memInsert(n.left, k, v, prio)
+		if m.prio < m.left.prio {
+			// m.left is a fresh copy, so we can change it.
+			l := m.left
+			m.left = l.right
+			l.right = &m
+			return l
+		}
+	default:
+		m.right = memInsert(n.right, k, v, prio)
+		if m.prio < m.right.prio {
+			r := m.right
+			m.right = r.left
+			r.left = &m
+			return r
+		}
+	}
+	return &m
+}
+
+// memDelete returns a new root without k.
+func memDelete(n *memNode, k []byte) *memNode {
+	if n == nil {
+		return nil
+	}
+	switch c := bytes.Compare(k, n.k); {
+	case c == 0:
+		return memMerge(n.left, n.right)
+	case c < 0:
+		left := memDelete(n.left, k)
+		if left == n.left {
+			return n
+		}
+		m := *n
+		m.left = left
+		return &m
+	default:
+		right := memDelete(n.right, k)
+		if right == n.right {
+			return n
+		}
+		m := *n
+		m.right = right
+		return &m
+	}
+}
+
+func memMerge(a *memNode, b *memNode) *memNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if b.prio < a.prio {
+		m := *a
+		m.right = memMerge(a.right, b)
+		return &m
+	}
+	m := *b
+	m.left = memMerge(a, b.left)
+	return &m
+}
+
+func memGet(n *memNode, k []byte) []byte {
+	for n != nil {
+		switch c := bytes.Compare(k, n.k); {
+		case c == 0:
+			return n.v
+		case c < 0:
+			n = n.left
+		default:
+			n = n.right
+		}
+	}
+	return nil
+}
+
+type MemoryStore struct {
+	sync.Mutex
+	root *memNode
+	size int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) current(ro *ReadOptions) *memNode {
+	if ro != nil && ro.Snapshot != nil {
+		return ro.Snapshot.(*memSnapshot).root
+	}
+	s.Lock()
+	root := s.root
+	s.Unlock()
+	return root
+}
+
+func copyBytes(bs []byte) []byte {
+	acc := make([]byte, len(bs))
+	copy(acc, bs)
+	return acc
+}
+
+func (s *MemoryStore) Get(ro *ReadOptions, k []byte) ([]byte, error) {
+	if ro != nil && ro.Snapshot != nil && ro.Snapshot.(*memSnapshot).released {
+		return nil, ErrSnapshotReleased
+	}
+	v := memGet(s.current(ro), k)
+	if v == nil {
+		return nil, nil
+	}
+	return copyBytes(v), nil
+}
+
+func (s *MemoryStore) put(k []byte, v []byte) {
+	if memGet(s.root, k) == nil {
+		s.size++
+	}
+	s.root = memInsert(s.root, copyBytes(k), copyBytes(v), memPriority(k))
+}
+
+func (s *MemoryStore) delete(k []byte) {
+	if memGet(s.root, k) != nil {
+		s.size--
+	}
+	s.root = memDelete(s.root, k)
+}
+
+func (s *MemoryStore) Put(wo *WriteOptions, k []byte, v []byte) error {
+	s.Lock()
+	s.put(k, v)
+	s.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Delete(wo *WriteOptions, k []byte) error {
+	s.Lock()
+	s.delete(k)
+	s.Unlock()
+	return nil
+}
+
+type memOp struct {
+	k   []byte
+	v   []byte
+	del bool
+}
+
+type memBatch struct {
+	ops []memOp
+}
+
+func (b *memBatch) Put(k []byte, v []byte) {
+	b.ops = append(b.ops, memOp{copyBytes(k), copyBytes(v), false})
+}
+
+func (b *memBatch) Delete(k []byte) {
+	b.ops = append(b.ops, memOp{copyBytes(k), nil, true})
+}
+
+func (b *memBatch) Clear() {
+	b.ops = b.ops[0:0]
+}
+
+func (s *MemoryStore) NewBatch() Batch {
+	return &memBatch{}
+}
+
+func (s *MemoryStore) Write(wo *WriteOptions, b Batch) error {
+	batch, ok := b.(*memBatch)
+	if !ok {
+		return fmt.Errorf("MemoryStore can't write a %T", b)
+	}
+	s.Lock()
+	for _, op := range batch.ops {
+		if op.del {
+			s.delete(op.k)
+		} else {
+			s.put(op.k, op.v)
+		}
+	}
+	s.Unlock()
+	return nil
+}
+
+// DeleteRange deletes the keys in [from,to).
+func (s *MemoryStore) DeleteRange(wo *WriteOptions, from []byte, to []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	i := &memIterator{s.root, nil}
+	ks := make([][]byte, 0, 16)
+	for i.Seek(from); i.Valid(); i.Next() {
+		k := i.stack[len(i.stack)-1].k
+		if bytes.Compare(to, k) <= 0 {
+			break
+		}
+		ks = append(ks, k)
+	}
+	for _, k := range ks {
+		s.delete(k)
+	}
+	return nil
+}
+
+// ApproximateSize adds up the sizes of the keys and values in
+// [from,to).  It's exact, but it visits every key.
+func (s *MemoryStore) ApproximateSize(from []byte, to []byte) uint64 {
+	i := s.NewIterator(nil)
+	defer i.Close()
+	n := uint64(0)
+	for i.Seek(from); i.Valid(); i.Next() {
+		k := i.Key()
+		if bytes.Compare(to, k) <= 0 {
+			break
+		}
+		n += uint64(len(k) + len(i.Value()))
+	}
+	return n
+}
+
+type memSnapshot struct {
+	root     *memNode
+	released bool
+}
+
+func (snap *memSnapshot) Release() {
+	snap.root = nil
+	snap.released = true
+}
+
+func (s *MemoryStore) NewSnapshot() Snapshot {
+	return &memSnapshot{root: s.current(nil)}
+}
+
+// memIterator walks a treap in order using a stack of the nodes
+// whose left subtrees we've visited.
+type memIterator struct {
+	root  *memNode
+	stack []*memNode
+}
+
+func (s *MemoryStore) NewIterator(ro *ReadOptions) StoreIterator {
+	return &memIterator{s.current(ro), nil}
+}
+
+func (i *memIterator) Seek(k []byte) {
+	i.stack = i.stack[0:0]
+	n := i.root
+	for n != nil {
+		if bytes.Compare(n.k, k) < 0 {
+			n = n.right
+		} else {
+			i.stack = append(i.stack, n)
+			n = n.left
+		}
+	}
+}
+
+func (i *memIterator) Valid() bool {
+	return 0 < len(i.stack)
+}
+
+func (i *memIterator) Key() []byte {
+	return copyBytes(i.stack[len(i.stack)-1].k)
+}
+
+func (i *memIterator) Value() []byte {
+	return copyBytes(i.stack[len(i.stack)-1].v)
+}
+
+func (i *memIterator) Next() {
+	n := i.stack[len(i.stack)-1]
+	i.stack = i.stack[0 : len(i.stack)-1]
+	for n = n.right; n != nil; n = n.left {
+		i.stack = append(i.stack, n)
+	}
+}
+
+func (i *memIterator) Close() {
+	i.root = nil
+	i.stack = nil
+}
+
+func (s *MemoryStore) Compact() {
+}
+
+func (s *MemoryStore) Stats() string {
+	s.Lock()
+	defer s.Unlock()
+	return fmt.Sprintf("memory store keys %d\n", s.size)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
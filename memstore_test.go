@@ -0,0 +1,107 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	expect := make(map[string]string)
+	r := rand.New(rand.NewSource(42))
+
+	check := func(ro *ReadOptions, expect map[string]string) {
+		keys := make([]string, 0, len(expect))
+		for k := range expect {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		i := s.NewIterator(ro)
+		n := 0
+		for i.Seek([]byte{}); i.Valid(); i.Next() {
+			if keys[n] != string(i.Key()) || expect[keys[n]] != string(i.Value()) {
+				t.Fatalf("Expected %s=%s at %d but got %s=%s", keys[n], expect[keys[n]], n, i.Key(), i.Value())
+			}
+			n++
+		}
+		i.Close()
+		if n != len(keys) {
+			t.Fatalf("Expected %d keys but got %d", len(keys), n)
+		}
+	}
+
+	for n := 0; n < 2000; n++ {
+		k := fmt.Sprintf("k%03d", r.Intn(500))
+		if r.Intn(3) == 0 {
+			s.Delete(nil, []byte(k))
+			delete(expect, k)
+		} else {
+			v := fmt.Sprintf("v%d", n)
+			s.Put(nil, []byte(k), []byte(v))
+			expect[k] = v
+		}
+	}
+	check(nil, expect)
+
+	snap := s.NewSnapshot()
+	before := make(map[string]string)
+	for k, v := range expect {
+		before[k] = v
+	}
+
+	b := s.NewBatch()
+	b.Put([]byte("k000"), []byte("new"))
+	b.Delete([]byte("k001"))
+	s.Write(nil, b)
+	expect["k000"] = "new"
+	delete(expect, "k001")
+
+	check(nil, expect)
+	check(&ReadOptions{snap}, before)
+	snap.Release()
+
+	i := s.NewIterator(nil)
+	i.Seek([]byte("k0005"))
+	if !i.Valid() || string(i.Key()) < "k0005" {
+		t.Errorf("Seek landed on %s", i.Key())
+	}
+	i.Close()
+
+	if v, _ := s.Get(nil, []byte("k000")); string(v) != "new" {
+		t.Errorf("Expected %s but got %s", "new", v)
+	}
+	if v, _ := s.Get(nil, []byte("k001")); v != nil {
+		t.Errorf("Expected nil but got %s", v)
+	}
+}
+
+func TestOpenStoreDefault(t *testing.T) {
+	was := DefaultStore
+	defer func() { DefaultStore = was }()
+	DefaultStore = ""
+
+	if _, err := OpenStore(&Options{}); err != ErrNoStore {
+		t.Fatalf("Expected ErrNoStore, not %v", err)
+	}
+	s, err := OpenStore(&Options{"store": "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// On-disk format versions and migration between them.
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// The format marker lives outside of the index key ranges.
+var formatKey = []byte("\xff\xfftinygraph.format")
+
+// FormatVersion returns the database's key format version.  An empty
+// database has version 0.  A database without a marker but with
+// indexed data has version 1.
+func (g *Graph) FormatVersion() (int, error) {
+	bs, err := g.db.Get(g.ropts, formatKey)
+	if err != nil {
+		return 0, err
+	}
+	if bs != nil {
+		return strconv.Atoi(string(bs))
+	}
+
+	if g.hasIndexedData() {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (g *Graph) setFormatVersion(version int) error {
+	return g.db.Put(g.wopts, formatKey, []byte(strconv.Itoa(version)))
+}
+
+// checkFormat marks an empty database with the current format and
+// complains about a database with any other format.
+func (g *Graph) checkFormat() error {
+	version, err := g.FormatVersion()
+	if err != nil {
+		return err
+	}
+	switch version {
+	case FormatVersion:
+		return nil
+	case 0:
+		if err := g.setFormatVersion(FormatVersion); err != nil {
+			// Probably read-only.
+			log.Printf("checkFormat couldn't write format marker: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("Database has key format %d but we need %d.  Try 'tinygraph -migrate'.",
+		version, FormatVersion)
+}
+
+// MigrateGraph rewrites a database's keys in the current format.
+// Keys that already have the current format are left alone, so an
+// interrupted migration can just be run again.  The format marker is
+// written last.
+func MigrateGraph(db Store, batchSize int) error {
+	g := newGraph(db)
+
+	version, err := g.FormatVersion()
+	if err != nil {
+		return err
+	}
+	switch version {
+	case FormatVersion:
+		log.Printf("MigrateGraph already has format %d", version)
+		return nil
+	case 0:
+		return g.setFormatVersion(FormatVersion)
+	case 1, 2:
+	default:
+		return fmt.Errorf("Can't migrate from format %d", version)
+	}
+
+	// Graph labels are interned in version 3.
+	if err := g.openDictionary(DefaultDictionaryCacheSize); err != nil {
+		return err
+	}
+
+	for _, index := range AllIndexes {
+		n, err := g.migrateIndex(index, batchSize)
+		if err != nil {
+			return err
+		}
+		log.Printf("MigrateGraph migrated %d %s keys", n, index)
+	}
+
+	return g.setFormatVersion(FormatVersion)
+}
+
+func (g *Graph) migrateIndex(index Index, batchSize int) (int, error) {
+	// The iterator doesn't see our writes.
+	i := g.db.NewIterator(g.ropts)
+	defer i.Close()
+
+	n := 0
+	pending := 0
+	batch := g.db.NewBatch()
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		err := g.db.Write(g.wopts, batch)
+		batch.Clear()
+		pending = 0
+		return err
+	}
+
+	for i.Seek([]byte{byte(index)}); i.Valid(); i.Next() {
+		k := i.Key()
+		if k[0] != byte(index) {
+			break
+		}
+		if _, err := TripleFromBytes(k[1:], nil); err == nil {
+			// Already migrated.
+			continue
+		}
+		t, err := version2TripleFromBytes(k[1:], i.Value())
+		if err != nil {
+			t, err = legacyTripleFromBytes(k[1:], i.Value())
+		}
+		if err != nil {
+			log.Printf("migrateIndex %s skipping bad key: %v", index, err)
+			continue
+		}
+		if g.dict != nil && 0 < len(t.V) {
+			ids, err := g.dict.Intern([][]byte{t.V})
+			if err != nil {
+				return n, err
+			}
+			t.V = ids[0]
+		}
+		batch.Put(withIndex(index, t.Key()), nil)
+		batch.Delete(k)
+		n++
+		pending++
+		if batchSize <= pending {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+		if n%1000000 == 0 {
+			log.Printf("migrateIndex %s at %d %s", index, n, NowStringMillis())
+		}
+	}
+
+	return n, flush()
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Named graphs.
+//
+// A Triple's V is its graph label (the fourth element of a quad), and
+// it's part of every key.  So ("a","p","b","g1") and
+// ("a","p","b","g2") are different quads.  The empty label is the
+// default graph.
+//
+// The GSPO and GPOS indexes (not maintained by default) start their
+// keys with the graph label, so they make scans of one graph cheap.
+// Without them, a graph-scoped scan has to filter.
+
+import (
+	"fmt"
+	"log"
+)
+
+// DoMatching calls f on every triple that matches the given pattern,
+// which is in natural (SPO) order.  Any components (including the
+// graph label) can be given.  Uses the best maintained index and
+// filters when that index can't do all the work.
+func (g *Graph) DoMatching(on *Triple, opts *ReadOptions, f TripleFun) error {
+	index := g.BestIndex(on)
+	q := on.Copy().Permute(index)
+	filter := q.boundIn(index) < on.given()
+	i := g.NewIndexIterator(index, q, opts)
+	defer i.Release()
+	for i.Next() {
+		t, err := i.Triple()
+		if err != nil {
+			log.Printf("DoMatching skipping bad key: %v", err)
+			continue
+		}
+		if filter && !t.Matches(on) {
+			continue
+		}
+		if !f(t) {
+			break
+		}
+	}
+	return nil
+}
+
+// ScanGraph returns the triples in the named graph that match the
+// given pattern, which is in natural (SPO) order.  The pattern's own
+// V is ignored.
+func (g *Graph) ScanGraph(name []byte, on *Triple, opts *ReadOptions) []Triple {
+	var pattern *Triple
+	if on == nil {
+		pattern = &Triple{}
+	} else {
+		pattern = on.Copy()
+	}
+	pattern.V = name
+	acc := make([]Triple, 0, 64)
+	g.DoMatching(pattern, opts, func(t *Triple) bool {
+		acc = append(acc, *t)
+		return true
+	})
+	return acc
+}
+
+// DropGraph removes every triple in the named graph from all
+// indexes.  Deletions are written in batches of 'deleteBatchSize'
+// triples.  Returns the number of triples deleted.
+//
+// The default graph has no name, so it can't be dropped this way.
+func (g *Graph) DropGraph(name []byte, opts *WriteOptions) (int, error) {
+	if len(name) == 0 {
+		return 0, fmt.Errorf("DropGraph needs a graph name")
+	}
+	n := 0
+	var err error
+	batch := make([]*Triple, 0, deleteBatchSize)
+	g.DoMatching(&Triple{nil, nil, nil, name}, nil, func(t *Triple) bool {
+		batch = append(batch, t)
+		if len(batch) == deleteBatchSize {
+			if err = g.DeleteIndexedTriples(batch, opts); err != nil {
+				return false
+			}
+			n += len(batch)
+			batch = batch[0:0]
+		}
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	if 0 < len(batch) {
+		if err := g.DeleteIndexedTriples(batch, opts); err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
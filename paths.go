@@ -0,0 +1,640 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// A pull-based walk.
+//
+// A PathIterator does a depth-first walk with an explicit stack.
+// Each frame on the stack is a path plus the index of the stepper
+// that extends it, and an In or Out step's frame holds the index
+// iterator for the edges it's following.  Next() runs until it has a
+// complete path, so nothing happens between calls: no goroutines, no
+// channels.
+//
+// Paths come out in the same order (and Do() functions run at the
+// same points) as they would with the channel-based Walk().
+//
+// A Repeat() step's frame does its own breadth-first search: a queue
+// of paths still to extend, a set of visited vertices, and a nested
+// PathIterator that runs the repeated chain once from the path at the
+// head of the queue.
+//
+// Or(), And(), and Optional() steps work the same way: a nested
+// PathIterator runs a branch's chain from the frame's path.  The
+// nested walk starts with the frame's tags, so its As() steps are seen
+// after it.
+//
+// Dedup(), Limit(), Skip(), OrderBy(), and Sample() keep their state
+// in the iterator.  Once a Limit() has passed its paths, every frame
+// before it is popped, which releases their index iterators.  OrderBy()
+// and Sample() hold the frames that reach them until the stack is
+// empty (so nothing before them can produce more) and then push them
+// back in their new order.  Inside a Repeat() body or a branch, a
+// stage applies to each run of that chain.
+//
+// Each frame also has the vertexes tagged by As() steps so far, and the
+// current vertex if a Back() step moved it.  Tags inside a Repeat()
+// body stay there.
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+)
+
+type pathFrame struct {
+	path    Path
+	depth   int          // Index of the stepper that extends this path
+	i       *Iterator    // For an edge step
+	q       *Triple      // The edge step's pattern
+	filter  bool         // Whether the index iterator needs filtering
+	visited bool         // For a Has() step
+	r       *repeatState // For a Repeat() step
+	b       *branchState // For an Or(), And(), or Optional() step
+	tags    *tagged
+	at      Vertex // The current vertex after a Back() step
+}
+
+// tagged is a list of the vertexes tagged by As() steps on a path.
+type tagged struct {
+	name   string
+	vertex Vertex
+	prev   *tagged
+}
+
+func (t *tagged) lookup(name string) (Vertex, bool) {
+	for ; t != nil; t = t.prev {
+		if t.name == name {
+			return t.vertex, true
+		}
+	}
+	return nil, false
+}
+
+// vertex returns the frame's current vertex.
+func (f *pathFrame) vertex() Vertex {
+	if f.at != nil {
+		return f.at
+	}
+	return f.path[len(f.path)-1].O
+}
+
+// current returns the triple a Has() step checks.
+func (f *pathFrame) current() Triple {
+	if f.at != nil {
+		return Triple{nil, nil, f.at, nil}
+	}
+	return f.path[len(f.path)-1]
+}
+
+type repeatItem struct {
+	path  Path
+	depth int    // Number of repetitions
+	end   Vertex // Where the path ends (see PathIterator.end())
+}
+
+type repeatState struct {
+	visited map[string]bool
+	queue   []repeatItem
+	at      repeatItem    // What 'inner' is extending
+	inner   *PathIterator // Extends 'at' by one repetition
+	found   bool          // Whether 'inner' has found a new vertex
+}
+
+type branchState struct {
+	chain int               // Index of the next chain to run
+	inner *PathIterator     // Runs the current chain
+	found bool              // Whether any chain has emitted a path
+	ends  []map[string]bool // For And(): where the other chains go
+}
+
+type stageState struct {
+	seen   map[string]bool // For Dedup()
+	n      int64           // Paths that have reached the stage
+	frames []*pathFrame    // Held by OrderBy() and Sample()
+}
+
+type PathIterator struct {
+	g      *Graph
+	ctx    context.Context
+	from   Vertex
+	ss     []*Stepper
+	stack  []*pathFrame
+	post   func(Path) (Path, bool) // Optional final filter
+	err    error
+	closed bool
+	last   *tagged // The tags of the path Next() returned last
+	lastAt Vertex  // And its current vertex if Back() moved it
+	stages map[int]*stageState
+	cut    int // Pop frames at this depth or less (for Limit())
+}
+
+// Paths returns an iterator of the paths from walking the steppers
+// from the given vertex.  The walk uses the graph's context (see
+// WithContext).
+func (g *Graph) Paths(o Vertex, ss []*Stepper) *PathIterator {
+	return g.PathsContext(g.context(), o, ss)
+}
+
+// PathsContext is Paths() with a context.  Once the context is done,
+// Next() returns false and Err() returns the context's error.
+func (g *Graph) PathsContext(ctx context.Context, o Vertex, ss []*Stepper) *PathIterator {
+	it := &PathIterator{g: g, ctx: ctx, from: o, ss: ss, stages: map[int]*stageState{}, cut: -1}
+	it.push(Path{o.toTriple()}, 0, nil)
+	return it
+}
+
+// push adds a frame for the path.  The frame gets the tags of 'from'
+// (if any) and its current vertex unless the path is longer.
+func (it *PathIterator) push(path Path, depth int, from *pathFrame) *pathFrame {
+	f := &pathFrame{path: path, depth: depth}
+	if from != nil {
+		f.tags = from.tags
+		if len(path) == len(from.path) {
+			f.at = from.at
+		}
+	}
+	it.stack = append(it.stack, f)
+	return f
+}
+
+func (it *PathIterator) pop() {
+	top := it.stack[len(it.stack)-1]
+	if top.i != nil {
+		top.i.Release()
+	}
+	if top.r != nil && top.r.inner != nil {
+		top.r.inner.Close()
+	}
+	if top.b != nil && top.b.inner != nil {
+		top.b.inner.Close()
+	}
+	it.stack = it.stack[0 : len(it.stack)-1]
+}
+
+// open starts the index iterator for an edge step.
+func (it *PathIterator) open(f *pathFrame, s *Stepper) {
+	// The current vertex is always the last object in the path.
+	// In-bound edges are reversed in the path so that this remains
+	// true.
+	f.q = &Triple{f.vertex(), s.pattern.P, nil, nil}
+	if s.in {
+		f.q.Permute(OPS)
+	}
+	index := it.g.BestIndex(f.q)
+	on := f.q.Copy().Permute(index)
+	// Filter if the index can't do all the work.
+	f.filter = on.boundIn(index) < f.q.given()
+	f.i = it.g.NewIndexIterator(index, on, nil)
+}
+
+// Next returns the next path.  Returns false at the end (or if the
+// iterator's context is done).
+func (it *PathIterator) Next() (Path, bool) {
+	f, path := it.nextFrame()
+	return path, f != nil
+}
+
+// nextFrame returns the frame (at the final depth) for the next path
+// and the path.  Returns nil at the end.
+func (it *PathIterator) nextFrame() (*pathFrame, Path) {
+	for !it.closed && (0 < len(it.stack) || it.release()) {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			break
+		}
+		top := it.stack[len(it.stack)-1]
+		if top.depth <= it.cut {
+			it.pop()
+			continue
+		}
+		if top.depth == len(it.ss) {
+			it.pop()
+			it.last, it.lastAt = top.tags, top.at
+			path := top.path[1:]
+			if it.post != nil {
+				var ok bool
+				if path, ok = it.post(path); !ok {
+					continue
+				}
+			}
+			return top, path
+		}
+
+		s := it.ss[top.depth]
+		if s.repeat != nil {
+			it.repeat(top, s)
+			continue
+		}
+		if s.tag != nil {
+			it.pop()
+			it.tag(top, s)
+			continue
+		}
+		if s.branch != nil {
+			it.branch(top, s)
+			continue
+		}
+		if s.stage != nil {
+			it.pop()
+			it.stage(top, s)
+			continue
+		}
+		if s.pred != nil {
+			if top.visited {
+				it.pop()
+			} else {
+				top.visited = true
+				if s.pred(top.current()) {
+					s.exec(top.path[1:])
+					it.push(top.path, top.depth+1, top)
+				}
+			}
+			continue
+		}
+
+		if top.i == nil {
+			it.open(top, s)
+		}
+		if !top.i.Next() {
+			it.pop()
+			continue
+		}
+		t, err := top.i.Triple()
+		if err != nil {
+			log.Printf("step skipping bad key: %v", err)
+			continue
+		}
+		if top.filter && !t.Matches(top.q) {
+			continue
+		}
+		if s.in {
+			t.Permute(OPS)
+		}
+		path := make(Path, len(top.path), len(top.path)+1)
+		copy(path, top.path)
+		path = append(path, *t)
+		s.exec(path[1:])
+		it.push(path, top.depth+1, top)
+	}
+	it.Close()
+	return nil, nil
+}
+
+// tag pushes the frame for the step after an As() or Back() step.
+func (it *PathIterator) tag(f *pathFrame, s *Stepper) {
+	name := s.tag.name
+	if !s.tag.back {
+		s.exec(f.path[1:])
+		next := it.push(f.path, f.depth+1, f)
+		next.tags = &tagged{name, f.vertex(), f.tags}
+		return
+	}
+	if v, ok := f.tags.lookup(name); ok {
+		s.exec(f.path[1:])
+		it.push(f.path, f.depth+1, f).at = v
+	}
+}
+
+// key returns what Dedup() and OrderBy() compare for the frame.
+func (f *pathFrame) key(by string) string {
+	if by == "" {
+		return string(f.vertex())
+	}
+	v, _ := f.tags.lookup(by)
+	return string(v)
+}
+
+// stage handles a frame that reaches a Dedup(), Limit(), etc.
+func (it *PathIterator) stage(f *pathFrame, s *Stepper) {
+	st := it.stages[f.depth]
+	if st == nil {
+		st = &stageState{seen: map[string]bool{}}
+		it.stages[f.depth] = st
+	}
+	pass := func() {
+		s.exec(f.path[1:])
+		it.push(f.path, f.depth+1, f)
+	}
+	st.n++
+	switch ps := s.stage; ps.op {
+	case 'd':
+		if k := f.key(ps.by); !st.seen[k] {
+			st.seen[k] = true
+			pass()
+		}
+	case 'l':
+		if st.n <= ps.n {
+			pass()
+		}
+		if ps.n <= st.n && it.cut < f.depth {
+			it.cut = f.depth
+		}
+	case 's':
+		if ps.n < st.n {
+			pass()
+		}
+	case 'o':
+		st.frames = append(st.frames, f)
+	case 'r':
+		// Reservoir sampling.
+		if int64(len(st.frames)) < ps.n {
+			st.frames = append(st.frames, f)
+		} else if i := rand.Int63n(st.n); i < ps.n {
+			st.frames[i] = f
+		}
+	}
+}
+
+// release pushes the frames held by the first OrderBy() or Sample()
+// that has any.  Returns false if there weren't any.
+func (it *PathIterator) release() bool {
+	for depth, s := range it.ss {
+		st := it.stages[depth]
+		if s.stage == nil || st == nil || len(st.frames) == 0 {
+			continue
+		}
+		fs := st.frames
+		st.frames = nil
+		if s.stage.op == 'o' {
+			by := s.stage.by
+			sort.SliceStable(fs, func(i, j int) bool { return fs[i].key(by) < fs[j].key(by) })
+		}
+		// The first one goes on top.
+		for i := len(fs) - 1; 0 <= i; i-- {
+			it.push(fs[i].path, depth+1, fs[i])
+		}
+		for _, f := range fs {
+			s.exec(f.path[1:])
+		}
+		return true
+	}
+	return false
+}
+
+// nested returns an iterator that runs the chain from the frame's
+// current vertex with the frame's tags.
+func (it *PathIterator) nested(f *pathFrame, chain []*Stepper) *PathIterator {
+	inner := it.g.PathsContext(it.ctx, f.vertex(), chain)
+	inner.stack[0].tags = f.tags
+	return inner
+}
+
+// end returns the vertex where the path that Next() returned last
+// ended.  'start' is where the walk started.
+func (it *PathIterator) end(path Path, start Vertex) Vertex {
+	if it.lastAt != nil {
+		return it.lastAt
+	}
+	if len(path) == 0 {
+		return start
+	}
+	return path[len(path)-1].O
+}
+
+// branch either pushes the next path from an Or(), And(), or
+// Optional() step's frame or pops the frame.
+func (it *PathIterator) branch(f *pathFrame, s *Stepper) {
+	b := s.branch
+	st := f.b
+	if st == nil {
+		st = &branchState{}
+		f.b = st
+		if b.op == '&' && 0 < len(b.chains) {
+			for _, chain := range b.chains[1:] {
+				ends := make(map[string]bool)
+				inner := it.nested(f, chain)
+				for {
+					ext, ok := inner.Next()
+					if !ok {
+						break
+					}
+					ends[string(inner.end(ext, f.vertex()))] = true
+				}
+				st.ends = append(st.ends, ends)
+			}
+		}
+	}
+
+	// And() only walks its first chain.
+	chains := b.chains
+	if b.op == '&' && 0 < len(chains) {
+		chains = chains[0:1]
+	}
+	for {
+		if st.inner == nil {
+			if st.chain == len(chains) {
+				if b.op == '?' && !st.found {
+					st.found = true
+					s.exec(f.path[1:])
+					it.push(f.path, f.depth+1, f)
+					return
+				}
+				it.pop()
+				return
+			}
+			st.inner = it.nested(f, chains[st.chain])
+			st.chain++
+		}
+		ext, ok := st.inner.Next()
+		if !ok {
+			st.inner = nil
+			continue
+		}
+		end := st.inner.end(ext, f.vertex())
+		missing := false
+		for _, ends := range st.ends {
+			if !ends[string(end)] {
+				missing = true
+				break
+			}
+		}
+		if missing {
+			continue
+		}
+		st.found = true
+		path := make(Path, len(f.path), len(f.path)+len(ext))
+		copy(path, f.path)
+		path = append(path, ext...)
+		s.exec(path[1:])
+		next := it.push(path, f.depth+1, f)
+		next.tags = st.inner.last
+		if st.inner.lastAt != nil {
+			next.at = st.inner.lastAt
+		}
+		return
+	}
+}
+
+// repeat either pushes the next path from a Repeat() step's frame or
+// pops the frame.
+func (it *PathIterator) repeat(f *pathFrame, s *Stepper) {
+	rep := s.repeat
+	emit := func(item repeatItem) {
+		s.exec(item.path[1:])
+		next := it.push(item.path, f.depth+1, f)
+		if string(item.end) != string(item.path[len(item.path)-1].O) {
+			next.at = item.end
+		}
+	}
+	r := f.r
+	if r == nil {
+		start := f.vertex()
+		r = &repeatState{visited: map[string]bool{string(start): true}}
+		r.queue = append(r.queue, repeatItem{f.path, 0, start})
+		f.r = r
+		if rep.emit && rep.min == 0 {
+			emit(r.queue[0])
+			return
+		}
+	}
+
+	for {
+		if r.inner != nil {
+			ext, ok := r.inner.Next()
+			if !ok {
+				r.inner = nil
+				// A dead end.
+				if !rep.emit && !r.found && rep.min <= r.at.depth {
+					emit(r.at)
+					return
+				}
+				continue
+			}
+			end := r.inner.end(ext, r.at.end)
+			if r.visited[string(end)] {
+				continue
+			}
+			r.visited[string(end)] = true
+			r.found = true
+			path := make(Path, len(r.at.path), len(r.at.path)+len(ext))
+			copy(path, r.at.path)
+			path = append(path, ext...)
+			item := repeatItem{path, r.at.depth + 1, end}
+			last := item.depth == rep.max
+			if !last {
+				r.queue = append(r.queue, item)
+			}
+			if rep.min <= item.depth && (rep.emit || last) {
+				emit(item)
+				return
+			}
+			continue
+		}
+
+		if len(r.queue) == 0 {
+			it.pop()
+			return
+		}
+		r.at = r.queue[0]
+		r.queue = r.queue[1:]
+		r.found = false
+		if r.at.depth == rep.max {
+			// Only when max is 0.
+			if !rep.emit && rep.min == 0 {
+				emit(r.at)
+				return
+			}
+			continue
+		}
+		r.inner = it.g.PathsContext(it.ctx, r.at.end, rep.body)
+	}
+}
+
+// Tags returns the vertexes tagged by As() steps on the path that
+// Next() returned last.
+func (it *PathIterator) Tags() map[string]Vertex {
+	acc := make(map[string]Vertex)
+	for t := it.last; t != nil; t = t.prev {
+		if _, have := acc[t.name]; !have {
+			acc[t.name] = t.vertex
+		}
+	}
+	return acc
+}
+
+// Select returns, for every path, a map from the given names (or all
+// names if none are given) to the vertexes tagged with them.  Then it
+// closes the iterator.
+func (it *PathIterator) Select(names ...string) []map[string]Vertex {
+	return it.SelectSome(-1, names...)
+}
+
+// SelectSome is Select() for at most 'limit' paths.
+func (it *PathIterator) SelectSome(limit int64, names ...string) []map[string]Vertex {
+	acc := make([]map[string]Vertex, 0, 0)
+	it.DoSome(func(path Path) {
+		tags := it.Tags()
+		if 0 < len(names) {
+			selected := make(map[string]Vertex, len(names))
+			for _, name := range names {
+				if v, ok := tags[name]; ok {
+					selected[name] = v
+				}
+			}
+			tags = selected
+		}
+		acc = append(acc, tags)
+	}, limit)
+	return acc
+}
+
+// Err returns the error (if any) that stopped the iterator early.
+func (it *PathIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator's index iterators.  It's fine to call
+// Close more than once.
+func (it *PathIterator) Close() {
+	for 0 < len(it.stack) {
+		it.pop()
+	}
+	it.closed = true
+}
+
+// Do calls the given function on every path and then closes the
+// iterator.
+func (it *PathIterator) Do(f func(Path)) {
+	it.DoSome(f, -1)
+}
+
+// DoSome calls the given function on at most 'limit' paths (no limit
+// if it's negative) and then closes the iterator.
+func (it *PathIterator) DoSome(f func(Path), limit int64) {
+	defer it.Close()
+	for n := int64(0); n != limit; n++ {
+		path, ok := it.Next()
+		if !ok {
+			break
+		}
+		f(path)
+	}
+}
+
+// Collect gathers up all of the paths.  Use caution.
+func (it *PathIterator) Collect() []Path {
+	return it.CollectSome(-1)
+}
+
+// CollectSome gathers up at most 'limit' paths.
+func (it *PathIterator) CollectSome(limit int64) []Path {
+	acc := make([]Path, 0, 0)
+	it.DoSome(func(path Path) {
+		acc = append(acc, path)
+	}, limit)
+	return acc
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Cost-based evaluation of Stepper chains.
+//
+// Walk() always starts at the given vertex and runs the steppers in
+// the order written.  A Plan looks at a chain that runs from one
+// vertex to another (either of which can be nil for "any vertex") and
+// decides whether to walk it forward from the start or backward from
+// the end.  Walking backward follows each edge the other way (Out
+// becomes In and vice versa) in reverse order, and then the paths are
+// reversed so they look like they came from walking forward.
+//
+// Costs are estimates of the number of triples visited.  The first
+// step's count comes from EstimateMatching() with the start vertex.
+// Later steps multiply by an average fan-out, which needs stats (see
+// EnableStats).  Without stats, the fan-out is taken to be 1, so the
+// plan is based on the first step alone.
+//
+// Has() steps are checked against the final, forward paths.  Steppers
+// with Do() functions are only walked forward, since those functions
+// see partial paths.  So are chains with any other steps besides Has()
+// (Repeat(), As(), Or(), Limit(), etc.), whose costs aren't estimated.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A PlanStep is an edge step in the order a Plan walks it.
+type PlanStep struct {
+	In       bool
+	P        []byte
+	Frontier float64 // Estimated number of paths after this step
+}
+
+type Plan struct {
+	g       *Graph
+	steps   []*Stepper // As written
+	from    Vertex
+	to      Vertex
+	Reverse bool
+	Cost    float64
+	Other   float64 // Cost of the other direction (negative if not possible)
+	Steps   []PlanStep
+}
+
+// chain returns the steppers from the first to s.
+func (s *Stepper) chain() []*Stepper {
+	ss := make([]*Stepper, 0, 1)
+	for at := s; at != nil; at = at.previous {
+		ss = append([]*Stepper{at}, ss...)
+	}
+	return ss
+}
+
+// edge reports whether the stepper is an In or Out step.
+func (s *Stepper) edge() bool {
+	return s.pred == nil && s.repeat == nil && s.tag == nil && s.branch == nil && s.stage == nil
+}
+
+// edgeSteps returns the chain's In and Out steps, reversed (and
+// flipped) if 'reverse'.
+func edgeSteps(ss []*Stepper, reverse bool) []*Stepper {
+	acc := make([]*Stepper, 0, len(ss))
+	for _, s := range ss {
+		if !s.edge() {
+			continue
+		}
+		if reverse {
+			flipped := &Stepper{in: !s.in, pattern: s.pattern}
+			acc = append([]*Stepper{flipped}, acc...)
+		} else {
+			acc = append(acc, s)
+		}
+	}
+	return acc
+}
+
+// fanout estimates the number of edges a step follows from a typical
+// vertex.
+func (g *Graph) fanout(s *Stepper) float64 {
+	stats, err := g.TripleStats()
+	if err != nil {
+		return 1
+	}
+	degrees := stats.OutDegrees
+	if s.in {
+		degrees = stats.InDegrees
+	}
+	vertexes := int64(0)
+	for _, n := range degrees {
+		vertexes += n
+	}
+	if vertexes == 0 {
+		return 0
+	}
+	edges := stats.Triples
+	if len(s.pattern.P) != 0 {
+		edges = stats.Predicates[string(s.pattern.P)]
+	}
+	return float64(edges) / float64(vertexes)
+}
+
+// cost estimates walking the steps from the given vertex.
+func (g *Graph) cost(steps []*Stepper, from Vertex) (float64, []PlanStep) {
+	total := float64(0)
+	frontier := float64(1)
+	acc := make([]PlanStep, 0, len(steps))
+	for i, s := range steps {
+		if i == 0 {
+			q := &Triple{[]byte(from), s.pattern.P, nil, nil}
+			if s.in {
+				q.Permute(OPS)
+			}
+			n, _, err := g.EstimateMatching(q)
+			if err != nil {
+				log.Printf("Plan estimate error %v", err)
+			}
+			frontier = float64(n)
+		} else {
+			frontier *= g.fanout(s)
+		}
+		total += frontier
+		acc = append(acc, PlanStep{s.in, s.pattern.P, frontier})
+	}
+	return total, acc
+}
+
+// Plan decides how to walk the chain from 'from' to 'to'.  Either
+// vertex can be nil.
+func (s *Stepper) Plan(g *Graph, from Vertex, to Vertex) *Plan {
+	ss := s.chain()
+	p := &Plan{g: g, steps: ss, from: from, to: to, Other: -1}
+
+	forward, fsteps := g.cost(edgeSteps(ss, false), from)
+	p.Cost, p.Steps = forward, fsteps
+
+	for _, s := range ss {
+		if 0 < len(s.fs) || (!s.edge() && s.pred == nil) {
+			return p
+		}
+	}
+	backward, bsteps := g.cost(edgeSteps(ss, true), to)
+	if backward < forward {
+		p.Reverse = true
+		p.Cost, p.Steps, p.Other = backward, bsteps, forward
+	} else {
+		p.Other = backward
+	}
+	return p
+}
+
+func vertexString(v Vertex) string {
+	if v == nil {
+		return "any vertex"
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+// Explain describes the plan.
+func (p *Plan) Explain() string {
+	start, end := p.from, p.to
+	direction, other := "forward", "backward"
+	if p.Reverse {
+		start, end = end, start
+		direction, other = other, direction
+	}
+	acc := fmt.Sprintf("walk %s from %s (cost %.1f)", direction, vertexString(start), p.Cost)
+	if 0 <= p.Other {
+		acc += fmt.Sprintf(" rather than %s (cost %.1f)", other, p.Other)
+	} else {
+		acc += " (only In, Out, and Has steps go backward)"
+	}
+	acc += "\n"
+	for i, s := range p.Steps {
+		dir := "out"
+		if s.In {
+			dir = "in"
+		}
+		label := "*"
+		if len(s.P) != 0 {
+			label = string(s.P)
+		}
+		acc += fmt.Sprintf("  %d %s %s ~%.1f\n", i+1, dir, label, s.Frontier)
+	}
+	if end != nil {
+		acc += fmt.Sprintf("  keep paths ending at %s\n", vertexString(end))
+	}
+	if p.Reverse {
+		acc += "  reverse paths\n"
+		for _, s := range p.steps {
+			if s.pred != nil {
+				acc += "  check Has() steps\n"
+				break
+			}
+		}
+	}
+	return strings.TrimRight(acc, "\n")
+}
+
+// reversed turns a path from a backward walk into the path the
+// forward walk would have found.
+func reversed(path Path) Path {
+	acc := make(Path, len(path))
+	for i, t := range path {
+		acc[len(path)-1-i] = Triple{t.O, t.P, t.S, t.V}
+	}
+	return acc
+}
+
+// checkHas applies the chain's Has() steps to a forward path.
+func (p *Plan) checkHas(path Path) bool {
+	at := Triple{nil, nil, p.from, nil}
+	n := 0
+	for _, s := range p.steps {
+		if s.pred == nil {
+			at = path[n]
+			n++
+		} else if !s.pred(at) {
+			return false
+		}
+	}
+	return true
+}
+
+// Paths evaluates the plan.  The walk uses the graph's context (see
+// WithContext).
+func (p *Plan) Paths() *PathIterator {
+	return p.pathsContext(p.g.context())
+}
+
+func (p *Plan) pathsContext(ctx context.Context) *PathIterator {
+	start, end := p.from, p.to
+	steps := p.steps
+	if p.Reverse {
+		start, end = end, start
+		steps = edgeSteps(p.steps, true)
+	}
+	it := p.g.PathsContext(ctx, start, steps)
+	it.post = func(path Path) (Path, bool) {
+		if end != nil && (len(path) == 0 || string(path[len(path)-1].O) != string(end)) {
+			return nil, false
+		}
+		if p.Reverse {
+			path = reversed(path)
+			return path, p.checkHas(path)
+		}
+		return path, true
+	}
+	return it
+}
+
+// Walk evaluates the plan.  Returns a channel of paths.
+func (p *Plan) Walk() *Chan {
+	return newPathChan(p.g.context(), p.pathsContext)
+}
@@ -79,6 +79,7 @@ func ParseTriple(s string) (*Triple, error) {
 	}
 	// log.Println(meta + "; " + more)
 
+	more = strings.TrimSpace(more)
 	if more != "" && more != "." {
 		return nil, fmt.Errorf("Triple '%s' not terminated properly with '%s'",
 			s, more)
@@ -28,3 +28,18 @@ func TestQuads(t *testing.T) {
 
 	fmt.Println(triple.String())
 }
+
+func TestQuadsGraph(t *testing.T) {
+	for _, s := range []string{"<s> <p> <o> <g> .", "<s> <p> <o> <g>.", "<s> <p> <o> <g>"} {
+		triple, err := ParseTriple(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(triple.O) != "o" || string(triple.V) != "g" {
+			t.Errorf("Unexpected %s from '%s'", triple, s)
+		}
+	}
+	if _, err := ParseTriple("<s> <p> <o> <g> . x"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
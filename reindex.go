@@ -0,0 +1,276 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Adding and dropping indexes on an existing database.
+//
+// Reindex streams an existing index and writes the keys for another
+// one in big batches.  Each batch also records the last source key it
+// covered, so a Reindex that's interrupted picks up where it left off
+// when it's run again with the same indexes.
+//
+// DropIndex deletes an index's whole key range, with a single range
+// delete if the store is a RangeDeleter (RocksStore and MemoryStore
+// are).  The stats count triples, so neither changes them.
+//
+// The database records the indexes it maintains, and the batch that
+// finishes a Reindex or DropIndex updates that record.  A graph
+// opened with a configuration whose "indexes" list one that the
+// database doesn't maintain refuses to open, and a graph keeps
+// maintaining indexes that the configuration leaves out.
+//
+// Run these when nothing else is writing to the graph: writes that
+// happen during a Reindex might not make it into the new index.  If a
+// DropIndex is interrupted, run it again.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Number of keys per write batch when reindexing.
+const reindexBatchSize = 10000
+
+// Log progress every this many keys.
+const reindexLogEvery = 1000000
+
+// Holds the source and target indexes and the last source key
+// written.
+var reindexKey = []byte("\xff\xfftinygraph.reindex")
+
+// Holds the maintained indexes (see JoinIndexes).
+var indexesKey = []byte("\xff\xfftinygraph.indexes")
+
+// A RangeDeleter is a Store that can delete a range of keys without
+// visiting them.  'to' is exclusive.
+type RangeDeleter interface {
+	DeleteRange(wo *WriteOptions, from []byte, to []byte) error
+}
+
+// indexRange returns the key range [from,to) for the given index.
+func indexRange(index Index) ([]byte, []byte) {
+	return []byte{byte(index)}, []byte{byte(index) + 1}
+}
+
+// openIndexes uses the indexes that the database says it maintains.
+// Older databases don't say.
+func (g *Graph) openIndexes() error {
+	bs, err := g.db.Get(g.ropts, indexesKey)
+	if err != nil || bs == nil {
+		return err
+	}
+	if g.indexes, err = ParseIndexes(string(bs)); err != nil {
+		return fmt.Errorf("Bad maintained indexes '%s': %v", bs, err)
+	}
+	return nil
+}
+
+// configureIndexes checks the configured indexes (nil if the
+// configuration doesn't give any) against the ones the database
+// maintains.  Indexes that the configuration leaves out are still
+// maintained (after the configured ones).  If the database doesn't
+// say what it maintains, the configuration is right, and the database
+// records it.
+func (g *Graph) configureIndexes(configured []Index) error {
+	bs, err := g.db.Get(g.ropts, indexesKey)
+	if err != nil {
+		return err
+	}
+	if bs == nil {
+		if configured != nil {
+			g.indexes = configured
+		}
+		return g.db.Put(g.wopts, indexesKey, []byte(JoinIndexes(g.indexes)))
+	}
+	if configured == nil {
+		return nil
+	}
+	for _, index := range configured {
+		if !g.HasIndex(index) {
+			return fmt.Errorf("Configuration has index %s, but the database only maintains %s.  Try 'tinygraph -reindex'.",
+				index, JoinIndexes(g.indexes))
+		}
+	}
+	acc := append([]Index{}, configured...)
+	for _, have := range g.indexes {
+		if !hasIndex(configured, have) {
+			log.Printf("configureIndexes: configuration doesn't have %s, which the database maintains", have)
+			acc = append(acc, have)
+		}
+	}
+	g.indexes = acc
+	return nil
+}
+
+// reindexResume returns the last source key written by an earlier,
+// unfinished Reindex from 'from' to 'to' (or nil).
+func (g *Graph) reindexResume(from Index, to Index) ([]byte, error) {
+	bs, err := g.db.Get(g.ropts, reindexKey)
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	if len(bs) < 2 || Index(bs[0]) != from || Index(bs[1]) != to {
+		return nil, fmt.Errorf("Unfinished reindex %v", bs)
+	}
+	return bs[2:], nil
+}
+
+// Reindex writes the 'to' index based on the 'from' index, which the
+// graph must maintain.  Afterwards the graph maintains 'to', too.
+// Returns the number of keys written by this call.
+func (g *Graph) Reindex(from Index, to Index) (int, error) {
+	if g.snapshot != nil {
+		return 0, ErrSnapshotWrite
+	}
+	if !g.HasIndex(from) {
+		return 0, fmt.Errorf("Graph doesn't maintain %s", from)
+	}
+	if from == to || int(to) >= len(indexNames) {
+		return 0, fmt.Errorf("Can't reindex %s to %s", from, to)
+	}
+	if err := g.noteUnlogged(); err != nil {
+		return 0, err
+	}
+
+	last, err := g.reindexResume(from, to)
+	if err != nil {
+		return 0, err
+	}
+	prefix, _ := indexRange(from)
+	seek := prefix
+	if last != nil {
+		log.Printf("Reindex %s to %s resuming after %q", from, to, last)
+		seek = append(last, 0)
+	}
+
+	n := 0
+	pending := 0
+	batch := g.db.NewBatch()
+	flush := func(k []byte) error {
+		progress := append([]byte{byte(from), byte(to)}, k...)
+		batch.Put(reindexKey, progress)
+		err := g.write(g.wopts, batch, nil)
+		batch.Clear()
+		pending = 0
+		return err
+	}
+
+	// An index iterator that starts after the last key written.
+	i := g.NewIndexIterator(from, nil, nil)
+	i.from = seek
+	defer i.Release()
+	for i.Next() {
+		k := i.Key()
+		t, err := IndexedTripleFromBytes(from, k, nil)
+		if err != nil {
+			return n, err
+		}
+		batch.Put(t.Unpermute(from).IndexKey(to), i.Value())
+		n++
+		pending++
+		if pending == reindexBatchSize {
+			if err = flush(k); err != nil {
+				return n, err
+			}
+		}
+		if n%reindexLogEvery == 0 {
+			log.Printf("Reindex %s to %s wrote %d keys", from, to, n)
+		}
+	}
+	indexes := g.indexes
+	if !g.HasIndex(to) {
+		indexes = append(append([]Index{}, indexes...), to)
+	}
+	batch.Delete(reindexKey)
+	batch.Put(indexesKey, []byte(JoinIndexes(indexes)))
+	if err = g.write(g.wopts, batch, nil); err != nil {
+		return n, err
+	}
+	g.indexes = indexes
+	log.Printf("Reindex %s to %s done with %d keys", from, to, n)
+	return n, nil
+}
+
+// DropIndex deletes every key in the given index and stops
+// maintaining it.  SPO can't be dropped.
+func (g *Graph) DropIndex(index Index) error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
+	if index == SPO || int(index) >= len(indexNames) {
+		return fmt.Errorf("Can't drop %s", index)
+	}
+	if err := g.noteUnlogged(); err != nil {
+		return err
+	}
+
+	from, to := indexRange(index)
+	if rd, ok := g.db.(RangeDeleter); ok {
+		if err := rd.DeleteRange(g.wopts, from, to); err != nil {
+			return err
+		}
+	} else if err := deleteRange(g.db, g.wopts, from, to); err != nil {
+		return err
+	}
+
+	acc := make([]Index, 0, len(g.indexes))
+	for _, have := range g.indexes {
+		if have != index {
+			acc = append(acc, have)
+		}
+	}
+	batch := g.db.NewBatch()
+	batch.Put(indexesKey, []byte(JoinIndexes(acc)))
+	// Forget an unfinished Reindex to this index.
+	if bs, err := g.db.Get(g.ropts, reindexKey); err != nil {
+		return err
+	} else if 2 <= len(bs) && Index(bs[1]) == index {
+		batch.Delete(reindexKey)
+	}
+	if err := g.write(g.wopts, batch, nil); err != nil {
+		return err
+	}
+	g.indexes = acc
+	log.Printf("DropIndex %s done", index)
+	return nil
+}
+
+// deleteRange deletes the keys in [from,to) in batches.
+func deleteRange(db Store, opts *WriteOptions, from []byte, to []byte) error {
+	i := db.NewIterator(nil)
+	defer i.Close()
+	pending := 0
+	batch := db.NewBatch()
+	for i.Seek(from); i.Valid(); i.Next() {
+		k := i.Key()
+		if bytes.Compare(to, k) <= 0 {
+			break
+		}
+		batch.Delete(k)
+		pending++
+		if pending == deleteBatchSize {
+			if err := db.Write(opts, batch); err != nil {
+				return err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+	if 0 < pending {
+		return db.Write(opts, batch)
+	}
+	return nil
+}
@@ -20,7 +20,9 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/robertkrimen/otto"
+	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -29,6 +31,7 @@ import (
 
 // Env hold our bindings.
 type Env struct {
+	graph *Graph
 }
 
 func (e *Env) Vertex(s string) Vertex {
@@ -54,34 +57,108 @@ func GetGraph(configFilename string) (*Graph, *Options) {
 		panic(err)
 	}
 
-	opts := RocksOpts(config)
-	opts.SetCreateIfMissing(true)
-	opts.SetErrorIfExists(false)
-
-	dirname := "tmp.db"
-	if dir, ok := config.StringKey("db_dir"); ok {
-		dirname = dir
+	db, err := OpenStore(config)
+	if err != nil {
+		panic(err)
 	}
 
-	g, err := NewGraph(dirname, opts)
-
+	// An existing dictionary opens with the graph, so its cache size
+	// has to be known up front.
+	cacheSize := DefaultDictionaryCacheSize
+	if n, ok := config.IntKey("dictionary_cache_size"); ok {
+		cacheSize = n
+	}
+	g, err := openGraph(db, cacheSize)
 	if err != nil {
 		panic(err)
 	}
 
-	g.wopts = RocksWriteOpts(config)
-	g.ropts = RocksReadOpts(config)
+	var indexes []Index
+	if names, ok := config.StringKey("indexes"); ok {
+		if indexes, err = ParseIndexes(names); err != nil {
+			panic(err)
+		}
+	}
+	if err = g.configureIndexes(indexes); err != nil {
+		panic(err)
+	}
+	log.Printf("config indexes %v\n", g.indexes)
+
+	if b, ok := config.BoolKey("dictionary"); ok && b {
+		if err = g.EnableDictionary(cacheSize); err != nil {
+			panic(err)
+		}
+		log.Printf("config dictionary cache size %d\n", cacheSize)
+	}
+
+	if b, ok := config.BoolKey("changelog"); ok && b {
+		if err = g.EnableChangelog(); err != nil {
+			panic(err)
+		}
+		log.Printf("config changelog at %d\n", g.LastChange())
+	}
+
+	if b, ok := config.BoolKey("stats"); ok && b {
+		if err = g.EnableStats(); err != nil {
+			panic(err)
+		}
+		log.Printf("config stats\n")
+	}
 
 	return g, config
 }
 
+// DBDir returns the database directory given by the configuration.
+func DBDir(config *Options) string {
+	if dir, ok := config.StringKey("db_dir"); ok {
+		return dir
+	}
+	return "tmp.db"
+}
+
 var SharedGraph *Graph
 
-// Graph returns the global graph.  Sorry.
+// Graph returns the global graph (or the graph given to SetGraph).
+// Sorry.
 func (e *Env) Graph() *Graph {
+	if e.graph != nil {
+		return e.graph
+	}
 	return SharedGraph
 }
 
+// SetGraph sets the graph that Graph() returns.  Use nil to go back
+// to SharedGraph.  The HTTP server uses this to give each request its
+// own snapshot.
+func (e *Env) SetGraph(g *Graph) {
+	e.graph = g
+}
+
+// Txn starts a transaction on the graph.  Remember to Commit() or
+// Rollback().
+func (e *Env) Txn() *Txn {
+	return e.Graph().Txn()
+}
+
+// Count estimates the number of triples matching the given pattern.
+// Use "" for a wildcard.  Handy for deciding which way to walk.
+func (e *Env) Count(s, p, o string) int64 {
+	n, _, err := e.Graph().EstimateMatching(TripleFromStrings(s, p, o))
+	if err != nil {
+		log.Printf("Count error %v", err)
+	}
+	return n
+}
+
+// Stats returns the graph's counts (if it keeps them).
+func (e *Env) Stats() *TripleStats {
+	stats, err := e.Graph().TripleStats()
+	if err != nil {
+		log.Printf("Stats error %v", err)
+	}
+	return stats
+}
+
 func (e *Env) Out(p []byte) *Stepper {
 	return Out(p)
 }
@@ -98,6 +175,263 @@ func (e *Env) AllIn() *Stepper {
 	return AllIn()
 }
 
+func (e *Env) Repeat(body *Stepper, min int, max int) *Stepper {
+	return Repeat(body, min, max)
+}
+
+func (e *Env) OutStar(p []byte) *Stepper {
+	return OutStar(p)
+}
+
+func (e *Env) InStar(p []byte) *Stepper {
+	return InStar(p)
+}
+
+func (e *Env) Or(chains ...*Stepper) *Stepper {
+	return Or(chains...)
+}
+
+func (e *Env) And(chains ...*Stepper) *Stepper {
+	return And(chains...)
+}
+
+func (e *Env) Intersect(chains ...*Stepper) *Stepper {
+	return Intersect(chains...)
+}
+
+func (e *Env) Optional(chain *Stepper) *Stepper {
+	return Optional(chain)
+}
+
+func (e *Env) Dedup(by ...string) *Stepper {
+	return Dedup(by...)
+}
+
+func (e *Env) Limit(n int64) *Stepper {
+	return Limit(n)
+}
+
+func (e *Env) Skip(n int64) *Stepper {
+	return Skip(n)
+}
+
+func (e *Env) OrderBy(by ...string) *Stepper {
+	return OrderBy(by...)
+}
+
+func (e *Env) Sample(n int64) *Stepper {
+	return Sample(n)
+}
+
+func (e *Env) As(name string) *Stepper {
+	return As(name)
+}
+
+func (e *Env) Back(name string) *Stepper {
+	return Back(name)
+}
+
+// Select returns, for each path from the iterator, a map from the
+// given names (all if none) to the vertexes tagged with As().
+func (e *Env) Select(it *PathIterator, names ...string) []map[string]string {
+	acc := make([]map[string]string, 0, 0)
+	for _, tags := range it.Select(names...) {
+		m := make(map[string]string, len(tags))
+		for name, v := range tags {
+			m[name] = string(v)
+		}
+		acc = append(acc, m)
+	}
+	return acc
+}
+
+// CountPaths returns the number of paths from the iterator.
+func (e *Env) CountPaths(it *PathIterator) int64 {
+	n, err := it.Count()
+	if err != nil {
+		log.Printf("CountPaths error %v", err)
+	}
+	return n
+}
+
+// GroupCount returns the number of paths from the iterator for each
+// vertex tagged 'by' (or each current vertex if 'by' is "").
+func (e *Env) GroupCount(it *PathIterator, by string) map[string]int64 {
+	counts, err := it.GroupBy(by).Count()
+	if err != nil {
+		log.Printf("GroupCount error %v", err)
+	}
+	return counts
+}
+
+// GroupMin returns the least vertex tagged 'of' for each vertex tagged
+// 'by'.
+func (e *Env) GroupMin(it *PathIterator, by, of string) map[string]string {
+	acc, err := it.GroupBy(by).Min(of)
+	if err != nil {
+		log.Printf("GroupMin error %v", err)
+	}
+	return acc
+}
+
+// GroupMax returns the greatest vertex tagged 'of' for each vertex
+// tagged 'by'.
+func (e *Env) GroupMax(it *PathIterator, by, of string) map[string]string {
+	acc, err := it.GroupBy(by).Max(of)
+	if err != nil {
+		log.Printf("GroupMax error %v", err)
+	}
+	return acc
+}
+
+// Min returns the least vertex tagged 'by' (or current vertex if 'by'
+// is "") from the iterator's paths.  Numbers compare as numbers.
+func (e *Env) Min(it *PathIterator, by string) string {
+	v, err := it.Min(by)
+	if err != nil {
+		log.Printf("Min error %v", err)
+	}
+	return string(v)
+}
+
+// Max returns the greatest vertex tagged 'by' (see Min).
+func (e *Env) Max(it *PathIterator, by string) string {
+	v, err := it.Max(by)
+	if err != nil {
+		log.Printf("Max error %v", err)
+	}
+	return string(v)
+}
+
+// direction parses "in" or "out".
+func direction(dir string) (bool, error) {
+	switch dir {
+	case "in":
+		return true, nil
+	case "out":
+		return false, nil
+	}
+	return false, fmt.Errorf("Bad direction %q (want in or out)", dir)
+}
+
+// Degree returns the number of edges in ('dir' is "in") or out ("out")
+// of the vertex with the given property ("" for any).
+func (e *Env) Degree(v, dir, p string) int64 {
+	in, err := direction(dir)
+	if err != nil {
+		log.Printf("Degree error %v", err)
+		return 0
+	}
+	n, err := e.Graph().Degree(Vertex(v), in, []byte(p))
+	if err != nil {
+		log.Printf("Degree error %v", err)
+	}
+	return n
+}
+
+// Degrees returns the degree (see Degree) of each vertex the iterator's
+// paths reach.
+func (e *Env) Degrees(it *PathIterator, dir, p string) map[string]int64 {
+	in, err := direction(dir)
+	if err != nil {
+		log.Printf("Degrees error %v", err)
+		it.Close()
+		return nil
+	}
+	acc, err := it.Degree(in, []byte(p))
+	if err != nil {
+		log.Printf("Degrees error %v", err)
+	}
+	return acc
+}
+
+// CountMatching returns the exact number of triples matching the
+// given pattern.  Use "" for a wildcard.
+func (e *Env) CountMatching(s, p, o string) int64 {
+	n, err := e.Graph().CountMatching(TripleFromStrings(s, p, o))
+	if err != nil {
+		log.Printf("CountMatching error %v", err)
+	}
+	return n
+}
+
+// GroupMatching returns the number of triples matching the given
+// pattern for each term at the position ("s", "p", "o", or "g").
+func (e *Env) GroupMatching(s, p, o, position string) map[string]int64 {
+	counts, err := e.Graph().GroupMatching(TripleFromStrings(s, p, o), position)
+	if err != nil {
+		log.Printf("GroupMatching error %v", err)
+	}
+	return counts
+}
+
+// Histogram returns the number of keys with each count in 'counts'
+// (from GroupCount, GroupMatching, or Degrees).  The counts are
+// strings, since otto wants string keys.
+func (e *Env) Histogram(counts map[string]int64) map[string]int64 {
+	acc := make(map[string]int64)
+	for n, keys := range Histogram(counts) {
+		acc[strconv.FormatInt(n, 10)] = keys
+	}
+	return acc
+}
+
+// PathOptions makes options for ShortestPath and KShortestPaths.  Use
+// 0 for no limit on the number of edges.
+func (e *Env) PathOptions(maxDepth int) *PathOptions {
+	return &PathOptions{MaxDepth: maxDepth}
+}
+
+// ShortestPath returns a shortest path between the two vertexes (or
+// null).  'opts' can be null.
+func (e *Env) ShortestPath(from, to string, opts *PathOptions) Path {
+	path, err := e.Graph().ShortestPath(Vertex(from), Vertex(to), opts)
+	if err != nil {
+		log.Printf("ShortestPath error %v", err)
+	}
+	return path
+}
+
+// KShortestPaths returns up to k shortest paths between the two
+// vertexes.  'opts' can be null.
+func (e *Env) KShortestPaths(from, to string, k int, opts *PathOptions) []Path {
+	paths, err := e.Graph().KShortestPaths(Vertex(from), Vertex(to), k, opts)
+	if err != nil {
+		log.Printf("KShortestPaths error %v", err)
+	}
+	return paths
+}
+
+// Match returns the bindings for at most 'limit' matches (all if
+// 'limit' is negative) of triple patterns like '?x label "Africa" .
+// ?x part_holonym ?y'.
+func (e *Env) Match(patterns string, limit int64) []map[string]string {
+	b, err := ParseBGP(patterns)
+	if err != nil {
+		log.Printf("Match error %v", err)
+		return nil
+	}
+	rows, err := e.Graph().MatchBGP(b, limit)
+	if err != nil {
+		log.Printf("Match error %v", err)
+	}
+	acc := make([]map[string]string, 0, len(rows))
+	for _, bs := range rows {
+		acc = append(acc, bs.Strings())
+	}
+	return acc
+}
+
+// SPARQL runs a SELECT or ASK query.  Returns the results in the
+// SPARQL JSON results format.
+func (e *Env) SPARQL(query string) *SPARQLResult {
+	result, err := e.Graph().SPARQL(query)
+	if err != nil {
+		log.Printf("SPARQL error %v", err)
+	}
+	return result
+}
+
 // Bs converts the given string to a byte array.
 func (e *Env) Bs(s string) []byte {
 	return []byte(s)
@@ -128,7 +462,12 @@ func (i *REPLIterator) Next() interface{} {
 		return nil
 	}
 	i.n--
-	return <-(i.c).c
+	path, ok := i.c.next()
+	if !ok {
+		i.Close()
+		return nil
+	}
+	return path
 }
 
 // BUG(?): Iterator can return an array with a nil first component
@@ -157,8 +496,10 @@ func (e *Env) Scan(g *Graph, s []byte, limit int64) [][]string {
 	return acc
 }
 
-func InitEnv(vm *otto.Otto) {
-	vm.Set("G", new(Env))
+// InitEnv installs a new Env as 'G' and returns it.
+func InitEnv(vm *otto.Otto) *Env {
+	env := new(Env)
+	vm.Set("G", env)
 
 	vm.Set("toJS", func(call otto.FunctionCall) otto.Value {
 		result, err := vm.ToValue(call.Argument(0))
@@ -167,6 +508,8 @@ func InitEnv(vm *otto.Otto) {
 		}
 		return result
 	})
+
+	return env
 }
 
 func REPL() {
@@ -0,0 +1,206 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !norocks
+// +build !norocks
+
+package tinygraph
+
+// A Store backed by RocksDB.
+
+import (
+	"fmt"
+
+	rocks "github.com/jsccast/rocksdb"
+)
+
+func init() {
+	DefaultStore = "rocksdb"
+	RegisterStore("rocksdb", func(config *Options) (Store, error) {
+		opts := RocksOpts(config)
+		opts.SetCreateIfMissing(true)
+		opts.SetErrorIfExists(false)
+		s, err := OpenRocksStore(DBDir(config), opts)
+		if err != nil {
+			return nil, err
+		}
+		s.wopts.Close()
+		s.wopts = RocksWriteOpts(config)
+		s.ropts.Close()
+		s.ropts = RocksReadOpts(config)
+		return s, nil
+	})
+}
+
+type RocksStore struct {
+	path  string
+	db    *rocks.DB
+	opts  *rocks.Options
+	wopts *rocks.WriteOptions
+	ropts *rocks.ReadOptions
+	// For non-nil WriteOptions, indexed by writeVariant().
+	variants [4]*rocks.WriteOptions
+}
+
+func OpenRocksStore(path string, opts *rocks.Options) (*RocksStore, error) {
+	db, err := rocks.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &RocksStore{path: path, db: db, opts: opts, wopts: rocks.NewWriteOptions(), ropts: rocks.NewReadOptions()}
+	for i := range s.variants {
+		wopts := rocks.NewWriteOptions()
+		wopts.SetSync(i&1 != 0)
+		wopts.DisableWAL(i&2 != 0)
+		s.variants[i] = wopts
+	}
+	return s, nil
+}
+
+// NewGraph opens a graph on a RocksDB database.
+func NewGraph(path string, opts *rocks.Options) (*Graph, error) {
+	s, err := OpenRocksStore(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGraphWithStore(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// DB returns the underlying RocksDB database.
+func (s *RocksStore) DB() *rocks.DB {
+	return s.db
+}
+
+// readOpts returns the RocksDB options for the read.  Returns nil if
+// the read is from a released snapshot.
+func (s *RocksStore) readOpts(ro *ReadOptions) *rocks.ReadOptions {
+	if ro == nil || ro.Snapshot == nil {
+		return s.ropts
+	}
+	snap := ro.Snapshot.(*rocksSnapshot)
+	if snap.snap == nil {
+		return nil
+	}
+	return snap.ropts
+}
+
+func (s *RocksStore) writeOpts(wo *WriteOptions) *rocks.WriteOptions {
+	if wo == nil {
+		return s.wopts
+	}
+	return s.variants[writeVariant(wo)]
+}
+
+func writeVariant(wo *WriteOptions) int {
+	i := 0
+	if wo.Sync {
+		i |= 1
+	}
+	if wo.DisableWAL {
+		i |= 2
+	}
+	return i
+}
+
+func (s *RocksStore) Get(ro *ReadOptions, k []byte) ([]byte, error) {
+	ropts := s.readOpts(ro)
+	if ropts == nil {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.Get(ropts, k)
+}
+
+func (s *RocksStore) Put(wo *WriteOptions, k []byte, v []byte) error {
+	return s.db.Put(s.writeOpts(wo), k, v)
+}
+
+func (s *RocksStore) Delete(wo *WriteOptions, k []byte) error {
+	return s.db.Delete(s.writeOpts(wo), k)
+}
+
+func (s *RocksStore) NewBatch() Batch {
+	return rocks.NewWriteBatch()
+}
+
+func (s *RocksStore) Write(wo *WriteOptions, b Batch) error {
+	batch, ok := b.(*rocks.WriteBatch)
+	if !ok {
+		return fmt.Errorf("RocksStore can't write a %T", b)
+	}
+	return s.db.Write(s.writeOpts(wo), batch)
+}
+
+func (s *RocksStore) NewIterator(ro *ReadOptions) StoreIterator {
+	ropts := s.readOpts(ro)
+	if ropts == nil {
+		return emptyIterator{}
+	}
+	return s.db.NewIterator(ropts)
+}
+
+type rocksSnapshot struct {
+	db    *rocks.DB
+	snap  *rocks.Snapshot
+	ropts *rocks.ReadOptions
+}
+
+func (s *RocksStore) NewSnapshot() Snapshot {
+	snap := s.db.NewSnapshot()
+	ropts := rocks.NewReadOptions()
+	ropts.SetSnapshot(snap)
+	return &rocksSnapshot{s.db, snap, ropts}
+}
+
+func (snap *rocksSnapshot) Release() {
+	if snap.snap != nil {
+		snap.db.ReleaseSnapshot(snap.snap)
+		snap.ropts.Close()
+		snap.snap = nil
+	}
+}
+
+// ApproximateSize uses RocksDB's GetApproximateSizes, which only
+// knows about data that's been flushed to files.
+func (s *RocksStore) ApproximateSize(from []byte, to []byte) uint64 {
+	return s.db.GetApproximateSizes([]rocks.Range{{from, to}})[0]
+}
+
+func (s *RocksStore) Compact() {
+	ff := byte(0xff)
+	r := rocks.Range{[]byte{}, []byte{ff, ff, ff, ff, ff, ff, ff, ff, ff}}
+	s.db.CompactRange(r)
+}
+
+func (s *RocksStore) Stats() string {
+	return s.db.PropertyValue("rocksdb.stats")
+}
+
+func (s *RocksStore) Close() error {
+	if s.db == nil {
+		return fmt.Errorf("RocksStore isn't open")
+	}
+	s.db.Close()
+	s.db = nil
+	for _, wopts := range s.variants {
+		wopts.Close()
+	}
+	s.wopts.Close()
+	s.ropts.Close()
+	return nil
+}
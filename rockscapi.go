@@ -0,0 +1,261 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !norocks
+// +build !norocks
+
+package tinygraph
+
+// RocksDB features that our RocksDB binding doesn't have (checkpoints,
+// backups, SST file ingestion, and range deletes), straight from
+// RocksDB's C API.  The binding's handles (DB.Ldb etc.) are the
+// C API's handles, but cgo gives each package its own C types, so we
+// convert them.
+
+// #cgo LDFLAGS: -lrocksdb
+// #include <stdlib.h>
+// #include "rocksdb/c.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	rocks "github.com/jsccast/rocksdb"
+)
+
+// Number of keys per SST file that IngestSorted writes.
+const rocksIngestFileKeys = 1 << 24
+
+// BackupInfo.Store for RocksDB's backups.
+const rocksBackupStore = "rocksdb"
+
+// Two of RocksDB's backup engines can't use the same directory at the
+// same time, so our backups and restores take turns.
+var rocksBackupMu sync.Mutex
+
+// rocksError converts (and frees) an error from the C API.
+func rocksError(cerr *C.char) error {
+	if cerr == nil {
+		return nil
+	}
+	err := errors.New(C.GoString(cerr))
+	C.free(unsafe.Pointer(cerr))
+	return err
+}
+
+// cbytes returns a C pointer to the slice's bytes (which C can't
+// keep).
+func cbytes(bs []byte) *C.char {
+	if len(bs) == 0 {
+		return nil
+	}
+	return (*C.char)(unsafe.Pointer(&bs[0]))
+}
+
+func (s *RocksStore) cdb() *C.rocksdb_t {
+	return (*C.rocksdb_t)(unsafe.Pointer(s.db.Ldb))
+}
+
+// Checkpoint uses a RocksDB checkpoint, which hard-links the
+// database's files into the new directory (or copies them if the
+// directory is on another filesystem).  The directory can't exist
+// yet.
+func (s *RocksStore) Checkpoint(dir string) error {
+	var cerr *C.char
+	cp := C.rocksdb_checkpoint_object_create(s.cdb(), &cerr)
+	if err := rocksError(cerr); err != nil {
+		return err
+	}
+	defer C.rocksdb_checkpoint_object_destroy(cp)
+	cdir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cdir))
+	// Flush the memtable first, so the checkpoint doesn't need the
+	// WAL.
+	C.rocksdb_checkpoint_create(cp, cdir, 0, &cerr)
+	return rocksError(cerr)
+}
+
+func (s *RocksStore) openBackupEngine(dir string) (*C.rocksdb_backup_engine_t, error) {
+	cdir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cdir))
+	var cerr *C.char
+	be := C.rocksdb_backup_engine_open((*C.rocksdb_options_t)(unsafe.Pointer(s.opts.Opt)), cdir, &cerr)
+	if err := rocksError(cerr); err != nil {
+		return nil, err
+	}
+	return be, nil
+}
+
+// CreateBackup uses RocksDB's BackupEngine, which copies only the SST
+// files that earlier backups in the directory don't already have.
+func (s *RocksStore) CreateBackup(dir string, info *BackupInfo) error {
+	rocksBackupMu.Lock()
+	defer rocksBackupMu.Unlock()
+	be, err := s.openBackupEngine(dir)
+	if err != nil {
+		return err
+	}
+	defer C.rocksdb_backup_engine_close(be)
+	var cerr *C.char
+	C.rocksdb_backup_engine_create_new_backup(be, s.cdb(), &cerr)
+	if err := rocksError(cerr); err != nil {
+		return err
+	}
+	// The backups are ordered by ID, so the new one is last.
+	backups := C.rocksdb_backup_engine_get_backup_info(be)
+	defer C.rocksdb_backup_engine_info_destroy(backups)
+	n := C.rocksdb_backup_engine_info_count(backups)
+	if n == 0 {
+		return fmt.Errorf("No RocksDB backups in %s after creating one", dir)
+	}
+	info.ID = int(C.rocksdb_backup_engine_info_backup_id(backups, n-1))
+	info.Bytes = int64(C.rocksdb_backup_engine_info_size(backups, n-1))
+	info.Store = rocksBackupStore
+	return nil
+}
+
+// RestoreBackup closes the database, has RocksDB's BackupEngine copy
+// the backup's files into the database's directory, and then opens
+// the database again.
+func (s *RocksStore) RestoreBackup(dir string, id int) error {
+	rocksBackupMu.Lock()
+	defer rocksBackupMu.Unlock()
+	be, err := s.openBackupEngine(dir)
+	if err != nil {
+		return err
+	}
+	defer C.rocksdb_backup_engine_close(be)
+	opts := C.rocksdb_restore_options_create()
+	defer C.rocksdb_restore_options_destroy(opts)
+	cpath := C.CString(s.path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	s.db.Close()
+	var cerr *C.char
+	C.rocksdb_backup_engine_restore_db_from_backup(be, cpath, cpath, opts, C.uint32_t(id), &cerr)
+	err = rocksError(cerr)
+	// Open again even if the restore failed.
+	db, oerr := rocks.Open(s.path, s.opts)
+	s.db = db
+	if err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// IngestSorted writes the keys to SST files with RocksDB's
+// SstFileWriter and then adds the files to the database with
+// IngestExternalFile, so the keys skip both the WAL and the memtable.
+// The keys have to be strictly increasing.  The files are written in
+// the database's directory, so ingesting them just moves them.
+// Nothing is ingested if there's an error.
+func (s *RocksStore) IngestSorted(next func() ([]byte, []byte, bool)) (int, error) {
+	dir, err := ioutil.TempDir(s.path, "ingest")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	envOpts := C.rocksdb_envoptions_create()
+	defer C.rocksdb_envoptions_destroy(envOpts)
+	n := 0
+	filenames := make([]string, 0, 1)
+	for {
+		filename := filepath.Join(dir, fmt.Sprintf("%06d.sst", len(filenames)))
+		keys, err := s.writeSST(envOpts, filename, next)
+		if err != nil {
+			return 0, err
+		}
+		if keys == 0 {
+			break
+		}
+		n += keys
+		filenames = append(filenames, filename)
+		if keys < rocksIngestFileKeys {
+			break
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := s.ingest(filenames); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeSST writes up to rocksIngestFileKeys keys to a new SST file.
+// Returns the number of keys written.  The file is useless if that's
+// zero, since RocksDB won't finish an empty SST file.
+func (s *RocksStore) writeSST(envOpts *C.rocksdb_envoptions_t, filename string, next func() ([]byte, []byte, bool)) (int, error) {
+	w := C.rocksdb_sstfilewriter_create(envOpts, (*C.rocksdb_options_t)(unsafe.Pointer(s.opts.Opt)))
+	defer C.rocksdb_sstfilewriter_destroy(w)
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+	var cerr *C.char
+	C.rocksdb_sstfilewriter_open(w, cfilename, &cerr)
+	if err := rocksError(cerr); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < rocksIngestFileKeys {
+		k, v, ok := next()
+		if !ok {
+			break
+		}
+		C.rocksdb_sstfilewriter_put(w, cbytes(k), C.size_t(len(k)), cbytes(v), C.size_t(len(v)), &cerr)
+		if err := rocksError(cerr); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	C.rocksdb_sstfilewriter_finish(w, &cerr)
+	return n, rocksError(cerr)
+}
+
+// ingest adds the SST files to the database in one step.
+func (s *RocksStore) ingest(filenames []string) error {
+	cfilenames := make([]*C.char, len(filenames))
+	for i, filename := range filenames {
+		cfilenames[i] = C.CString(filename)
+		defer C.free(unsafe.Pointer(cfilenames[i]))
+	}
+	opts := C.rocksdb_ingestexternalfileoptions_create()
+	defer C.rocksdb_ingestexternalfileoptions_destroy(opts)
+	C.rocksdb_ingestexternalfileoptions_set_move_files(opts, 1)
+	var cerr *C.char
+	C.rocksdb_ingest_external_file(s.cdb(), &cfilenames[0], C.size_t(len(cfilenames)), opts, &cerr)
+	return rocksError(cerr)
+}
+
+// DeleteRange writes a single range tombstone for [from,to) instead
+// of a delete for each key.
+func (s *RocksStore) DeleteRange(wo *WriteOptions, from []byte, to []byte) error {
+	batch := C.rocksdb_writebatch_create()
+	defer C.rocksdb_writebatch_destroy(batch)
+	C.rocksdb_writebatch_delete_range(batch, cbytes(from), C.size_t(len(from)), cbytes(to), C.size_t(len(to)))
+	wopts := (*C.rocksdb_writeoptions_t)(unsafe.Pointer(s.writeOpts(wo).Opt))
+	var cerr *C.char
+	C.rocksdb_write(s.cdb(), wopts, batch, &cerr)
+	return rocksError(cerr)
+}
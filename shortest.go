@@ -0,0 +1,307 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Shortest paths between two vertexes.
+//
+// ShortestPath does a bidirectional breadth-first search: one side
+// follows out-bound edges (SPO) from the start, and the other follows
+// in-bound edges (OPS) back from the end.  Each round expands the
+// smaller frontier by one level.  With Undirected, both sides follow
+// edges both ways.
+//
+// KShortestPaths uses Yen's algorithm on top of that: each next path
+// is the shortest "spur" off of a prefix of an earlier path that
+// avoids the edges those paths already took from there.
+//
+// Paths have the same shape as a walk's paths: one triple per edge,
+// with each triple's S the vertex it leaves and its O the vertex it
+// reaches.  An edge followed backwards has its S and O swapped (like
+// an In() step's triples).
+
+import (
+	"sort"
+)
+
+// PathOptions constrain ShortestPath and KShortestPaths.  A nil
+// *PathOptions means no constraints.
+type PathOptions struct {
+	Allow      [][]byte // If given, only follow these predicates
+	Deny       [][]byte // Never follow these predicates
+	MaxDepth   int      // Most edges in a path (0 for no limit)
+	Undirected bool     // Follow edges in either direction
+}
+
+// Only adds a predicate to the allow list.
+func (o *PathOptions) Only(p []byte) *PathOptions {
+	o.Allow = append(o.Allow, p)
+	return o
+}
+
+// Except adds a predicate to the deny list.
+func (o *PathOptions) Except(p []byte) *PathOptions {
+	o.Deny = append(o.Deny, p)
+	return o
+}
+
+// Both makes the search undirected.
+func (o *PathOptions) Both() *PathOptions {
+	o.Undirected = true
+	return o
+}
+
+func (o *PathOptions) allowed(p []byte) bool {
+	for _, q := range o.Deny {
+		if string(p) == string(q) {
+			return false
+		}
+	}
+	if len(o.Allow) == 0 {
+		return true
+	}
+	for _, q := range o.Allow {
+		if string(p) == string(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// Edges and vertexes a search must avoid (for Yen's algorithm).
+type pathBans struct {
+	edges    map[string]bool // By the oriented triple's Key()
+	vertexes map[string]bool
+}
+
+// edges calls f on each edge that leaves v (or arrives at v if 'in'),
+// oriented in the direction of travel.
+func (g *Graph) edges(v []byte, in bool, opts *PathOptions, f func(Triple) bool) error {
+	directions := []bool{in}
+	if opts.Undirected {
+		directions = []bool{false, true}
+	}
+	for _, backward := range directions {
+		on := &Triple{v, nil, nil, nil}
+		if backward {
+			on = &Triple{nil, nil, v, nil}
+		}
+		stopped := false
+		err := g.DoMatching(on, nil, func(t *Triple) bool {
+			if !opts.allowed(t.P) {
+				return true
+			}
+			e := *t
+			if backward != in {
+				// Followed against its direction.
+				e.S, e.O = e.O, e.S
+			}
+			if !f(e) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShortestPath returns a shortest path from one vertex to another.
+// Returns nil if there isn't one (within opts.MaxDepth).  The path from
+// a vertex to itself is empty.
+func (g *Graph) ShortestPath(from Vertex, to Vertex, opts *PathOptions) (Path, error) {
+	if opts == nil {
+		opts = &PathOptions{}
+	}
+	return g.shortestPath(from, to, opts, opts.MaxDepth, nil)
+}
+
+// bfsSide is one side of a bidirectional search.  For the forward
+// side, via[v] is the edge that reached v.  For the backward side,
+// via[v] is the edge that leaves v toward the end.
+type bfsSide struct {
+	in       bool
+	via      map[string]Triple
+	dist     map[string]int
+	frontier [][]byte
+	depth    int
+}
+
+func newBFSSide(v []byte, in bool) *bfsSide {
+	return &bfsSide{in, map[string]Triple{}, map[string]int{string(v): 0}, [][]byte{v}, 0}
+}
+
+func (g *Graph) shortestPath(from Vertex, to Vertex, opts *PathOptions, maxDepth int, bans *pathBans) (Path, error) {
+	if string(from) == string(to) {
+		return Path{}, nil
+	}
+	fwd := newBFSSide(from, false)
+	bwd := newBFSSide(to, true)
+	ctx := g.context()
+
+	for 0 < len(fwd.frontier) && 0 < len(bwd.frontier) {
+		if maxDepth != 0 && maxDepth <= fwd.depth+bwd.depth {
+			return nil, nil
+		}
+		side, other := fwd, bwd
+		if len(bwd.frontier) < len(fwd.frontier) {
+			side, other = bwd, fwd
+		}
+		side.depth++
+
+		// Expand a whole level and keep the best meeting point.
+		best := -1
+		var meet string
+		next := make([][]byte, 0, len(side.frontier))
+		for _, v := range side.frontier {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			err := g.edges(v, side.in, opts, func(e Triple) bool {
+				w := e.O
+				if side.in {
+					w = e.S
+				}
+				if bans != nil && (bans.edges[string(e.Key())] || bans.vertexes[string(w)]) {
+					return true
+				}
+				if _, seen := side.dist[string(w)]; seen {
+					return true
+				}
+				side.dist[string(w)] = side.depth
+				side.via[string(w)] = e
+				next = append(next, w)
+				if d, ok := other.dist[string(w)]; ok && (best < 0 || side.depth+d < best) {
+					best = side.depth + d
+					meet = string(w)
+				}
+				return true
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		side.frontier = next
+
+		if 0 <= best {
+			return joinPath(fwd, bwd, meet, from, to), nil
+		}
+	}
+	return nil, nil
+}
+
+// joinPath follows both sides' edges out from the meeting point.
+func joinPath(fwd *bfsSide, bwd *bfsSide, meet string, from Vertex, to Vertex) Path {
+	acc := Path{}
+	for v := meet; v != string(from); {
+		e := fwd.via[v]
+		acc = append(Path{e}, acc...)
+		v = string(e.S)
+	}
+	for v := meet; v != string(to); {
+		e := bwd.via[v]
+		acc = append(acc, e)
+		v = string(e.O)
+	}
+	return acc
+}
+
+// samePrefix reports whether two paths start with the same n edges.
+func samePrefix(a Path, b Path, n int) bool {
+	if len(a) < n || len(b) < n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if string(a[i].Key()) != string(b[i].Key()) {
+			return false
+		}
+	}
+	return true
+}
+
+// KShortestPaths returns up to k shortest loopless paths from one
+// vertex to another, shortest first.
+func (g *Graph) KShortestPaths(from Vertex, to Vertex, k int, opts *PathOptions) ([]Path, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	if opts == nil {
+		opts = &PathOptions{}
+	}
+	first, err := g.shortestPath(from, to, opts, opts.MaxDepth, nil)
+	if err != nil || first == nil {
+		return nil, err
+	}
+	acc := []Path{first}
+	candidates := make([]Path, 0, k)
+	have := map[string]bool{pathKey(first): true}
+
+	for len(acc) < k {
+		prev := acc[len(acc)-1]
+		for i := range prev {
+			spur := from
+			if 0 < i {
+				spur = Vertex(prev[i-1].O)
+			}
+			root := prev[0:i]
+			bans := &pathBans{map[string]bool{}, map[string]bool{}}
+			for _, p := range acc {
+				if samePrefix(p, prev, i) && i < len(p) {
+					bans.edges[string(p[i].Key())] = true
+				}
+			}
+			// The root's vertexes before the spur.
+			for _, t := range root {
+				bans.vertexes[string(t.S)] = true
+			}
+			depth := 0
+			if opts.MaxDepth != 0 {
+				if depth = opts.MaxDepth - i; depth <= 0 {
+					continue
+				}
+			}
+			rest, err := g.shortestPath(spur, to, opts, depth, bans)
+			if err != nil {
+				return acc, err
+			}
+			if rest == nil {
+				continue
+			}
+			path := append(append(Path{}, root...), rest...)
+			if key := pathKey(path); !have[key] {
+				have[key] = true
+				candidates = append(candidates, path)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return len(candidates[i]) < len(candidates[j]) })
+		acc = append(acc, candidates[0])
+		candidates = candidates[1:]
+	}
+	return acc, nil
+}
+
+// pathKey identifies a path's edges.
+func pathKey(path Path) string {
+	acc := ""
+	for _, t := range path {
+		acc += string(t.Key())
+	}
+	return acc
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Consistent reads.
+
+import (
+	"errors"
+)
+
+var ErrSnapshotWrite = errors.New("Can't write to a graph snapshot")
+
+var ErrSnapshotReleased = errors.New("Graph snapshot was released")
+
+// A graphSnapshot is a store snapshot shared by the views of a graph
+// snapshot (see WithContext), so releasing it through one view
+// releases it for all of them.
+type graphSnapshot struct {
+	snap     Snapshot
+	released bool
+}
+
+// Snapshot returns a read-only view of the graph as it is right now.
+// Everything that reads with default options (Do, Scan, Walk,
+// NewVertexIterator, and so on) reads from that same point in time.
+// Writes return ErrSnapshotWrite.
+//
+// Call Release (or Close) when done.  Don't release a snapshot while
+// a walk on it is still running.  After that, reads find nothing (or
+// return ErrSnapshotReleased), and Close returns ErrSnapshotReleased.
+func (g *Graph) Snapshot() *Graph {
+	snap := g.db.NewSnapshot()
+	view := *g
+	view.snapshot = &graphSnapshot{snap: snap}
+	view.ropts = &ReadOptions{Snapshot: snap}
+	return &view
+}
+
+// live returns a view of the current data.  That's g itself unless g
+// is a snapshot.
+func (g *Graph) live() *Graph {
+	if g.snapshot == nil {
+		return g
+	}
+	view := *g
+	view.snapshot = nil
+	view.ropts = nil
+	return &view
+}
+
+// IsSnapshot reports whether this graph is a snapshot (even one that
+// has been released).
+func (g *Graph) IsSnapshot() bool {
+	return g.snapshot != nil
+}
+
+// Release releases a snapshot.  Does nothing if the graph isn't a
+// snapshot or if it's already released.
+func (g *Graph) Release() {
+	if g.snapshot != nil && !g.snapshot.released {
+		g.snapshot.snap.Release()
+		g.snapshot.released = true
+	}
+}
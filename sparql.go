@@ -0,0 +1,713 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// A parser for a practical subset of SPARQL 1.1 queries:
+//
+//   PREFIX and BASE (which is ignored)
+//   SELECT [DISTINCT] (?vars... | *) and ASK
+//   WHERE { ... } with triple patterns (including ';' and ',' and 'a'),
+//     FILTER, OPTIONAL, UNION, and nested groups
+//   property paths: p1/p2, p1|p2, ^p, p*, p+, p?, and (...)
+//   LIMIT and OFFSET
+//
+// FILTER expressions can use ||, &&, !, =, !=, <, >, <=, >=, and the
+// functions bound, regex, contains, strstarts, strends, str, lcase,
+// ucase, isIRI (isURI), and isLiteral.
+//
+// The loader (see quads.go) keeps an IRI without its brackets and a
+// literal without its quotes, language, or datatype.  Queries do the
+// same: <http://x> and "x"@en are just the strings http://x and x.
+//
+// See sparqleval.go for evaluation.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+
+// A SPARQLQuery is a parsed SELECT or ASK query.
+type SPARQLQuery struct {
+	Ask      bool
+	Distinct bool
+	Vars     []string // What SELECT returns
+	Limit    int64    // Negative for no limit
+	Offset   int64
+	where    *groupPattern
+}
+
+// A groupPattern is the part of a query in braces.  Its filters apply
+// to the whole group.
+type groupPattern struct {
+	elems   []*groupElem
+	filters []*sparqlExpr
+}
+
+// A groupElem is one of a BGP, a triple with a property path, an
+// OPTIONAL group, or the groups of a UNION (just one for a nested
+// group).
+type groupElem struct {
+	bgp      BGP
+	path     *pathTriple
+	optional *groupPattern
+	union    []*groupPattern
+}
+
+type pathTriple struct {
+	s    PatternTerm
+	path *propertyPath
+	o    PatternTerm
+}
+
+// A propertyPath is a predicate ('p'), or an operator ('^', '/', '|',
+// '*', '+', or '?') and its arguments.
+type propertyPath struct {
+	op   byte
+	p    []byte
+	args []*propertyPath
+}
+
+// A sparqlExpr is a FILTER expression: a variable ("var"), a constant
+// ("lit" or "bool"), an operator, or a function call ("call").
+type sparqlExpr struct {
+	op   string
+	name string
+	args []*sparqlExpr
+}
+
+type sparqlToken struct {
+	kind byte // 'i'ri, 'v'ar, 's'tring, 'n'umber, 'w'ord, or 'p'unctuation
+	text string
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || c == ':' || c == '.' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || 0x80 <= c
+}
+
+// sparqlTokens splits a query into tokens.
+func sparqlTokens(s string) ([]sparqlToken, error) {
+	acc := make([]sparqlToken, 0, 32)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '<' && 0 < strings.IndexByte(s[i:], '>') &&
+			!strings.ContainsAny(s[i:i+strings.IndexByte(s[i:], '>')], " \t\n\r"):
+			j := i + strings.IndexByte(s[i:], '>')
+			acc = append(acc, sparqlToken{'i', s[i+1 : j]})
+			i = j + 1
+		case (c == '?' || c == '$') && i+1 < len(s) && isNameByte(s[i+1]) && s[i+1] != ':':
+			j := i + 1
+			for j < len(s) && isNameByte(s[j]) && s[j] != '.' && s[j] != ':' && s[j] != '-' {
+				j++
+			}
+			acc = append(acc, sparqlToken{'v', s[i+1 : j]})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			raw := make([]byte, 0, 16)
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					switch s[j] {
+					case 'n':
+						raw = append(raw, '\n')
+					case 't':
+						raw = append(raw, '\t')
+					case 'r':
+						raw = append(raw, '\r')
+					default:
+						raw = append(raw, s[j])
+					}
+					continue
+				}
+				raw = append(raw, s[j])
+			}
+			if len(s) <= j {
+				return nil, fmt.Errorf("SPARQL: Unterminated string at %d", i)
+			}
+			i = j + 1
+			// Ignore a language or a datatype.
+			if i < len(s) && s[i] == '@' {
+				for i++; i < len(s) && (isNameByte(s[i]) && s[i] != '.'); i++ {
+				}
+			} else if strings.HasPrefix(s[i:], "^^<") {
+				i += strings.IndexByte(s[i:], '>') + 1
+			} else if strings.HasPrefix(s[i:], "^^") {
+				for i += 2; i < len(s) && isNameByte(s[i]); i++ {
+				}
+			}
+			acc = append(acc, sparqlToken{'s', string(raw)})
+		case '0' <= c && c <= '9':
+			j := i
+			for j < len(s) && (('0' <= s[j] && s[j] <= '9') || (s[j] == '.' && j+1 < len(s) && '0' <= s[j+1] && s[j+1] <= '9')) {
+				j++
+			}
+			acc = append(acc, sparqlToken{'n', s[i:j]})
+			i = j
+		case isNameByte(c) && c != '.' && c != '-':
+			j := i
+			for j < len(s) && isNameByte(s[j]) {
+				j++
+			}
+			// A name doesn't end in '.'.
+			for s[j-1] == '.' {
+				j--
+			}
+			acc = append(acc, sparqlToken{'w', s[i:j]})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "&&", "||", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			if !sparqlPunctuation[op] {
+				return nil, fmt.Errorf("SPARQL: Unexpected %q at %d", op, i)
+			}
+			acc = append(acc, sparqlToken{'p', op})
+			i += len(op)
+		}
+	}
+	return acc, nil
+}
+
+var sparqlPunctuation = map[string]bool{
+	"{": true, "}": true, "(": true, ")": true, ".": true, ",": true, ";": true,
+	"*": true, "+": true, "?": true, "/": true, "|": true, "^": true, "!": true,
+	"=": true, "<": true, ">": true, "&&": true, "||": true, "!=": true, "<=": true, ">=": true,
+}
+
+type sparqlParser struct {
+	tokens   []sparqlToken
+	at       int
+	prefixes map[string]string
+	vars     []string // In the order they appear in triples
+	seen     map[string]bool
+}
+
+func (p *sparqlParser) peek() sparqlToken {
+	if p.at < len(p.tokens) {
+		return p.tokens[p.at]
+	}
+	return sparqlToken{}
+}
+
+// next returns the next token and moves past it.  It moves past the
+// end, too, so that p.at-- always backs up to the token next()
+// returned.
+func (p *sparqlParser) next() sparqlToken {
+	t := p.peek()
+	p.at++
+	return t
+}
+
+// is reports whether the next token is the given punctuation or
+// (case-insensitive) keyword.
+func (p *sparqlParser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == 'p' && t.text == s) || (t.kind == 'w' && strings.EqualFold(t.text, s))
+}
+
+func (p *sparqlParser) expect(s string) error {
+	if !p.is(s) {
+		return p.errorf("Expected %q", s)
+	}
+	p.next()
+	return nil
+}
+
+func (p *sparqlParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	where := "at the end"
+	if t.kind != 0 {
+		where = fmt.Sprintf("at %q (token %d)", t.text, p.at)
+	}
+	return fmt.Errorf("SPARQL: "+format+" "+where, args...)
+}
+
+func (p *sparqlParser) addVar(name string) {
+	if !p.seen[name] {
+		p.seen[name] = true
+		p.vars = append(p.vars, name)
+	}
+}
+
+// ParseSPARQL parses a SELECT or ASK query.
+func ParseSPARQL(s string) (*SPARQLQuery, error) {
+	tokens, err := sparqlTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &sparqlParser{tokens: tokens, prefixes: map[string]string{}, vars: []string{}, seen: map[string]bool{}}
+	q := &SPARQLQuery{Limit: -1}
+
+	for {
+		if p.is("PREFIX") {
+			p.next()
+			name := p.next()
+			iri := p.next()
+			if name.kind != 'w' || !strings.HasSuffix(name.text, ":") || iri.kind != 'i' {
+				return nil, p.errorf("Bad PREFIX")
+			}
+			p.prefixes[strings.TrimSuffix(name.text, ":")] = iri.text
+		} else if p.is("BASE") {
+			p.next()
+			if p.next().kind != 'i' {
+				return nil, p.errorf("Bad BASE")
+			}
+		} else {
+			break
+		}
+	}
+
+	switch {
+	case p.is("ASK"):
+		p.next()
+		q.Ask = true
+	case p.is("SELECT"):
+		p.next()
+		if p.is("DISTINCT") {
+			p.next()
+			q.Distinct = true
+		} else if p.is("REDUCED") {
+			p.next()
+		}
+		if p.is("*") {
+			p.next()
+		} else {
+			for p.peek().kind == 'v' {
+				q.Vars = append(q.Vars, p.next().text)
+			}
+			if len(q.Vars) == 0 {
+				return nil, p.errorf("Expected variables or '*'")
+			}
+		}
+	default:
+		return nil, p.errorf("Expected SELECT or ASK")
+	}
+
+	if p.is("WHERE") {
+		p.next()
+	}
+	if q.where, err = p.group(); err != nil {
+		return nil, err
+	}
+	if !q.Ask && q.Vars == nil {
+		q.Vars = p.vars
+	}
+
+	for p.peek().kind != 0 {
+		switch {
+		case p.is("LIMIT"), p.is("OFFSET"):
+			keyword := strings.ToUpper(p.next().text)
+			t := p.next()
+			n, err := strconv.ParseInt(t.text, 10, 64)
+			if t.kind != 'n' || err != nil || n < 0 {
+				return nil, p.errorf("Bad %s", keyword)
+			}
+			if keyword == "LIMIT" {
+				q.Limit = n
+			} else {
+				q.Offset = n
+			}
+		default:
+			return nil, p.errorf("Unsupported")
+		}
+	}
+	return q, nil
+}
+
+// group parses '{ ... }'.
+func (p *sparqlParser) group() (*groupPattern, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	gp := &groupPattern{}
+	var bgp BGP
+	var paths []*groupElem
+	flush := func() {
+		if 0 < len(bgp) {
+			gp.elems = append(gp.elems, &groupElem{bgp: bgp})
+			bgp = nil
+		}
+		gp.elems = append(gp.elems, paths...)
+		paths = nil
+	}
+
+	for !p.is("}") {
+		switch {
+		case p.peek().kind == 0:
+			return nil, p.errorf("Expected '}'")
+		case p.is("."):
+			p.next()
+		case p.is("FILTER"):
+			p.next()
+			e, err := p.constraint()
+			if err != nil {
+				return nil, err
+			}
+			gp.filters = append(gp.filters, e)
+		case p.is("OPTIONAL"):
+			p.next()
+			flush()
+			opt, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			gp.elems = append(gp.elems, &groupElem{optional: opt})
+		case p.is("{"):
+			flush()
+			sub, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			union := []*groupPattern{sub}
+			for p.is("UNION") {
+				p.next()
+				if sub, err = p.group(); err != nil {
+					return nil, err
+				}
+				union = append(union, sub)
+			}
+			gp.elems = append(gp.elems, &groupElem{union: union})
+		default:
+			tps, pts, err := p.triples()
+			if err != nil {
+				return nil, err
+			}
+			bgp = append(bgp, tps...)
+			for _, pt := range pts {
+				paths = append(paths, &groupElem{path: pt})
+			}
+		}
+	}
+	p.next()
+	flush()
+	return gp, nil
+}
+
+// term parses a subject or an object.
+func (p *sparqlParser) term() (PatternTerm, error) {
+	t := p.next()
+	switch t.kind {
+	case 'v':
+		p.addVar(t.text)
+		return PatternTerm{Var: t.text}, nil
+	case 'i', 's', 'n':
+		return PatternTerm{Value: []byte(t.text)}, nil
+	case 'w':
+		if strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false") {
+			return PatternTerm{Value: []byte(strings.ToLower(t.text))}, nil
+		}
+		iri, err := p.expand(t.text)
+		return PatternTerm{Value: []byte(iri)}, err
+	}
+	p.at--
+	return PatternTerm{}, p.errorf("Expected a term")
+}
+
+// expand turns a prefixed name into an IRI.
+func (p *sparqlParser) expand(name string) (string, error) {
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		p.at--
+		return "", p.errorf("Expected a prefixed name")
+	}
+	iri, ok := p.prefixes[name[:i]]
+	if !ok {
+		p.at--
+		return "", p.errorf("Unknown prefix %q", name[:i])
+	}
+	return iri + name[i+1:], nil
+}
+
+// triples parses a subject and its predicate-object list.  Triples
+// with simple predicates are returned as TriplePatterns and the rest as
+// pathTriples.
+func (p *sparqlParser) triples() ([]TriplePattern, []*pathTriple, error) {
+	var tps []TriplePattern
+	var pts []*pathTriple
+	s, err := p.term()
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		var verb PatternTerm
+		var path *propertyPath
+		if p.peek().kind == 'v' {
+			verb = PatternTerm{Var: p.next().text}
+			p.addVar(verb.Var)
+		} else {
+			if path, err = p.pathAlt(); err != nil {
+				return nil, nil, err
+			}
+			if path.op == 'p' {
+				verb = PatternTerm{Value: path.p}
+				path = nil
+			}
+		}
+		for {
+			o, err := p.term()
+			if err != nil {
+				return nil, nil, err
+			}
+			if path == nil {
+				tps = append(tps, TriplePattern{s, verb, o, PatternTerm{}})
+			} else {
+				pts = append(pts, &pathTriple{s, path, o})
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		if !p.is(";") {
+			return tps, pts, nil
+		}
+		for p.is(";") {
+			p.next()
+		}
+		if p.is(".") || p.is("}") {
+			return tps, pts, nil
+		}
+	}
+}
+
+func (p *sparqlParser) pathAlt() (*propertyPath, error) {
+	first, err := p.pathSeq()
+	if err != nil || !p.is("|") {
+		return first, err
+	}
+	acc := &propertyPath{op: '|', args: []*propertyPath{first}}
+	for p.is("|") {
+		p.next()
+		next, err := p.pathSeq()
+		if err != nil {
+			return nil, err
+		}
+		acc.args = append(acc.args, next)
+	}
+	return acc, nil
+}
+
+func (p *sparqlParser) pathSeq() (*propertyPath, error) {
+	first, err := p.pathElt()
+	if err != nil || !p.is("/") {
+		return first, err
+	}
+	acc := &propertyPath{op: '/', args: []*propertyPath{first}}
+	for p.is("/") {
+		p.next()
+		next, err := p.pathElt()
+		if err != nil {
+			return nil, err
+		}
+		acc.args = append(acc.args, next)
+	}
+	return acc, nil
+}
+
+func (p *sparqlParser) pathElt() (*propertyPath, error) {
+	if p.is("^") {
+		p.next()
+		inverse, err := p.pathElt()
+		if err != nil {
+			return nil, err
+		}
+		return &propertyPath{op: '^', args: []*propertyPath{inverse}}, nil
+	}
+
+	var acc *propertyPath
+	t := p.next()
+	switch {
+	case t.kind == 'i':
+		acc = &propertyPath{op: 'p', p: []byte(t.text)}
+	case t.kind == 'w' && t.text == "a":
+		acc = &propertyPath{op: 'p', p: []byte(rdfType)}
+	case t.kind == 'w':
+		iri, err := p.expand(t.text)
+		if err != nil {
+			return nil, err
+		}
+		acc = &propertyPath{op: 'p', p: []byte(iri)}
+	case t.kind == 'p' && t.text == "(":
+		inner, err := p.pathAlt()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(")"); err != nil {
+			return nil, err
+		}
+		acc = inner
+	default:
+		p.at--
+		return nil, p.errorf("Expected a predicate")
+	}
+
+	if p.is("*") || p.is("+") || p.is("?") {
+		acc = &propertyPath{op: p.next().text[0], args: []*propertyPath{acc}}
+	}
+	return acc, nil
+}
+
+// constraint parses what follows FILTER.
+func (p *sparqlParser) constraint() (*sparqlExpr, error) {
+	if p.is("(") {
+		p.next()
+		e, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	if p.peek().kind == 'w' {
+		return p.primary()
+	}
+	return nil, p.errorf("Expected a FILTER expression")
+}
+
+func (p *sparqlParser) orExpr() (*sparqlExpr, error) {
+	acc, err := p.andExpr()
+	for err == nil && p.is("||") {
+		p.next()
+		var right *sparqlExpr
+		right, err = p.andExpr()
+		acc = &sparqlExpr{op: "||", args: []*sparqlExpr{acc, right}}
+	}
+	return acc, err
+}
+
+func (p *sparqlParser) andExpr() (*sparqlExpr, error) {
+	acc, err := p.relational()
+	for err == nil && p.is("&&") {
+		p.next()
+		var right *sparqlExpr
+		right, err = p.relational()
+		acc = &sparqlExpr{op: "&&", args: []*sparqlExpr{acc, right}}
+	}
+	return acc, err
+}
+
+func (p *sparqlParser) relational() (*sparqlExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "!=", "<", ">", "<=", ">="} {
+		if p.is(op) {
+			p.next()
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &sparqlExpr{op: op, args: []*sparqlExpr{left, right}}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *sparqlParser) unary() (*sparqlExpr, error) {
+	if p.is("!") {
+		p.next()
+		e, err := p.unary()
+		return &sparqlExpr{op: "!", args: []*sparqlExpr{e}}, err
+	}
+	return p.primary()
+}
+
+// The FILTER functions and their numbers of arguments.
+var sparqlFunctions = map[string][2]int{
+	"bound":     {1, 1},
+	"regex":     {2, 3},
+	"contains":  {2, 2},
+	"strstarts": {2, 2},
+	"strends":   {2, 2},
+	"str":       {1, 1},
+	"lcase":     {1, 1},
+	"ucase":     {1, 1},
+	"isiri":     {1, 1},
+	"isuri":     {1, 1},
+	"isliteral": {1, 1},
+}
+
+func (p *sparqlParser) primary() (*sparqlExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case 'v':
+		return &sparqlExpr{op: "var", name: t.text}, nil
+	case 's', 'n', 'i':
+		return &sparqlExpr{op: "lit", name: t.text}, nil
+	case 'p':
+		if t.text == "(" {
+			e, err := p.orExpr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	case 'w':
+		name := strings.ToLower(t.text)
+		if name == "true" || name == "false" {
+			return &sparqlExpr{op: "bool", name: name}, nil
+		}
+		arity, ok := sparqlFunctions[name]
+		if !ok {
+			if strings.Contains(t.text, ":") {
+				iri, err := p.expand(t.text)
+				return &sparqlExpr{op: "lit", name: iri}, err
+			}
+			p.at--
+			return nil, p.errorf("Unsupported function")
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		e := &sparqlExpr{op: "call", name: name}
+		for !p.is(")") {
+			if 0 < len(e.args) {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.orExpr()
+			if err != nil {
+				return nil, err
+			}
+			e.args = append(e.args, arg)
+		}
+		p.next()
+		if len(e.args) < arity[0] || arity[1] < len(e.args) {
+			return nil, fmt.Errorf("SPARQL: %s takes %d to %d arguments", t.text, arity[0], arity[1])
+		}
+		if name == "bound" && e.args[0].op != "var" {
+			return nil, fmt.Errorf("SPARQL: bound takes a variable")
+		}
+		return e, nil
+	}
+	p.at--
+	return nil, p.errorf("Expected an expression")
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sparqlGraph(t *testing.T) *Graph {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdfs := "http://www.w3.org/2000/01/rdf-schema#label"
+	for _, ts := range [][3]string{
+		{"http://x/af", rdfs, "Africa"},
+		{"http://x/ke", rdfs, "Kenya"},
+		{"http://x/eg", rdfs, "Egypt"},
+		{"http://x/na", rdfs, "Nairobi"},
+		{"http://x/ke", "http://x/part_holonym", "http://x/af"},
+		{"http://x/eg", "http://x/part_holonym", "http://x/af"},
+		{"http://x/na", "http://x/part_holonym", "http://x/ke"},
+		{"http://x/af", rdfType, "http://x/Continent"},
+		{"http://x/ke", "http://x/population", "47"},
+		{"http://x/eg", "http://x/population", "91"},
+	} {
+		g.WriteIndexedTriple(TripleFromStrings(ts[0], ts[1], ts[2]), nil)
+	}
+	return g
+}
+
+// sparqlRows renders results as sorted "var=value" rows.
+func sparqlRows(t *testing.T, g *Graph, q string) string {
+	result, err := g.SPARQL(q)
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	if result.Boolean != nil {
+		return fmt.Sprint(*result.Boolean)
+	}
+	acc := make([]string, 0, len(result.Results.Bindings))
+	for _, row := range result.Results.Bindings {
+		vs := make([]string, 0, len(row))
+		for _, v := range result.Head.Vars {
+			if term, ok := row[v]; ok {
+				vs = append(vs, v+"="+strings.TrimPrefix(term.Value, "http://x/"))
+			}
+		}
+		acc = append(acc, strings.Join(vs, ","))
+	}
+	sort.Strings(acc)
+	return strings.Join(acc, " ")
+}
+
+func TestSPARQL(t *testing.T) {
+	g := sparqlGraph(t)
+	defer g.Close()
+
+	prefixes := `PREFIX x: <http://x/>
+PREFIX rdfs: <http://www.w3.org/2000/01/rdf-schema#>
+`
+	for _, c := range []struct {
+		q    string
+		want string
+	}{
+		{`SELECT ?name WHERE { ?x rdfs:label "Africa" . ?y x:part_holonym ?x . ?y rdfs:label ?name }`,
+			"name=Egypt name=Kenya"},
+		{`SELECT * { ?y x:part_holonym x:af ; rdfs:label ?name }`,
+			"y=eg,name=Egypt y=ke,name=Kenya"},
+		{`SELECT ?y WHERE { ?y x:part_holonym x:af , x:ke }`, ""},
+		{`SELECT ?y WHERE { ?y x:part_holonym ?z } LIMIT 2 OFFSET 1`, "y=ke y=na"},
+		{`SELECT DISTINCT ?z WHERE { ?y x:part_holonym ?z }`, "z=af z=ke"},
+		{`SELECT ?z WHERE { ?y x:part_holonym ?z }`, "z=af z=af z=ke"},
+		{`SELECT ?x WHERE { ?x a x:Continent }`, "x=af"},
+		{`SELECT ?name WHERE { ?x rdfs:label ?name FILTER regex(?name, "^k", "i") }`, "name=Kenya"},
+		{`SELECT ?name WHERE { ?x rdfs:label ?name . FILTER (contains(?name, "a") && !strstarts(?name, "N")) }`,
+			"name=Africa name=Kenya"},
+		{`SELECT ?x WHERE { ?x x:population ?n FILTER (?n > 50) }`, "x=eg"},
+		{`SELECT ?x WHERE { ?x x:population ?n FILTER (?n < "50") }`, "x=ke"},
+		{`SELECT ?name WHERE { ?x rdfs:label ?name FILTER (?name < "F") }`, "name=Africa name=Egypt"},
+		{`SELECT ?x ?n WHERE { ?x rdfs:label ?name OPTIONAL { ?x x:population ?n } }`,
+			"x=af x=eg,n=91 x=ke,n=47 x=na"},
+		{`SELECT ?x WHERE { ?x rdfs:label ?name OPTIONAL { ?x x:population ?n } FILTER (!bound(?n)) }`,
+			"x=af x=na"},
+		{`SELECT ?x WHERE { { ?x a x:Continent } UNION { ?x x:population "47" } }`, "x=af x=ke"},
+		{`SELECT ?x WHERE { ?x x:part_holonym+ x:af }`, "x=eg x=ke x=na"},
+		{`SELECT ?x WHERE { ?x x:part_holonym* x:af }`, "x=af x=eg x=ke x=na"},
+		{`SELECT ?x WHERE { x:na x:part_holonym+ ?x }`, "x=af x=ke"},
+		{`SELECT ?x WHERE { x:na x:part_holonym? ?x }`, "x=ke x=na"},
+		{`SELECT ?x WHERE { x:af ^x:part_holonym/^x:part_holonym ?x }`, "x=na"},
+		{`SELECT ?x WHERE { x:na x:part_holonym/rdfs:label ?x }`, "x=Kenya"},
+		{`SELECT ?a ?b WHERE { ?a (x:part_holonym|x:population)/x:part_holonym ?b }`, "a=na,b=af"},
+		{`SELECT ?b WHERE { ?a x:part_holonym+ ?b FILTER (?a = x:na) }`, "b=af b=ke"},
+		{`SELECT ?name WHERE { ?x rdfs:label ?name FILTER (isLiteral(?name) && isIRI(?x)) } LIMIT 1`,
+			"name=Africa"},
+		{`ASK { x:na x:part_holonym+ x:af }`, "true"},
+		{`ASK WHERE { x:af x:part_holonym+ x:na }`, "false"},
+	} {
+		if got := sparqlRows(t, g, prefixes+c.q); got != c.want {
+			t.Errorf("%s: expected %q but got %q", c.q, c.want, got)
+		}
+	}
+
+	for _, bad := range []string{
+		``,
+		`SELECT WHERE { ?x ?p ?o }`,
+		`SELECT ?x WHERE { ?x ?p }`,
+		`SELECT ?x WHERE { ?x y:p ?o }`,
+		`SELECT ?x WHERE { ?x <p> ?o } ORDER BY ?x`,
+		`SELECT ?x WHERE { ?x <p> ?o FILTER nosuch(?x) }`,
+		`SELECT ?x WHERE { ?x <p> "o }`,
+	} {
+		if _, err := ParseSPARQL(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	// Errors point at the token that's wrong.
+	for _, c := range [][2]string{
+		{`SELECT ?x { ?x`, `Expected a predicate at the end`},
+		{`SELECT ?x { ?x <p>`, `Expected a term at the end`},
+		{`SELECT ?x { ?x y:p ?o }`, `Unknown prefix "y" at "y:p" (token 4)`},
+	} {
+		if _, err := ParseSPARQL(c[0]); err == nil || !strings.HasSuffix(err.Error(), c[1]) {
+			t.Errorf("Unexpected %v for %q", err, c[0])
+		}
+	}
+}
+
+func TestSPARQLRegexFlags(t *testing.T) {
+	for _, c := range []struct {
+		pattern, flags, s string
+		want              bool
+	}{
+		{"^k", "i", "Kenya", true},
+		{"a.b", "", "a\nb", false},
+		{"a.b", "s", "a\nb", true},
+		{"^b", "m", "a\nb", true},
+		{"^ K e [ ]n", "ix", "ke nya", true},
+		{"a.b", "q", "axb", false},
+		{"a.b", "q", "xa.b", true},
+	} {
+		pattern, ok := sparqlRegexp(c.pattern, c.flags)
+		if !ok || regexp.MustCompile(pattern).MatchString(c.s) != c.want {
+			t.Errorf("Unexpected %q for %q with %q", pattern, c.pattern, c.flags)
+		}
+	}
+	if _, ok := sparqlRegexp("a", "iz"); ok {
+		t.Error("Expected a bad flag")
+	}
+}
+
+func TestSPARQLJSON(t *testing.T) {
+	g := sparqlGraph(t)
+	defer g.Close()
+
+	result, err := g.SPARQL(`SELECT ?x ?name WHERE { ?x <http://www.w3.org/2000/01/rdf-schema#label> ?name } LIMIT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := json.Marshal(result)
+	want := `{"head":{"vars":["x","name"]},"results":{"bindings":[{"name":{"type":"literal","value":"Africa"},"x":{"type":"uri","value":"http://x/af"}}]}}`
+	if string(bs) != want {
+		t.Errorf("Unexpected %s", bs)
+	}
+
+	result, _ = g.SPARQL(`ASK { ?x ?p ?o }`)
+	if bs, _ = json.Marshal(result); string(bs) != `{"head":{},"boolean":true}` {
+		t.Errorf("Unexpected %s", bs)
+	}
+}
@@ -0,0 +1,535 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Evaluating SPARQL queries (see sparql.go).
+//
+// A group's elements are evaluated left to right, one solution at a
+// time.  Each BGP is a nested-loop join (see DoBGP) that starts with
+// the bindings so far.  OPTIONAL keeps a solution that its group
+// doesn't extend.  Each branch of a UNION starts with the bindings so
+// far, too, which is a little different from SPARQL when a branch has
+// a FILTER on a variable bound outside it.  A group's FILTERs are
+// checked on each of its complete solutions.
+//
+// A property path with a bound end is evaluated from that end.  With
+// neither end bound, it's evaluated from every subject in the graph,
+// so 'p*' doesn't produce zero-length paths for vertexes that are only
+// objects.
+//
+// Values don't say whether they're IRIs or literals.  A value that
+// looks like "scheme:..." without spaces is taken to be an IRI, and one
+// that starts with "_:" is a blank node.
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A SPARQLTerm is a value in SPARQL JSON results.
+type SPARQLTerm struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type SPARQLHead struct {
+	Vars []string `json:"vars,omitempty"`
+}
+
+type SPARQLBindings struct {
+	Bindings []map[string]SPARQLTerm `json:"bindings"`
+}
+
+// A SPARQLResult marshals to the SPARQL 1.1 JSON results format.
+type SPARQLResult struct {
+	Head    SPARQLHead      `json:"head"`
+	Results *SPARQLBindings `json:"results,omitempty"`
+	Boolean *bool           `json:"boolean,omitempty"`
+}
+
+var iriPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:[^\s]+$`)
+
+func looksLikeIRI(s string) bool {
+	return iriPattern.MatchString(s) && !strings.HasPrefix(s, "_:")
+}
+
+func sparqlTerm(v []byte) SPARQLTerm {
+	s := string(v)
+	switch {
+	case strings.HasPrefix(s, "_:"):
+		return SPARQLTerm{"bnode", s[2:]}
+	case looksLikeIRI(s):
+		return SPARQLTerm{"uri", s}
+	}
+	return SPARQLTerm{"literal", s}
+}
+
+// A sparqlEval evaluates one query.
+type sparqlEval struct {
+	g       *Graph
+	ordered map[*groupElem]BGP // Join orders, chosen on first use
+	regexps map[string]*regexp.Regexp
+}
+
+// DoSPARQL calls f with each solution of the query, after DISTINCT,
+// OFFSET, and LIMIT.  Stops if f returns false.  The bindings only have
+// the query's variables.
+func (g *Graph) DoSPARQL(q *SPARQLQuery, f func(Bindings) bool) error {
+	ev := &sparqlEval{g, map[*groupElem]BGP{}, map[string]*regexp.Regexp{}}
+	seen := map[string]bool{}
+	skipped := int64(0)
+	n := int64(0)
+	if q.Limit == 0 {
+		return nil
+	}
+	_, err := ev.group(q.where, Bindings{}, func(bs Bindings) bool {
+		acc := Bindings{}
+		key := ""
+		for _, v := range q.Vars {
+			if value, ok := bs[v]; ok {
+				acc[v] = value
+				key += strconv.Quote(string(value))
+			}
+			key += ","
+		}
+		if q.Distinct {
+			if seen[key] {
+				return true
+			}
+			seen[key] = true
+		}
+		if skipped < q.Offset {
+			skipped++
+			return true
+		}
+		n++
+		return f(acc) && (q.Limit < 0 || n < q.Limit)
+	})
+	return err
+}
+
+// SPARQL parses and evaluates a query.
+func (g *Graph) SPARQL(query string) (*SPARQLResult, error) {
+	q, err := ParseSPARQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return g.SPARQLResults(q)
+}
+
+// SPARQLResults evaluates a parsed query.
+func (g *Graph) SPARQLResults(q *SPARQLQuery) (*SPARQLResult, error) {
+	if q.Ask {
+		found := false
+		err := g.DoSPARQL(q, func(bs Bindings) bool {
+			found = true
+			return false
+		})
+		return &SPARQLResult{Boolean: &found}, err
+	}
+	acc := &SPARQLResult{SPARQLHead{q.Vars}, &SPARQLBindings{make([]map[string]SPARQLTerm, 0)}, nil}
+	err := g.DoSPARQL(q, func(bs Bindings) bool {
+		row := make(map[string]SPARQLTerm, len(bs))
+		for k, v := range bs {
+			row[k] = sparqlTerm(v)
+		}
+		acc.Results.Bindings = append(acc.Results.Bindings, row)
+		return true
+	})
+	return acc, err
+}
+
+// group evaluates a group.  Returns false when it's time to stop.
+func (ev *sparqlEval) group(gp *groupPattern, bs Bindings, f func(Bindings) bool) (bool, error) {
+	return ev.elems(gp, 0, bs, f)
+}
+
+func (ev *sparqlEval) elems(gp *groupPattern, i int, bs Bindings, f func(Bindings) bool) (bool, error) {
+	if i == len(gp.elems) {
+		for _, e := range gp.filters {
+			if !ev.truth(ev.eval(e, bs)) {
+				return true, nil
+			}
+		}
+		return f(bs), nil
+	}
+	if err := ev.g.context().Err(); err != nil {
+		return false, err
+	}
+
+	var failed error
+	next := func(bs Bindings) bool {
+		more, err := ev.elems(gp, i+1, bs, f)
+		if err != nil {
+			failed = err
+		}
+		return more && err == nil
+	}
+	more := true
+	var err error
+	switch e := gp.elems[i]; {
+	case e.bgp != nil:
+		b, ok := ev.ordered[e]
+		if !ok {
+			b = ev.g.order(e.bgp, bs)
+			ev.ordered[e] = b
+		}
+		more, err = ev.g.join(b, bs.copy(), next)
+	case e.path != nil:
+		more, err = ev.pathTriple(e.path, bs, next)
+	case e.optional != nil:
+		found := false
+		more, err = ev.group(e.optional, bs, func(extended Bindings) bool {
+			found = true
+			return next(extended)
+		})
+		if err == nil && failed == nil && more && !found {
+			more = next(bs)
+		}
+	default:
+		for _, branch := range e.union {
+			if more, err = ev.group(branch, bs, next); !more || err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = failed
+	}
+	return more && err == nil, err
+}
+
+// pathTriple evaluates a triple with a property path.
+func (ev *sparqlEval) pathTriple(pt *pathTriple, bs Bindings, f func(Bindings) bool) (bool, error) {
+	s, o := pt.s.value(bs), pt.o.value(bs)
+	emit := func(start []byte, end []byte) bool {
+		acc := bs.copy()
+		for _, side := range []struct {
+			term  PatternTerm
+			value []byte
+		}{{pt.s, start}, {pt.o, end}} {
+			if side.term.Var == "" {
+				continue
+			}
+			if have, ok := acc[side.term.Var]; ok && string(have) != string(side.value) {
+				return true
+			}
+			acc[side.term.Var] = side.value
+		}
+		return f(acc)
+	}
+
+	switch {
+	case s != nil:
+		return ev.path(pt.path, s, false, func(end []byte) bool {
+			if o != nil && string(o) != string(end) {
+				return true
+			}
+			return emit(s, end)
+		})
+	case o != nil:
+		return ev.path(pt.path, o, true, func(start []byte) bool {
+			return emit(start, o)
+		})
+	}
+
+	// Neither end is bound, so start at every subject (in SPO order).
+	var last []byte
+	i := ev.g.NewIndexIterator(SPO, nil, nil)
+	defer i.Release()
+	for i.Next() {
+		t, err := i.Triple()
+		if err != nil {
+			return false, err
+		}
+		if last != nil && string(last) == string(t.S) {
+			continue
+		}
+		last = t.S
+		more, err := ev.path(pt.path, t.S, false, func(end []byte) bool {
+			return emit(t.S, end)
+		})
+		if !more || err != nil {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// path calls f with each vertex the path reaches from v (or, if
+// 'backward', each vertex from which the path reaches v).
+func (ev *sparqlEval) path(pp *propertyPath, v []byte, backward bool, f func([]byte) bool) (bool, error) {
+	switch pp.op {
+	case 'p':
+		on := &Triple{v, pp.p, nil, nil}
+		if backward {
+			on = &Triple{nil, pp.p, v, nil}
+		}
+		more := true
+		err := ev.g.DoMatching(on, nil, func(t *Triple) bool {
+			if backward {
+				more = f(t.S)
+			} else {
+				more = f(t.O)
+			}
+			return more
+		})
+		return more && err == nil, err
+	case '^':
+		return ev.path(pp.args[0], v, !backward, f)
+	case '|':
+		for _, arg := range pp.args {
+			if more, err := ev.path(arg, v, backward, f); !more || err != nil {
+				return more, err
+			}
+		}
+		return true, nil
+	case '/':
+		args := pp.args
+		if backward {
+			args = make([]*propertyPath, len(pp.args))
+			for i, arg := range pp.args {
+				args[len(args)-1-i] = arg
+			}
+		}
+		return ev.sequence(args, v, backward, f)
+	}
+
+	// '*', '+', and '?': breadth-first without repeats.
+	seen := map[string]bool{}
+	frontier := [][]byte{v}
+	if pp.op != '+' {
+		seen[string(v)] = true
+		if !f(v) {
+			return false, nil
+		}
+	}
+	for depth := 0; 0 < len(frontier); depth++ {
+		if pp.op == '?' && 0 < depth {
+			break
+		}
+		if err := ev.g.context().Err(); err != nil {
+			return false, err
+		}
+		next := make([][]byte, 0, len(frontier))
+		for _, u := range frontier {
+			more, err := ev.path(pp.args[0], u, backward, func(w []byte) bool {
+				if seen[string(w)] {
+					return true
+				}
+				seen[string(w)] = true
+				next = append(next, w)
+				return f(w)
+			})
+			if !more || err != nil {
+				return more, err
+			}
+		}
+		frontier = next
+	}
+	return true, nil
+}
+
+func (ev *sparqlEval) sequence(args []*propertyPath, v []byte, backward bool, f func([]byte) bool) (bool, error) {
+	if len(args) == 0 {
+		return f(v), nil
+	}
+	var failed error
+	more, err := ev.path(args[0], v, backward, func(w []byte) bool {
+		more, err := ev.sequence(args[1:], w, backward, f)
+		if err != nil {
+			failed = err
+		}
+		return more && err == nil
+	})
+	if err == nil {
+		err = failed
+	}
+	return more && err == nil, err
+}
+
+// eval returns an expression's value: a string, a bool, or nil for an
+// error (such as an unbound variable).
+func (ev *sparqlEval) eval(e *sparqlExpr, bs Bindings) interface{} {
+	switch e.op {
+	case "var":
+		if v, ok := bs[e.name]; ok {
+			return string(v)
+		}
+		return nil
+	case "lit":
+		return e.name
+	case "bool":
+		return e.name == "true"
+	case "!":
+		if x := ev.eval(e.args[0], bs); x != nil {
+			return !ev.truth(x)
+		}
+		return nil
+	case "||":
+		return ev.truth(ev.eval(e.args[0], bs)) || ev.truth(ev.eval(e.args[1], bs))
+	case "&&":
+		return ev.truth(ev.eval(e.args[0], bs)) && ev.truth(ev.eval(e.args[1], bs))
+	case "call":
+		return ev.call(e, bs)
+	}
+
+	// Comparisons.
+	x, y := ev.eval(e.args[0], bs), ev.eval(e.args[1], bs)
+	if x == nil || y == nil {
+		return nil
+	}
+	c := 0
+	xs, xok := x.(string)
+	ys, yok := y.(string)
+	switch {
+	case xok && yok:
+		c = compareValues(xs, ys)
+	case !xok && !yok:
+		if x.(bool) != y.(bool) {
+			c = 1
+			if y.(bool) {
+				c = -1
+			}
+		}
+	default:
+		return nil
+	}
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case ">":
+		return 0 < c
+	case "<=":
+		return c <= 0
+	}
+	return 0 <= c
+}
+
+// truth is an expression value's "effective boolean value".
+func (ev *sparqlEval) truth(x interface{}) bool {
+	switch x := x.(type) {
+	case bool:
+		return x
+	case string:
+		return x != ""
+	}
+	return false
+}
+
+func (ev *sparqlEval) call(e *sparqlExpr, bs Bindings) interface{} {
+	if e.name == "bound" {
+		_, ok := bs[e.args[0].name]
+		return ok
+	}
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		s, ok := ev.eval(arg, bs).(string)
+		if !ok {
+			return nil
+		}
+		args[i] = s
+	}
+	switch e.name {
+	case "regex":
+		flags := ""
+		if len(args) == 3 {
+			flags = args[2]
+		}
+		pattern, ok := sparqlRegexp(args[1], flags)
+		if !ok {
+			return nil
+		}
+		re, ok := ev.regexps[pattern]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil
+			}
+			ev.regexps[pattern] = re
+		}
+		return re.MatchString(args[0])
+	case "contains":
+		return strings.Contains(args[0], args[1])
+	case "strstarts":
+		return strings.HasPrefix(args[0], args[1])
+	case "strends":
+		return strings.HasSuffix(args[0], args[1])
+	case "lcase":
+		return strings.ToLower(args[0])
+	case "ucase":
+		return strings.ToUpper(args[0])
+	case "isiri", "isuri":
+		return looksLikeIRI(args[0])
+	case "isliteral":
+		return !looksLikeIRI(args[0]) && !strings.HasPrefix(args[0], "_:")
+	}
+	// str
+	return args[0]
+}
+
+// sparqlRegexp translates a regex() pattern with flags (which are
+// XPath's: i, m, s, x, and q) to Go's syntax.  Returns false if there's
+// a flag it doesn't know.
+func sparqlRegexp(pattern string, flags string) (string, bool) {
+	goFlags := ""
+	quote, extended := false, false
+	for _, flag := range flags {
+		switch flag {
+		case 'i', 'm', 's':
+			goFlags += string(flag)
+		case 'x':
+			extended = true
+		case 'q':
+			quote = true
+		default:
+			return "", false
+		}
+	}
+	switch {
+	case quote:
+		pattern = regexp.QuoteMeta(pattern)
+	case extended:
+		// Drop whitespace outside of character classes.
+		acc := make([]byte, 0, len(pattern))
+		class, escaped := false, false
+		for i := 0; i < len(pattern); i++ {
+			c := pattern[i]
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '[':
+				class = true
+			case c == ']':
+				class = false
+			case !class && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+				continue
+			}
+			acc = append(acc, c)
+		}
+		pattern = string(acc)
+	}
+	if goFlags != "" {
+		pattern = "(?" + goFlags + ")" + pattern
+	}
+	return pattern, true
+}
@@ -0,0 +1,742 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Cardinality statistics and estimates.
+//
+// When a graph keeps stats, it maintains exact counts in their own
+// key range: the number of triples, the number of triples for each
+// predicate, the out- and in-degree of each vertex, and histograms of
+// those degrees (number of vertices with degree 1, 2-3, 4-7, ...).
+// Counts are of quads, so a triple in two named graphs counts twice.
+// Counts are keyed by terms rather than dictionary IDs.
+//
+// Everything that the changelog would log is counted in the same
+// batch as its index changes.  Our RocksDB binding doesn't have merge
+// operators, so a write doesn't update the counts.  It adds a delta
+// with the amounts to add to them instead.  Writes only wait for each
+// other when they change triples in the same stripe, which keeps two
+// writes of one triple from both counting it.  After every
+// statsFoldEvery deltas, a fold adds the deltas to the counts (and
+// the degree histograms) and deletes them.  Reads add the pending
+// deltas to the counts they read from the same snapshot.
+//
+// WriteTriple, WriteBatch, Reindex, DropIndex, and Repair don't add
+// or remove (decodable) SPO entries, so they don't change the counts.
+// IndexTriple to SPO and BulkLoad do, so they mark the stats stale.
+// Stale stats return ErrStaleStats until RebuildStats.
+//
+// EstimateCount doesn't need stats.  It counts keys in an index range
+// until it has seen a sample, and then it scales the store's
+// approximate size of the range (see Sizer) by the sample's average
+// key size.  With current stats, patterns that bind nothing or just a
+// predicate, subject, or object get exact counts.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/bits"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	statsPrefix      = byte(0x30) // kind, term -> count
+	statsDeltaPrefix = byte(0x31) // delta number -> counts to add
+)
+
+// Kinds of counts.
+const (
+	statsTriples    = byte('t')
+	statsPredicate  = byte('p')
+	statsOutDegree  = byte('o') // Per vertex
+	statsInDegree   = byte('i') // Per vertex
+	statsOutBuckets = byte('O') // Degree bucket -> number of vertices
+	statsInBuckets  = byte('I')
+)
+
+// Number of keys EstimateCount counts before estimating.
+const estimateSampleSize = 1000
+
+// Number of deltas written between folds.
+const statsFoldEvery = 256
+
+// Number of stripes that writes lock.
+const statsStripes = 64
+
+// Its presence means the database keeps stats.
+var statsEnabledKey = []byte("\xff\xfftinygraph.stats")
+
+// Its presence means the stats are stale.
+var statsStaleKey = []byte("\xff\xfftinygraph.stats.stale")
+
+var ErrNoStats = errors.New("Graph doesn't keep stats")
+
+var ErrStaleStats = errors.New("Graph's stats are stale (see RebuildStats)")
+
+// TripleStats are the counts a graph keeps.  Degree histograms map
+// the smallest degree in each bucket to the number of vertices in the
+// bucket.
+type TripleStats struct {
+	Triples    int64            `json:"triples"`
+	Predicates map[string]int64 `json:"predicates"`
+	OutDegrees map[int64]int64  `json:"outDegrees"`
+	InDegrees  map[int64]int64  `json:"inDegrees"`
+}
+
+type stats struct {
+	next    uint64     // Number of the last delta (atomic).
+	pending int64      // Deltas written since the last fold (atomic).
+	fold    sync.Mutex // Held while folding.
+	// Held while counting and writing changes to the triples in
+	// each stripe.
+	stripes [statsStripes]sync.Mutex
+}
+
+// lock locks the stripes of the changes' triples (in order).  Returns
+// the function that unlocks them.
+func (s *stats) lock(changes []Change) func() {
+	var held [statsStripes]bool
+	for i := range changes {
+		t := &changes[i].Triple
+		h := fnv.New32a()
+		for _, part := range [][]byte{t.S, t.P, t.O, t.V} {
+			h.Write(part)
+			h.Write([]byte{0})
+		}
+		held[h.Sum32()%statsStripes] = true
+	}
+	for i := range held {
+		if held[i] {
+			s.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range held {
+			if held[i] {
+				s.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+func statsKey(kind byte, term []byte) []byte {
+	bs := make([]byte, 0, len(term)+2)
+	bs = append(bs, statsPrefix, kind)
+	return append(bs, term...)
+}
+
+func statsDeltaKey(n uint64) []byte {
+	bs := make([]byte, 9)
+	bs[0] = statsDeltaPrefix
+	binary.BigEndian.PutUint64(bs[1:], n)
+	return bs
+}
+
+// knownStatsKey reports whether the key is exactly the form of one of
+// statsKey's or statsDeltaKey's keys.
+func knownStatsKey(k []byte) bool {
+	if len(k) == 9 && k[0] == statsDeltaPrefix {
+		return true
+	}
+	if len(k) < 2 || k[0] != statsPrefix {
+		return false
+	}
+	switch k[1] {
+	case statsTriples:
+		return len(k) == 2
+	case statsOutBuckets, statsInBuckets:
+		return len(k) == 10
+	case statsPredicate, statsOutDegree, statsInDegree:
+		return 2 < len(k)
+	}
+	return false
+}
+
+// encodeDeltas encodes the amounts to add to the counts with the
+// given keys.  Zeros are left out.
+func encodeDeltas(deltas map[string]int64) []byte {
+	var acc []byte
+	var n [binary.MaxVarintLen64]byte
+	for k, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		acc = append(acc, n[:binary.PutUvarint(n[:], uint64(len(k)))]...)
+		acc = append(acc, k...)
+		acc = append(acc, n[:binary.PutVarint(n[:], delta)]...)
+	}
+	return acc
+}
+
+// decodeDeltas adds the encoded deltas to 'acc'.
+func decodeDeltas(bs []byte, acc map[string]int64) error {
+	for more := bs; 0 < len(more); {
+		n, i := binary.Uvarint(more)
+		if i <= 0 || uint64(len(more)-i) < n {
+			return fmt.Errorf("Bad stats delta %q", bs)
+		}
+		k := string(more[i : i+int(n)])
+		more = more[i+int(n):]
+		delta, j := binary.Varint(more)
+		if j <= 0 {
+			return fmt.Errorf("Bad stats delta %q", bs)
+		}
+		more = more[j:]
+		acc[k] += delta
+	}
+	return nil
+}
+
+// degreeBucket returns the smallest degree in d's bucket.
+func degreeBucket(d int64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, 1<<uint(bits.Len64(uint64(d))-1))
+	return bs
+}
+
+// EnableStats starts keeping stats.  If the database doesn't have
+// them yet, they are computed from what's there (see RebuildStats).
+func (g *Graph) EnableStats() error {
+	if g.stats != nil {
+		return nil
+	}
+	bs, err := g.db.Get(g.ropts, statsEnabledKey)
+	if err != nil {
+		return err
+	}
+	s := &stats{}
+	if bs == nil {
+		if g.snapshot != nil {
+			return ErrSnapshotWrite
+		}
+		g.stats = s
+		if err = g.rebuildStats(); err != nil {
+			g.stats = nil
+			return err
+		}
+		return nil
+	}
+	// Pick up numbering after the pending deltas.
+	err = g.scanDeltas(g.ropts, func(k []byte, v []byte) error {
+		s.next = binary.BigEndian.Uint64(k[1:])
+		s.pending++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	g.stats = s
+	return nil
+}
+
+// openStats enables stats if the database has them.
+func (g *Graph) openStats() error {
+	bs, err := g.db.Get(g.ropts, statsEnabledKey)
+	if err != nil || bs == nil {
+		return err
+	}
+	return g.EnableStats()
+}
+
+// HasStats reports whether this graph keeps stats.
+func (g *Graph) HasStats() bool {
+	return g.stats != nil
+}
+
+// StatsCurrent reports whether this graph keeps stats and they aren't
+// stale.
+func (g *Graph) StatsCurrent() bool {
+	if g.stats == nil {
+		return false
+	}
+	bs, err := g.db.Get(g.ropts, statsStaleKey)
+	return err == nil && bs == nil
+}
+
+// staleStats marks the stats stale.  Does nothing if the graph
+// doesn't keep stats.
+func (g *Graph) staleStats() error {
+	if g.stats == nil {
+		return nil
+	}
+	return g.db.Put(g.wopts, statsStaleKey, []byte("1"))
+}
+
+// RebuildStats recomputes the stats from the SPO index, and then
+// they're current.  Writes wait until it's done.  The per-vertex
+// counts are collected in memory.
+func (g *Graph) RebuildStats() error {
+	if g.snapshot != nil {
+		return ErrSnapshotWrite
+	}
+	if g.stats == nil {
+		return ErrNoStats
+	}
+	return g.rebuildStats()
+}
+
+// rebuildStats holds the graph's write lock, which keeps other writes
+// (and so deltas) out.
+func (g *Graph) rebuildStats() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.stats.fold.Lock()
+	defer g.stats.fold.Unlock()
+
+	from, to := []byte{statsPrefix}, []byte{statsDeltaPrefix + 1}
+	if err := deleteRange(g.db, g.wopts, from, to); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&g.stats.pending, 0)
+
+	counts := make(map[string]int64)
+	outs := make(map[string]int64)
+	ins := make(map[string]int64)
+	i := g.NewIndexIterator(SPO, nil, nil)
+	for i.Next() {
+		t, err := i.Triple()
+		if err != nil {
+			log.Printf("RebuildStats skipping bad key: %v", err)
+			continue
+		}
+		counts[string(statsKey(statsTriples, nil))]++
+		counts[string(statsKey(statsPredicate, t.P))]++
+		outs[string(t.S)]++
+		ins[string(t.O)]++
+	}
+	i.Release()
+	for _, degrees := range []struct {
+		kind, buckets byte
+		m             map[string]int64
+	}{{statsOutDegree, statsOutBuckets, outs}, {statsInDegree, statsInBuckets, ins}} {
+		for v, d := range degrees.m {
+			counts[string(statsKey(degrees.kind, []byte(v)))] = d
+			counts[string(statsKey(degrees.buckets, degreeBucket(d)))]++
+		}
+	}
+
+	batch := g.db.NewBatch()
+	pending := 0
+	for k, n := range counts {
+		batch.Put([]byte(k), []byte(strconv.FormatInt(n, 10)))
+		pending++
+		if pending == restoreBatchSize {
+			if err := g.db.Write(g.wopts, batch); err != nil {
+				return err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+	batch.Put(statsEnabledKey, []byte("1"))
+	batch.Delete(statsStaleKey)
+	if err := g.db.Write(g.wopts, batch); err != nil {
+		return err
+	}
+	log.Printf("RebuildStats counted %d triples", counts[string(statsKey(statsTriples, nil))])
+	return nil
+}
+
+// countChanges adds a delta with what the changes add to the counts
+// to the batch.  Returns false if they don't change any counts.  Call
+// with the changes' stripes locked (see stats.lock) until the batch is
+// written, so the check for whether a triple is already there holds.
+func (g *Graph) countChanges(batch Batch, changes []Change) (bool, error) {
+	deltas := make(map[string]int64)
+	exists := make(map[string]bool)
+	for _, c := range changes {
+		q, known, err := g.encodePattern(&c.Triple)
+		if err != nil {
+			return false, err
+		}
+		if !known {
+			continue
+		}
+		k := string(q.IndexKey(SPO))
+		had, seen := exists[k]
+		if !seen {
+			bs, err := g.db.Get(g.ropts, []byte(k))
+			if err != nil {
+				return false, err
+			}
+			had = bs != nil
+		}
+		exists[k] = !c.Delete
+		if had != c.Delete {
+			continue
+		}
+		delta := int64(1)
+		if c.Delete {
+			delta = -1
+		}
+		deltas[string(statsKey(statsTriples, nil))] += delta
+		deltas[string(statsKey(statsPredicate, c.Triple.P))] += delta
+		deltas[string(statsKey(statsOutDegree, c.Triple.S))] += delta
+		deltas[string(statsKey(statsInDegree, c.Triple.O))] += delta
+	}
+	bs := encodeDeltas(deltas)
+	if len(bs) == 0 {
+		return false, nil
+	}
+	batch.Put(statsDeltaKey(atomic.AddUint64(&g.stats.next, 1)), bs)
+	return true, nil
+}
+
+// countAndCommit writes the batch along with a delta for the changes
+// and then folds if it's time.
+func (g *Graph) countAndCommit(opts *WriteOptions, batch Batch, changes []Change) error {
+	unlock := g.stats.lock(changes)
+	counted, err := g.countChanges(batch, changes)
+	if err == nil {
+		err = g.commit(opts, batch, changes)
+	}
+	unlock()
+	if err != nil || !counted {
+		return err
+	}
+	if atomic.AddInt64(&g.stats.pending, 1) < statsFoldEvery {
+		return nil
+	}
+	return g.foldStats()
+}
+
+// scanDeltas calls the function with each pending delta's key and
+// value.
+func (g *Graph) scanDeltas(ro *ReadOptions, f func(k []byte, v []byte) error) error {
+	i := g.db.NewIterator(ro)
+	defer i.Close()
+	for i.Seek([]byte{statsDeltaPrefix}); i.Valid(); i.Next() {
+		k := i.Key()
+		if len(k) == 0 || k[0] != statsDeltaPrefix {
+			break
+		}
+		if err := f(k, i.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingDeltas returns the sums of the pending deltas.
+func (g *Graph) pendingDeltas(ro *ReadOptions) (map[string]int64, error) {
+	acc := make(map[string]int64)
+	err := g.scanDeltas(ro, func(k []byte, v []byte) error {
+		return decodeDeltas(v, acc)
+	})
+	return acc, err
+}
+
+// addDeltas returns the counts that change when the deltas are added
+// to the counts read with 'ro', including degree histogram buckets.
+func (g *Graph) addDeltas(ro *ReadOptions, deltas map[string]int64) (map[string]int64, error) {
+	acc := make(map[string]int64)
+	add := func(k string, delta int64) (int64, int64, error) {
+		n, have := acc[k]
+		if !have {
+			var err error
+			if n, err = g.readCount(ro, []byte(k)); err != nil {
+				return 0, 0, err
+			}
+		}
+		acc[k] = n + delta
+		return n, n + delta, nil
+	}
+	for k, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		was, is, err := add(k, delta)
+		if err != nil {
+			return nil, err
+		}
+		var buckets byte
+		switch k[1] {
+		case statsOutDegree:
+			buckets = statsOutBuckets
+		case statsInDegree:
+			buckets = statsInBuckets
+		default:
+			continue
+		}
+		if 0 < was {
+			if _, _, err = add(string(statsKey(buckets, degreeBucket(was))), -1); err != nil {
+				return nil, err
+			}
+		}
+		if 0 < is {
+			if _, _, err = add(string(statsKey(buckets, degreeBucket(is))), 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return acc, nil
+}
+
+// foldStats adds the pending deltas to the counts and deletes them in
+// one batch.  Other than RebuildStats, it's the only writer of counts,
+// and only one fold runs at a time.
+func (g *Graph) foldStats() error {
+	g.stats.fold.Lock()
+	defer g.stats.fold.Unlock()
+	atomic.StoreInt64(&g.stats.pending, 0)
+
+	batch := g.db.NewBatch()
+	deltas := make(map[string]int64)
+	err := g.scanDeltas(nil, func(k []byte, v []byte) error {
+		batch.Delete(append([]byte{}, k...))
+		return decodeDeltas(v, deltas)
+	})
+	if err != nil {
+		return err
+	}
+	counts, err := g.addDeltas(nil, deltas)
+	if err != nil {
+		return err
+	}
+	for k, n := range counts {
+		if n == 0 {
+			batch.Delete([]byte(k))
+		} else {
+			batch.Put([]byte(k), []byte(strconv.FormatInt(n, 10)))
+		}
+	}
+	return g.db.Write(g.wopts, batch)
+}
+
+func (g *Graph) readCount(ro *ReadOptions, k []byte) (int64, error) {
+	bs, err := g.db.Get(ro, k)
+	if err != nil || bs == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(bs), 10, 64)
+}
+
+// statsReads returns read options that see the counts and the pending
+// deltas at one point in time, and a function to call when done with
+// them.  Returns ErrStaleStats if the stats are stale.
+func (g *Graph) statsReads() (*ReadOptions, func(), error) {
+	if g.stats == nil {
+		return nil, nil, ErrNoStats
+	}
+	ro, done := g.ropts, func() {}
+	if g.snapshot == nil {
+		snap := g.db.NewSnapshot()
+		ro, done = &ReadOptions{Snapshot: snap}, snap.Release
+	}
+	bs, err := g.db.Get(ro, statsStaleKey)
+	if err == nil && bs != nil {
+		err = ErrStaleStats
+	}
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return ro, done, nil
+}
+
+func (g *Graph) statsCount(kind byte, term []byte) (int64, error) {
+	ro, done, err := g.statsReads()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	k := statsKey(kind, term)
+	n, err := g.readCount(ro, k)
+	if err != nil {
+		return 0, err
+	}
+	deltas, err := g.pendingDeltas(ro)
+	return n + deltas[string(k)], err
+}
+
+// TripleCount returns the number of triples in the graph.
+func (g *Graph) TripleCount() (int64, error) {
+	return g.statsCount(statsTriples, nil)
+}
+
+// PredicateCount returns the number of triples with the given
+// predicate.
+func (g *Graph) PredicateCount(p []byte) (int64, error) {
+	return g.statsCount(statsPredicate, p)
+}
+
+// OutDegree returns the number of triples with the given subject.
+func (g *Graph) OutDegree(v []byte) (int64, error) {
+	return g.statsCount(statsOutDegree, v)
+}
+
+// InDegree returns the number of triples with the given object.
+func (g *Graph) InDegree(v []byte) (int64, error) {
+	return g.statsCount(statsInDegree, v)
+}
+
+// TripleStats returns the total, per-predicate counts, and degree
+// histograms.
+func (g *Graph) TripleStats() (*TripleStats, error) {
+	ro, done, err := g.statsReads()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	deltas, err := g.pendingDeltas(ro)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := g.addDeltas(ro, deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := &TripleStats{
+		Predicates: make(map[string]int64),
+		OutDegrees: make(map[int64]int64),
+		InDegrees:  make(map[int64]int64),
+	}
+	set := func(k []byte, n int64) {
+		switch k[1] {
+		case statsTriples:
+			acc.Triples = n
+		case statsPredicate:
+			acc.Predicates[string(k[2:])] = n
+		case statsOutBuckets:
+			acc.OutDegrees[int64(binary.BigEndian.Uint64(k[2:]))] = n
+		case statsInBuckets:
+			acc.InDegrees[int64(binary.BigEndian.Uint64(k[2:]))] = n
+		}
+	}
+	for _, kind := range []byte{statsTriples, statsPredicate, statsOutBuckets, statsInBuckets} {
+		prefix := statsKey(kind, nil)
+		i := g.db.NewIterator(ro)
+		for i.Seek(prefix); i.Valid(); i.Next() {
+			k := i.Key()
+			if !bytes.HasPrefix(k, prefix) {
+				break
+			}
+			n, err := strconv.ParseInt(string(i.Value()), 10, 64)
+			if err != nil {
+				i.Close()
+				return nil, fmt.Errorf("Bad count %q for %q", i.Value(), k)
+			}
+			set(k, n)
+		}
+		i.Close()
+	}
+	for k, n := range changed {
+		set([]byte(k), n)
+	}
+	for p, n := range acc.Predicates {
+		if n == 0 {
+			delete(acc.Predicates, p)
+		}
+	}
+	for _, m := range []map[int64]int64{acc.OutDegrees, acc.InDegrees} {
+		for k, n := range m {
+			if n == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	return acc, nil
+}
+
+// exactCount returns the number of keys in the index range for the
+// pattern if the stats have it.  The stats count triples, so they
+// only say anything about indexes the graph maintains: an index that
+// was dropped (or is only partly written by a Reindex) has fewer keys.
+func (g *Graph) exactCount(index Index, on *Triple) (int64, bool, error) {
+	if g.stats == nil || !g.HasIndex(index) {
+		return 0, false, nil
+	}
+	n := on.boundIn(index)
+	t := on.Copy().Unpermute(index)
+	var count int64
+	var err error
+	switch {
+	case n == 0:
+		count, err = g.TripleCount()
+	case n != 1 || index.IsGraphIndex():
+		return 0, false, nil
+	case index == PSO || index == POS:
+		count, err = g.PredicateCount(t.P)
+	case index == SPO || index == SOP:
+		count, err = g.OutDegree(t.S)
+	default:
+		count, err = g.InDegree(t.O)
+	}
+	if err == ErrStaleStats {
+		return 0, false, nil
+	}
+	return count, true, err
+}
+
+// EstimateCount estimates the number of keys that scanning the index
+// with the given pattern (in the index's order, as for
+// NewIndexIterator) would visit.  Small ranges are counted exactly.
+func (g *Graph) EstimateCount(index Index, on *Triple) (int64, error) {
+	if on == nil {
+		on = &Triple{}
+	}
+	if n, ok, err := g.exactCount(index, on); ok || err != nil {
+		return n, err
+	}
+
+	q, known, err := g.encodePattern(on)
+	if err != nil || !known {
+		return 0, err
+	}
+	from := withIndex(index, q.keyPrefix(index))
+	n := int64(0)
+	size := uint64(0)
+	i := g.db.NewIterator(g.ropts)
+	defer i.Close()
+	for i.Seek(from); i.Valid(); i.Next() {
+		k := i.Key()
+		if !bytes.HasPrefix(k, from) {
+			return n, nil
+		}
+		if n == estimateSampleSize {
+			break
+		}
+		n++
+		size += uint64(len(k) + len(i.Value()))
+	}
+	if n < estimateSampleSize {
+		return n, nil
+	}
+	sizer, ok := g.db.(Sizer)
+	if !ok {
+		return n, nil
+	}
+	est := int64(sizer.ApproximateSize(from, inc(from)) / (size / uint64(n)))
+	if est < n {
+		est = n
+	}
+	return est, nil
+}
+
+// EstimateMatching estimates the number of keys that DoMatching would
+// visit for the pattern, which is in natural (SPO) order.  Also
+// returns the index DoMatching would use.
+func (g *Graph) EstimateMatching(on *Triple) (int64, Index, error) {
+	index := g.BestIndex(on)
+	n, err := g.EstimateCount(index, on.Copy().Permute(index))
+	return n, index, err
+}
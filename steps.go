@@ -22,20 +22,52 @@ package tinygraph
 // ToDo: Examples in steps_test.go
 
 import (
+	"context"
 	"fmt"
+	"sync"
 )
 
 // A Stepper defines what to do when walking a graph from some path.
 // All the logic is given by the 'step' function, which possibly
 // extends the current path.  A Stepper is a pretty low-level thing.
 type Stepper struct {
-	iperm    Index
-	index    Index
-	operm    Index
+	in       bool
 	pattern  Triple
 	pred     func(Triple) bool
 	fs       []func(Path)
 	previous *Stepper
+	repeat   *repetition
+	tag      *stepTag
+	branch   *branching
+	stage    *pipeStage
+}
+
+// A branching is what an Or(), And(), or Optional() stepper runs.
+type branching struct {
+	op     byte // '|' for Or(), '&' for And(), '?' for Optional()
+	chains [][]*Stepper
+}
+
+// A pipeStage filters or reorders the paths that reach it.
+type pipeStage struct {
+	op byte   // 'd'edup, 'l'imit, 's'kip, 'o'rderBy, or sample ('r')
+	by string // Tag name for 'd' and 'o' ("" for the current vertex)
+	n  int64
+}
+
+// A stepTag names a position in a chain (As()) or goes back to one
+// (Back()).
+type stepTag struct {
+	name string
+	back bool
+}
+
+// A repetition is what a Repeat() stepper repeats.
+type repetition struct {
+	body []*Stepper
+	min  int
+	max  int // Negative for no limit
+	emit bool
 }
 
 type Path []Triple
@@ -44,48 +76,133 @@ type Chants chan Path
 
 type Vertex []byte
 
-// We wrap because Otto wants us to.
+// We wrap because Otto wants us to.  A Chan's methods (Do(),
+// Collect(), etc.) pull paths straight from a PathIterator.  The
+// channel and its goroutine only get started if you ask for them with
+// C().  Either way, Close() or the walk's context stops the walk.
 type Chan struct {
-	c    Chants
-	done chan (struct{})
+	c       Chants
+	ctx     context.Context // The walk's context
+	stop    context.Context // Done when the walk should stop
+	cancel  context.CancelFunc
+	it      *PathIterator
+	lock    sync.Mutex
+	started bool
 }
 
+// NewChan makes a Chan for paths that someone else will send.
 func NewChan() *Chan {
-	return &Chan{make(Chants, *chanBufferSize), make(chan (struct{}))}
+	ctx := context.Background()
+	stop, cancel := context.WithCancel(ctx)
+	return &Chan{c: make(Chants, *chanBufferSize), ctx: ctx, stop: stop, cancel: cancel, started: true}
+}
+
+// newPathChan makes a Chan for the paths from the iterator that
+// 'paths' makes with the given context.  The iterator is closed when
+// the walk stops, even if nobody is reading the Chan anymore.
+func newPathChan(ctx context.Context, paths func(context.Context) *PathIterator) *Chan {
+	stop, cancel := context.WithCancel(ctx)
+	c := &Chan{c: make(Chants, *chanBufferSize), ctx: ctx, stop: stop, cancel: cancel, it: paths(stop)}
+	context.AfterFunc(stop, c.release)
+	return c
 }
 
 const (
 	Open uint32 = iota
-
-	// ToDo: No this.  Need another channel for control.
 	Closed
 )
 
+// C returns the channel of paths, which is closed at the end of the
+// walk.  The first call starts a goroutine that sends the paths.
+func (c *Chan) C() Chants {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.started {
+		c.started = true
+		go c.run()
+	}
+	return c.c
+}
+
+func (c *Chan) run() {
+	defer close(c.c)
+	defer c.it.Close()
+	for {
+		path, ok := c.it.Next()
+		if !ok || !c.send(path) {
+			return
+		}
+	}
+}
+
+// next returns the next path (from the channel if it's started).
+// Holds the lock while it uses the iterator, which release() might
+// close at any time.
+func (c *Chan) next() (Path, bool) {
+	c.lock.Lock()
+	if !c.started {
+		path, ok := c.it.Next()
+		c.lock.Unlock()
+		if !ok {
+			c.Close()
+		}
+		return path, ok
+	}
+	c.lock.Unlock()
+	path := <-c.c
+	return path, path != nil
+}
+
+// Close stops the walk.  It's fine to call Close more than once.
 func (c *Chan) Close() {
-	close(c.done)
+	c.cancel()
+	c.release()
 }
 
-func (v *Vertex) toTriple() Triple {
-	return Triple{nil, nil, *v, nil}
+// release closes the iterator unless the goroutine that sends the
+// paths has it (and closes it when it stops).
+func (c *Chan) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.started && c.it != nil {
+		c.it.Close()
+	}
 }
 
-// Start walking.
-func (g *Graph) launch(c *Chan, at Triple, ss []*Stepper) {
-	g.step(c, Path{at}, ss)
+// Err returns the walk's context's error (if any), which says why a
+// walk stopped early.
+func (c *Chan) Err() error {
+	return c.ctx.Err()
+}
+
+// send emits a path unless the walk is stopped first.
+func (c *Chan) send(path Path) bool {
 	select {
-	case <-c.done:
-	default:
-		(*c).c <- nil
+	case <-c.stop.Done():
+		return false
+	case c.c <- path:
+		return true
 	}
 }
 
+func (v *Vertex) toTriple() Triple {
+	return Triple{nil, nil, *v, nil}
+}
+
 // Walk starts a graph walk at the given vertex.  You get a channel of
 // paths.  A path is just an array of triples.  The traversal is
 // defined by the given array of Steppers (such as In()s and Outs()).
+// The walk uses the graph's context (see WithContext).
 func (g *Graph) Walk(o Vertex, ss []*Stepper) *Chan {
-	c := NewChan()
-	go g.launch(c, o.toTriple(), ss)
-	return c
+	return g.WalkContext(g.context(), o, ss)
+}
+
+// WalkContext is Walk() with a context.  When the context is done,
+// the walk stops, releases its iterators, and closes the channel.
+func (g *Graph) WalkContext(ctx context.Context, o Vertex, ss []*Stepper) *Chan {
+	return newPathChan(ctx, func(ctx context.Context) *PathIterator {
+		return g.PathsContext(ctx, o, ss)
+	})
 }
 
 // Perform all stepper function invocation (if any).
@@ -95,48 +212,9 @@ func (s *Stepper) exec(path Path) {
 	}
 }
 
-func (g *Graph) step(c *Chan, ts Path, ss []*Stepper) bool {
-	if len(ss) == 0 {
-		select {
-		case _ = <-c.done:
-			return false
-		default:
-			(*c).c <- ts[1:]
-		}
-	} else {
-		at := &ts[len(ts)-1]
-		s := ss[0]
-		if s.pred != nil {
-			if s.pred(*at) {
-				s.exec(ts[1:])
-				g.step(c, ts, ss[1:])
-			}
-		} else {
-			u := at.Permute(s.iperm)
-			if s.pattern.S != nil {
-				u.S = s.pattern.S
-			}
-			u.P = s.pattern.P
-			u.O = nil
-			i := g.NewIndexIterator(s.index, u, nil)
-			for i.Next() {
-				t := IndexedTripleFromBytes(s.index, i.Key(), i.Value())
-				t = t.Permute(s.index).Permute(s.operm)
-				path := append(ts, *t)
-				s.exec(path[1:])
-				if !g.step(c, path, ss[1:]) {
-					return false
-				}
-			}
-		}
-	}
-
-	return true
-}
-
 // Out returns a Stepper that traverses all edges out of the Stepper's input verticies.
 func Out(p []byte) *Stepper {
-	return &Stepper{OPS, SPO, SPO, Triple{nil, p, nil, nil}, nil, make([]func(Path), 0, 0), nil}
+	return &Stepper{pattern: Triple{P: p}, fs: make([]func(Path), 0, 0)}
 }
 
 // Out extends the stepper to follow out-bound edges with the given property.
@@ -148,7 +226,7 @@ func (s *Stepper) Out(p []byte) *Stepper {
 
 // AllOut returns a Stepper that traverses all out-bound edges.
 func AllOut() *Stepper {
-	return &Stepper{OPS, SPO, SPO, Triple{nil, nil, nil, nil}, nil, make([]func(Path), 0, 0), nil}
+	return &Stepper{fs: make([]func(Path), 0, 0)}
 }
 
 // AllOut extends the stepper to follow all edges.
@@ -160,7 +238,7 @@ func (s *Stepper) AllOut() *Stepper {
 
 // In returns a Stepper that traverses all edges into of the Stepper's input verticies.
 func In(p []byte) *Stepper {
-	return &Stepper{OPS, OPS, OPS, Triple{nil, p, nil, nil}, nil, make([]func(Path), 0, 0), nil}
+	return &Stepper{in: true, pattern: Triple{P: p}, fs: make([]func(Path), 0, 0)}
 }
 
 // In extends the stepper to follow all in-bound edges with the given property.
@@ -172,7 +250,7 @@ func (s *Stepper) In(p []byte) *Stepper {
 
 // AllIn returns a Stepper that traverses all in-bound edges.
 func AllIn() *Stepper {
-	return &Stepper{OPS, OPS, OPS, Triple{nil, nil, nil, nil}, nil, make([]func(Path), 0, 0), nil}
+	return &Stepper{in: true, fs: make([]func(Path), 0, 0)}
 }
 
 // AllIn extends the stepper to follow all in-bound edges.
@@ -184,7 +262,7 @@ func (s *Stepper) AllIn() *Stepper {
 
 // Has returns a stepper that will follow edges for which pred returns true.
 func Has(pred func(Triple) bool) *Stepper {
-	return &Stepper{SPO, SPO, SPO, Triple{}, pred, make([]func(Path), 0, 0), nil}
+	return &Stepper{pred: pred, fs: make([]func(Path), 0, 0)}
 }
 
 // Has extends a stepper to will follow edges for which pred returns true.
@@ -194,6 +272,229 @@ func (s *Stepper) Has(pred func(Triple) bool) *Stepper {
 	return next
 }
 
+// Repeat returns a stepper that follows the chain ending in 'body' at
+// least 'min' and at most 'max' times (no limit if 'max' is
+// negative).  It goes breadth-first and never visits a vertex twice,
+// so cycles are fine and each vertex is reached by a shortest path.
+// It emits the paths that stop going: at 'max' or where there's no
+// new vertex to go to.  Use Emit() to get every path from 'min' on.
+func Repeat(body *Stepper, min int, max int) *Stepper {
+	r := &repetition{body.chain(), min, max, false}
+	return &Stepper{fs: make([]func(Path), 0, 0), repeat: r}
+}
+
+// Repeat extends the stepper to follow the chain ending in 'body'
+// repeatedly.
+func (s *Stepper) Repeat(body *Stepper, min int, max int) *Stepper {
+	next := Repeat(body, min, max)
+	next.previous = s
+	return next
+}
+
+// Emit makes a Repeat() stepper emit the path to every vertex it
+// reaches at depth 'min' or more, not just the paths that stop
+// there.  Does nothing to other steppers.
+func (s *Stepper) Emit() *Stepper {
+	if s.repeat != nil {
+		s.repeat.emit = true
+	}
+	return s
+}
+
+// OutStar returns a stepper that follows out-bound edges with the
+// given property any number of times (including zero).
+func OutStar(p []byte) *Stepper {
+	return Repeat(Out(p), 0, -1).Emit()
+}
+
+// OutStar extends the stepper to follow out-bound edges with the given
+// property any number of times.
+func (s *Stepper) OutStar(p []byte) *Stepper {
+	next := OutStar(p)
+	next.previous = s
+	return next
+}
+
+// InStar returns a stepper that follows in-bound edges with the given
+// property any number of times (including zero).
+func InStar(p []byte) *Stepper {
+	return Repeat(In(p), 0, -1).Emit()
+}
+
+// InStar extends the stepper to follow in-bound edges with the given
+// property any number of times.
+func (s *Stepper) InStar(p []byte) *Stepper {
+	next := InStar(p)
+	next.previous = s
+	return next
+}
+
+func newBranch(op byte, chains []*Stepper) *Stepper {
+	b := &branching{op, make([][]*Stepper, 0, len(chains))}
+	for _, chain := range chains {
+		b.chains = append(b.chains, chain.chain())
+	}
+	return &Stepper{fs: make([]func(Path), 0, 0), branch: b}
+}
+
+// Or returns a stepper that follows each of the given chains from the
+// current vertex.  It emits every path from the first chain, then
+// every path from the second, and so on.
+func Or(chains ...*Stepper) *Stepper {
+	return newBranch('|', chains)
+}
+
+// Or extends the stepper to follow each of the given chains.
+func (s *Stepper) Or(chains ...*Stepper) *Stepper {
+	next := Or(chains...)
+	next.previous = s
+	return next
+}
+
+// And returns a stepper that follows the first of the given chains
+// from the current vertex, but only emits the paths that end at a
+// vertex that every other chain also reaches from there.  With no
+// chains, it emits nothing.
+func And(chains ...*Stepper) *Stepper {
+	return newBranch('&', chains)
+}
+
+// And extends the stepper to follow the first chain to vertexes that
+// all of the chains reach.
+func (s *Stepper) And(chains ...*Stepper) *Stepper {
+	next := And(chains...)
+	next.previous = s
+	return next
+}
+
+// Intersect is And().
+func Intersect(chains ...*Stepper) *Stepper {
+	return And(chains...)
+}
+
+// Intersect is And().
+func (s *Stepper) Intersect(chains ...*Stepper) *Stepper {
+	return s.And(chains...)
+}
+
+// Optional returns a stepper that follows the given chain from the
+// current vertex.  If the chain doesn't go anywhere, it emits the path
+// so far (and stays at the current vertex).
+func Optional(chain *Stepper) *Stepper {
+	return newBranch('?', []*Stepper{chain})
+}
+
+// Optional extends the stepper to follow the chain if it can.
+func (s *Stepper) Optional(chain *Stepper) *Stepper {
+	next := Optional(chain)
+	next.previous = s
+	return next
+}
+
+func newStage(op byte, by []string, n int64) *Stepper {
+	st := &pipeStage{op: op, n: n}
+	if 0 < len(by) {
+		st.by = by[0]
+	}
+	return &Stepper{fs: make([]func(Path), 0, 0), stage: st}
+}
+
+// Dedup returns a stepper that drops each path whose current vertex
+// (or, if given, vertex tagged with As(by)) it has already seen.  Paths
+// without that tag count as the same.
+func Dedup(by ...string) *Stepper {
+	return newStage('d', by, 0)
+}
+
+// Dedup extends the stepper to drop paths it has already seen (see
+// Dedup()).
+func (s *Stepper) Dedup(by ...string) *Stepper {
+	next := Dedup(by...)
+	next.previous = s
+	return next
+}
+
+// Limit returns a stepper that passes at most n paths.  After that,
+// the walk stops going down the steps before it.
+func Limit(n int64) *Stepper {
+	return newStage('l', nil, n)
+}
+
+// Limit extends the stepper to pass at most n paths.
+func (s *Stepper) Limit(n int64) *Stepper {
+	next := Limit(n)
+	next.previous = s
+	return next
+}
+
+// Skip returns a stepper that drops the first n paths.
+func Skip(n int64) *Stepper {
+	return newStage('s', nil, n)
+}
+
+// Skip extends the stepper to drop the first n paths.
+func (s *Stepper) Skip(n int64) *Stepper {
+	next := Skip(n)
+	next.previous = s
+	return next
+}
+
+// OrderBy returns a stepper that waits for every path from the steps
+// before it and then passes them on sorted by their current vertexes
+// (or, if given, the vertexes tagged with As(by)).
+func OrderBy(by ...string) *Stepper {
+	return newStage('o', by, 0)
+}
+
+// OrderBy extends the stepper to sort paths (see OrderBy()).
+func (s *Stepper) OrderBy(by ...string) *Stepper {
+	next := OrderBy(by...)
+	next.previous = s
+	return next
+}
+
+// Sample returns a stepper that waits for every path from the steps
+// before it and then passes on n of them chosen at random.
+func Sample(n int64) *Stepper {
+	return newStage('r', nil, n)
+}
+
+// Sample extends the stepper to pass on n random paths.
+func (s *Stepper) Sample(n int64) *Stepper {
+	next := Sample(n)
+	next.previous = s
+	return next
+}
+
+// As returns a stepper that tags the current vertex with the given
+// name.  See Back() and PathIterator.Select().
+func As(name string) *Stepper {
+	return &Stepper{fs: make([]func(Path), 0, 0), tag: &stepTag{name: name}}
+}
+
+// As extends the stepper to tag the current vertex with the given
+// name.
+func (s *Stepper) As(name string) *Stepper {
+	next := As(name)
+	next.previous = s
+	return next
+}
+
+// Back returns a stepper that goes back to the vertex tagged with the
+// given name.  The path keeps the edges it took, and the next step
+// starts at the tagged vertex.  A path without that tag ends there.
+func Back(name string) *Stepper {
+	return &Stepper{fs: make([]func(Path), 0, 0), tag: &stepTag{name: name, back: true}}
+}
+
+// Back extends the stepper to go back to the vertex tagged with the
+// given name.
+func (s *Stepper) Back(name string) *Stepper {
+	next := Back(name)
+	next.previous = s
+	return next
+}
+
 // Do extends a stepper to execute a the given function for the current path.
 func (s *Stepper) Do(f func(Path)) *Stepper {
 	s.fs = append(s.fs, f)
@@ -211,22 +512,27 @@ func (path *Path) String() string {
 
 // Walk starts the stepper at the given vertex.  Returns a channel of paths.
 func (s *Stepper) Walk(g *Graph, from Vertex) *Chan {
-	at := s
-	ss := make([]*Stepper, 0, 1)
-	ss = append(ss, at)
-	for at.previous != nil {
-		ss = append([]*Stepper{at.previous}, ss...)
-		at = at.previous
-	}
-	return g.Walk(from, ss)
+	return g.Walk(from, s.chain())
+}
+
+// WalkContext starts the stepper at the given vertex.  The walk stops
+// when the context is done.
+func (s *Stepper) WalkContext(ctx context.Context, g *Graph, from Vertex) *Chan {
+	return g.WalkContext(ctx, from, s.chain())
+}
+
+// Paths starts the stepper at the given vertex.  Returns an iterator
+// of paths.
+func (s *Stepper) Paths(g *Graph, from Vertex) *PathIterator {
+	return g.Paths(from, s.chain())
 }
 
 // Do is a utility function to call the given function on every path from the channel.
 func (c *Chan) Do(f func(Path)) {
 	defer c.Close()
 	for {
-		x := <-(*c).c
-		if x == nil {
+		x, ok := c.next()
+		if !ok {
 			break
 		}
 		f(x)
@@ -237,14 +543,12 @@ func (c *Chan) Do(f func(Path)) {
 // from the channel at most 'limit' times.
 func (c *Chan) DoSome(f func(Path), limit int64) {
 	defer c.Close()
-	n := int64(0)
-	for {
-		x := <-(*c).c
-		if x == nil || n == limit {
+	for n := int64(0); n < limit; n++ {
+		x, ok := c.next()
+		if !ok {
 			break
 		}
 		f(x)
-		n++
 	}
 }
 
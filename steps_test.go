@@ -15,8 +15,11 @@
 package tinygraph
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"testing"
+	"time"
 )
 
 func TestSteps(t *testing.T) {
@@ -167,3 +170,579 @@ func TestDo(t *testing.T) {
 
 	g.Close()
 }
+
+func TestPlan(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err = g.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lots of edges into "hub" but just one into "rare".
+	for i := 0; i < 50; i++ {
+		g.WriteIndexedTriple(TripleFromStrings(fmt.Sprintf("x%d", i), "label", "hub"), nil)
+	}
+	g.WriteIndexedTriple(TripleFromStrings("x7", "holo", "rare"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("x8", "holo", "other"), nil)
+
+	chain := In([]byte("label")).Out([]byte("holo"))
+	plan := chain.Plan(g, Vertex("hub"), Vertex("rare"))
+	if !plan.Reverse {
+		t.Errorf("Expected a backward plan:\n%s", plan.Explain())
+	}
+	fmt.Printf("plan\n%s\n", plan.Explain())
+
+	want := chain.Walk(g, Vertex("hub")).Collect()
+	got := plan.Walk().Collect()
+	if len(want) != 2 || len(got) != 1 {
+		t.Fatalf("Unexpected %v and %v", want, got)
+	}
+	for _, path := range want {
+		if string(path[1].O) == "rare" && path.String() != got[0].String() {
+			t.Errorf("Expected %s but got %s", path.String(), got[0].String())
+		}
+	}
+
+	// Has() steps see the forward path.
+	x8 := func(t Triple) bool { return string(t.O) == "x8" }
+	plan = In([]byte("label")).Has(x8).Out([]byte("holo")).Plan(g, Vertex("hub"), nil)
+	if paths := plan.Walk().Collect(); len(paths) != 1 || string(paths[0][1].O) != "other" {
+		t.Errorf("Unexpected %v", paths)
+	}
+	plan = Out([]byte("label")).Has(x8).Out([]byte("holo")).Plan(g, nil, Vertex("rare"))
+	if !plan.Reverse {
+		t.Errorf("Expected a backward plan:\n%s", plan.Explain())
+	}
+	if paths := plan.Walk().Collect(); len(paths) != 0 {
+		t.Errorf("Unexpected %v", paths)
+	}
+
+	// Do() steps only go forward.
+	plan = In([]byte("label")).Do(func(Path) {}).Out([]byte("holo")).Plan(g, Vertex("hub"), Vertex("rare"))
+	if plan.Reverse {
+		t.Errorf("Expected a forward plan:\n%s", plan.Explain())
+	}
+	if paths := plan.Walk().Collect(); len(paths) != 1 {
+		t.Errorf("Unexpected %v", paths)
+	}
+}
+
+func TestWalkContext(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for i := 0; i < 100; i++ {
+		g.WriteIndexedTriple(TripleFromStrings("wc", "wcp", fmt.Sprintf("wc%d", i)), nil)
+		g.WriteIndexedTriple(TripleFromStrings(fmt.Sprintf("wc%d", i), "wcp", "wc"), nil)
+	}
+
+	// Cancel partway through a walk that would go on for a long time.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := Out([]byte("wcp")).Out([]byte("wcp")).Out([]byte("wcp")).WalkContext(ctx, g, Vertex("wc"))
+	paths := c.CollectSome(10)
+	if len(paths) != 10 {
+		t.Errorf("Expected %d paths but got %d", 10, len(paths))
+	}
+	cancel()
+	if c.Err() != context.Canceled {
+		t.Errorf("Unexpected %v", c.Err())
+	}
+	// The channel gets closed.
+	for range c.C() {
+	}
+
+	// A deadline stops a walk that nobody reads.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c = g.WithContext(ctx).Walk(Vertex("wc"), []*Stepper{AllOut(), AllOut(), AllOut()})
+	ch := c.C()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("No deadline")
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if *chanBufferSize < n {
+		t.Errorf("Expected at most %d paths but got %d", *chanBufferSize, n)
+	}
+}
+
+func TestPathIterator(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.WriteIndexedTriple(TripleFromStrings("a", "p1", "b"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("a", "p1", "f"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("b", "p2", "c"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("f", "p2", "c"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("g", "p4", "c"), nil)
+	g.WriteIndexedTriple(TripleFromStrings("g", "p1", "h"), nil)
+
+	did := make([]string, 0, 8)
+	chain := func() *Stepper {
+		did = did[0:0]
+		return Out([]byte("p1")).
+			Do(func(path Path) { did = append(did, path.String()) }).
+			Out([]byte("p2")).
+			Has(func(t Triple) bool { return string(t.S) != "f" }).
+			In([]byte("p4")).
+			Out([]byte("p1"))
+	}
+
+	path := func(ts ...[3]string) string {
+		acc := make(Path, 0, len(ts))
+		for _, t := range ts {
+			acc = append(acc, *TripleFromStrings(t[0], t[1], t[2]))
+		}
+		return acc.String()
+	}
+	// An In() step's triple has the subject and object swapped.
+	want := path([3]string{"a", "p1", "b"}, [3]string{"b", "p2", "c"}, [3]string{"c", "p4", "g"}, [3]string{"g", "p1", "h"})
+	wantDid := fmt.Sprint([]string{path([3]string{"a", "p1", "b"}), path([3]string{"a", "p1", "f"})})
+
+	i := chain().Paths(g, Vertex("a"))
+	got := make([]string, 0, 1)
+	for {
+		path, ok := i.Next()
+		if !ok {
+			break
+		}
+		got = append(got, path.String())
+	}
+	if i.Err() != nil {
+		t.Error(i.Err())
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("Expected %v but got %v", want, got)
+	}
+	if fmt.Sprint(did) != wantDid {
+		t.Errorf("Expected %v but got %v", wantDid, did)
+	}
+	if got := chain().Walk(g, Vertex("a")).Collect(); len(got) != 1 || got[0].String() != want {
+		t.Errorf("Expected %v but got %v", want, got)
+	}
+	if fmt.Sprint(did) != wantDid {
+		t.Errorf("Expected %v but got %v", wantDid, did)
+	}
+
+	// Stopping early.
+	i = AllOut().Paths(g, Vertex("a"))
+	if paths := i.CollectSome(1); len(paths) != 1 || len(i.stack) != 0 {
+		t.Errorf("Unexpected %v with %d frames", paths, len(i.stack))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	i = g.PathsContext(ctx, Vertex("a"), []*Stepper{AllOut()})
+	if _, ok := i.Next(); !ok {
+		t.Error("Expected a path")
+	}
+	cancel()
+	if _, ok := i.Next(); ok || i.Err() != context.Canceled {
+		t.Errorf("Unexpected %v", i.Err())
+	}
+
+	// An abandoned walk releases its iterators when its context is
+	// done.
+	ctx, cancel = context.WithCancel(context.Background())
+	c := g.WalkContext(ctx, Vertex("a"), []*Stepper{AllOut()})
+	if _, ok := c.next(); !ok {
+		t.Error("Expected a path")
+	}
+	cancel()
+	for n := 0; ; n++ {
+		c.lock.Lock()
+		frames := len(c.it.stack)
+		c.lock.Unlock()
+		if frames == 0 {
+			break
+		}
+		if n == 100 {
+			t.Fatalf("Still %d frames", frames)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// a -> b -> c -> d -> b (a cycle) and a -> e.
+	for _, edge := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"d", "b"}, {"a", "e"}, {"c", "x"}} {
+		p := "isa"
+		if edge[1] == "x" {
+			p = "other"
+		}
+		g.WriteIndexedTriple(TripleFromStrings(edge[0], p, edge[1]), nil)
+	}
+	isa := []byte("isa")
+
+	ends := func(paths []Path) string {
+		acc := make([]string, 0, len(paths))
+		for _, path := range paths {
+			if len(path) == 0 {
+				acc = append(acc, "-")
+			} else {
+				acc = append(acc, fmt.Sprintf("%s%d", path[len(path)-1].O, len(path)))
+			}
+		}
+		return fmt.Sprint(acc)
+	}
+
+	for _, c := range []struct {
+		s    *Stepper
+		want string
+	}{
+		{OutStar(isa), "[- b1 e1 c2 d3]"},
+		{Repeat(Out(isa), 1, -1).Emit(), "[b1 e1 c2 d3]"},
+		{Repeat(Out(isa), 1, -1), "[e1 d3]"},
+		{Repeat(Out(isa), 1, 2), "[c2 e1]"},
+		{Repeat(Out(isa), 2, 2).Emit(), "[c2]"},
+		{Repeat(Out(isa), 0, 0), "[-]"},
+		{InStar(isa).Out([]byte("isa")), "[b1 e1]"},
+		{OutStar(isa).Out([]byte("other")), "[x3]"},
+		{Repeat(Out(isa).Has(func(t Triple) bool { return string(t.O) != "c" }), 1, -1).Emit(), "[b1 e1]"},
+	} {
+		if got := ends(c.s.Paths(g, Vertex("a")).Collect()); got != c.want {
+			t.Errorf("Expected %s but got %s", c.want, got)
+		}
+	}
+
+	// The channel API works too.
+	if got := ends(Out(isa).OutStar(isa).Walk(g, Vertex("a")).Collect()); got != "[b1 c2 d3 e1]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Repetitions continue from where the body ends, which Back() can
+	// move.  Here that's each vertex that has a next one.
+	s := Repeat(Out(isa).As("v").Out(isa).Back("v"), 1, -1).Emit().As("end")
+	got := make([]string, 0, 3)
+	for _, tags := range s.Paths(g, Vertex("a")).Select("end") {
+		got = append(got, string(tags["end"]))
+	}
+	if fmt.Sprint(got) != "[b c d]" {
+		t.Errorf("Unexpected %v", got)
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// a -> b -> c -> z, a -> d -> z, and a -likes-> z.
+	for _, edge := range [][3]string{{"a", "isa", "b"}, {"b", "isa", "c"}, {"c", "isa", "z"},
+		{"a", "isa", "d"}, {"d", "isa", "z"}, {"a", "likes", "z"}} {
+		g.WriteIndexedTriple(TripleFromStrings(edge[0], edge[1], edge[2]), nil)
+	}
+
+	show := func(path Path) string {
+		if path == nil {
+			return "none"
+		}
+		acc := ""
+		for i, t := range path {
+			if i == 0 {
+				acc = string(t.S)
+			}
+			acc += "-" + string(t.O)
+		}
+		return acc
+	}
+
+	for _, c := range []struct {
+		from, to string
+		opts     *PathOptions
+		want     string
+	}{
+		{"a", "z", nil, "a-z"},
+		{"a", "z", (&PathOptions{}).Except([]byte("likes")), "a-d-z"},
+		{"a", "z", (&PathOptions{}).Only([]byte("isa")), "a-d-z"},
+		{"a", "z", (&PathOptions{MaxDepth: 1}).Only([]byte("isa")), "none"},
+		{"a", "c", &PathOptions{MaxDepth: 2}, "a-b-c"},
+		{"a", "a", nil, ""},
+		{"z", "a", nil, "none"},
+		{"z", "a", (&PathOptions{}).Both(), "z-a"},
+		{"z", "b", (&PathOptions{}).Both().Except([]byte("likes")), "z-c-b"},
+	} {
+		path, err := g.ShortestPath(Vertex(c.from), Vertex(c.to), c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := show(path); got != c.want {
+			t.Errorf("%s to %s: expected %s but got %s", c.from, c.to, c.want, got)
+		}
+	}
+
+	for k, want := range []string{"[]", "[a-z]", "[a-z a-d-z]", "[a-z a-d-z a-b-c-z]", "[a-z a-d-z a-b-c-z]"} {
+		paths, err := g.KShortestPaths(Vertex("a"), Vertex("z"), k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := make([]string, 0, len(paths))
+		for _, path := range paths {
+			acc = append(acc, show(path))
+		}
+		if got := fmt.Sprint(acc); got != want {
+			t.Errorf("k=%d: expected %s but got %s", k, want, got)
+		}
+	}
+
+	// A path's triples are the graph's triples (or flipped ones).
+	path, _ := g.ShortestPath(Vertex("z"), Vertex("b"), (&PathOptions{}).Both().Except([]byte("likes")))
+	if got := path[0].Strings(); got[0] != "z" || got[1] != "isa" || got[2] != "c" {
+		t.Errorf("Unexpected %v", got)
+	}
+}
+
+func TestAsBack(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for _, ts := range [][3]string{
+		{"af", "label", "Africa"}, {"ke", "label", "Kenya"}, {"eg", "label", "Egypt"},
+		{"ke", "holo", "af"}, {"eg", "holo", "af"}, {"ke", "capital", "na"},
+	} {
+		g.WriteIndexedTriple(TripleFromStrings(ts[0], ts[1], ts[2]), nil)
+	}
+	label, holo, capital := []byte("label"), []byte("holo"), []byte("capital")
+
+	show := func(rows []map[string]Vertex) string {
+		acc := make([]string, 0, len(rows))
+		for _, row := range rows {
+			names := make([]string, 0, len(row))
+			for name := range row {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			s := ""
+			for _, name := range names {
+				s += name + "=" + string(row[name]) + ";"
+			}
+			acc = append(acc, s)
+		}
+		sort.Strings(acc)
+		return fmt.Sprint(acc)
+	}
+
+	s := In(label).As("place").In(holo).As("country").Out(label).As("name")
+	if got := show(s.Paths(g, Vertex("Africa")).Select("country", "name")); got != "[country=eg;name=Egypt; country=ke;name=Kenya;]" {
+		t.Errorf("Unexpected %s", got)
+	}
+	if got := show(s.Paths(g, Vertex("Africa")).SelectSome(1)); got != "[country=eg;name=Egypt;place=af;]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Back to Africa from countries with capitals.
+	s = In(label).As("place").In(holo).Out(capital).Back("place").Out(label)
+	paths := s.Paths(g, Vertex("Africa")).Collect()
+	if len(paths) != 1 || len(paths[0]) != 4 || string(paths[0][3].O) != "Africa" || string(paths[0][2].O) != "na" {
+		t.Errorf("Unexpected %v", paths)
+	}
+
+	// Has() sees the vertex Back() went to.
+	s = In(label).As("place").In(holo).Back("place").Has(func(t Triple) bool { return string(t.O) == "af" })
+	if n := len(s.Paths(g, Vertex("Africa")).Collect()); n != 2 {
+		t.Errorf("Unexpected %d", n)
+	}
+
+	// No such tag.
+	if n := len(In(label).Back("nope").Paths(g, Vertex("Africa")).Collect()); n != 0 {
+		t.Errorf("Unexpected %d", n)
+	}
+
+	// Repeat() starts where Back() went, and tags outside it survive.
+	s = As("country").Out(capital).Back("country").Repeat(Out(holo), 1, 1).As("region")
+	if got := show(s.Paths(g, Vertex("ke")).Select()); got != "[country=ke;region=af;]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Plans with As() only go forward.
+	if p := In(label).As("x").Out(label).Plan(g, Vertex("Africa"), nil); p.Reverse || 0 <= p.Other {
+		t.Errorf("Unexpected plan %s", p.Explain())
+	}
+}
+
+func TestBranches(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// dog -> canine (hypernym), dog -> pet (instance), canine -> animal,
+	// pet -> animal, dog -> "Dog" (label), and cat -> pet.
+	for _, ts := range [][3]string{
+		{"dog", "hypernym", "canine"}, {"dog", "instance", "pet"}, {"canine", "hypernym", "animal"},
+		{"pet", "hypernym", "animal"}, {"dog", "label", "Dog"}, {"cat", "instance", "pet"},
+		{"dog", "hypernym", "wolfish"},
+	} {
+		g.WriteIndexedTriple(TripleFromStrings(ts[0], ts[1], ts[2]), nil)
+	}
+	hyper, instance, label := []byte("hypernym"), []byte("instance"), []byte("label")
+
+	ends := func(paths []Path) string {
+		acc := make([]string, 0, len(paths))
+		for _, path := range paths {
+			if len(path) == 0 {
+				acc = append(acc, "-")
+			} else {
+				acc = append(acc, fmt.Sprintf("%s%d", path[len(path)-1].O, len(path)))
+			}
+		}
+		return fmt.Sprint(acc)
+	}
+
+	for _, c := range []struct {
+		s    *Stepper
+		from string
+		want string
+	}{
+		// Every path from the first chain, then the second.
+		{Or(Out(hyper), Out(instance)), "dog", "[canine1 wolfish1 pet1]"},
+		{Or(Out(hyper), Out(instance)).Out(hyper), "dog", "[animal2 animal2]"},
+		{Or(Out(hyper), Out(hyper).Out(hyper)), "dog", "[canine1 wolfish1 animal2]"},
+		{Or(Out(label), Out(label)), "cat", "[]"},
+		// Paths from the first chain that end where the others go.
+		{And(Out(hyper).Out(hyper), Out(instance).Out(hyper)), "dog", "[animal2]"},
+		{Intersect(Out(hyper), Out(instance)), "dog", "[]"},
+		{And(Out(instance), Out(instance)), "cat", "[pet1]"},
+		{And(In(hyper).In(hyper), In(hyper).In(instance)), "animal", "[dog2]"},
+		// No chains, no paths.
+		{Out(hyper).And(), "dog", "[]"},
+		{Or(), "dog", "[]"},
+		// The chain's paths, or the path so far.
+		{Optional(Out(label)), "dog", "[Dog1]"},
+		{Optional(Out(label)), "cat", "[-]"},
+		{Out(instance).Optional(Out(label)), "cat", "[pet1]"},
+		{AllOut().Optional(Out(hyper)).Out(hyper), "cat", "[]"},
+		{Out(instance).Optional(Out(label)).Out(hyper), "cat", "[animal2]"},
+	} {
+		if got := ends(c.s.Paths(g, Vertex(c.from)).Collect()); got != c.want {
+			t.Errorf("From %s: expected %s but got %s", c.from, c.want, got)
+		}
+	}
+
+	// Tags inside branches survive, and Back() works across them.
+	s := Or(Out(hyper).As("up"), Out(instance).As("up")).Optional(Out(label).As("name")).Back("up")
+	ups := make([]string, 0, 3)
+	for _, tags := range s.Paths(g, Vertex("dog")).Select("up") {
+		ups = append(ups, string(tags["up"]))
+	}
+	if got := fmt.Sprint(ups); got != "[canine wolfish pet]" {
+		t.Errorf("Unexpected %s", got)
+	}
+	s = Optional(Out(label).As("name").Back("name")).Out(hyper)
+	if got := ends(s.Paths(g, Vertex("cat")).Collect()); got != "[]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Do() functions see the emitted paths.
+	n := 0
+	Or(Out(hyper), Out(instance)).Do(func(path Path) { n++ }).Paths(g, Vertex("dog")).Collect()
+	if n != 3 {
+		t.Errorf("Unexpected %d", n)
+	}
+}
+
+func TestStages(t *testing.T) {
+	g, err := NewGraphWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// hub -> v0 ... v9, and each vN -> even or odd.
+	for i := 0; i < 10; i++ {
+		v := fmt.Sprintf("v%d", i)
+		kind := "even"
+		if i%2 == 1 {
+			kind = "odd"
+		}
+		g.WriteIndexedTriple(TripleFromStrings("hub", "to", v), nil)
+		g.WriteIndexedTriple(TripleFromStrings(v, "kind", kind), nil)
+	}
+	to, kind := []byte("to"), []byte("kind")
+
+	ends := func(paths []Path) string {
+		acc := make([]string, 0, len(paths))
+		for _, path := range paths {
+			acc = append(acc, string(path[len(path)-1].O))
+		}
+		return fmt.Sprint(acc)
+	}
+
+	for _, c := range []struct {
+		s    *Stepper
+		want string
+	}{
+		{Out(to).Limit(3), "[v0 v1 v2]"},
+		{Out(to).Limit(0), "[]"},
+		{Out(to).Skip(8), "[v8 v9]"},
+		{Out(to).Skip(2).Limit(2), "[v2 v3]"},
+		{Out(to).Out(kind).Dedup(), "[even odd]"},
+		{Out(to).Out(kind).Dedup().Limit(1), "[even]"},
+		{Out(to).Out(kind).OrderBy().Limit(6), "[even even even even even odd]"},
+		{Out(to).Out(kind).OrderBy().Skip(4).Limit(2), "[even odd]"},
+		{Out(to).As("v").Out(kind).Dedup("v").Limit(3), "[even odd even]"},
+		{Out(to).As("v").Out(kind).OrderBy("v").Out(kind).Limit(3), "[]"},
+		{Out(to).Limit(2).Out(kind), "[even odd]"},
+		{Dedup().Out(to).Limit(1), "[v0]"},
+	} {
+		if got := ends(c.s.Paths(g, Vertex("hub")).Collect()); got != c.want {
+			t.Errorf("Expected %s but got %s", c.want, got)
+		}
+	}
+
+	// OrderBy() a tag, and the order survives later steps.
+	s := Out(to).As("v").Out(kind).OrderBy().As("k").Back("v").Limit(4)
+	rows := make([]string, 0, 4)
+	for _, tags := range s.Paths(g, Vertex("hub")).Select("v", "k") {
+		rows = append(rows, string(tags["k"])+":"+string(tags["v"]))
+	}
+	if got := fmt.Sprint(rows); got != "[even:v0 even:v2 even:v4 even:v6]" {
+		t.Errorf("Unexpected %s", got)
+	}
+
+	// Limit() stops the steps before it.
+	n := 0
+	Out(to).Do(func(Path) { n++ }).Limit(2).Paths(g, Vertex("hub")).Collect()
+	if n != 2 {
+		t.Errorf("Expected 2 paths before Limit() but got %d", n)
+	}
+
+	// Sample() picks distinct paths.
+	for _, k := range []int64{0, 4, 20} {
+		seen := make(map[string]bool)
+		for _, path := range Out(to).Sample(k).Paths(g, Vertex("hub")).Collect() {
+			seen[string(path[0].O)] = true
+		}
+		if want := int(k); (k < 10 && len(seen) != want) || (10 <= k && len(seen) != 10) {
+			t.Errorf("Sample(%d) got %d", k, len(seen))
+		}
+	}
+
+	// Plans with stages only go forward.
+	if p := Out(to).Limit(1).Plan(g, Vertex("hub"), Vertex("v1")); p.Reverse {
+		t.Errorf("Unexpected plan %s", p.Explain())
+	}
+}
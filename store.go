@@ -0,0 +1,156 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// A Graph sits on an ordered key-value Store.  RocksDB is the usual
+// store (see rocks.go).  There's also a pure-Go in-memory store (see
+// memstore.go), which is all you get if you build with '-tags
+// norocks'.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Store is an ordered key-value store.  Get returns nil (and no
+// error) for a missing key.
+type Store interface {
+	Get(ro *ReadOptions, k []byte) ([]byte, error)
+	Put(wo *WriteOptions, k []byte, v []byte) error
+	Delete(wo *WriteOptions, k []byte) error
+	NewBatch() Batch
+	Write(wo *WriteOptions, b Batch) error
+	NewIterator(ro *ReadOptions) StoreIterator
+	NewSnapshot() Snapshot
+	Compact()
+	Stats() string
+	Close() error
+}
+
+// A Batch is a set of writes that a Store applies atomically.
+type Batch interface {
+	Put(k []byte, v []byte)
+	Delete(k []byte)
+	Clear()
+}
+
+// A StoreIterator sees the store as it was when the iterator was
+// created.
+type StoreIterator interface {
+	Seek(k []byte)
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next()
+	Close()
+}
+
+// emptyIterator is a StoreIterator with no keys.  A store returns one
+// for a released snapshot.
+type emptyIterator struct{}
+
+func (emptyIterator) Seek(k []byte) {}
+func (emptyIterator) Valid() bool   { return false }
+func (emptyIterator) Key() []byte   { return nil }
+func (emptyIterator) Value() []byte { return nil }
+func (emptyIterator) Next()         {}
+func (emptyIterator) Close()        {}
+
+// A Checkpointer is a Store that can write a consistent copy of
+// itself to a directory.
+type Checkpointer interface {
+	Checkpoint(dir string) error
+}
+
+// A BackupStore is a Store with its own backups, which a
+// BackupEngine uses instead of its logical dumps (see backup.go).
+type BackupStore interface {
+	// CreateBackup adds a backup of the store to the directory.  Sets
+	// the info's ID, Store, and Bytes.
+	CreateBackup(dir string, info *BackupInfo) error
+	// RestoreBackup replaces the store's data, which should be
+	// empty, with the backup that has the given ID.
+	RestoreBackup(dir string, id int) error
+}
+
+// A Sizer is a Store that can estimate the number of bytes that the
+// keys in [from,to) take up.
+type Sizer interface {
+	ApproximateSize(from []byte, to []byte) uint64
+}
+
+// A Snapshot is a consistent, read-only view of a Store.  Release it
+// when you are done with it.
+type Snapshot interface {
+	Release()
+}
+
+// ReadOptions control reads.  A nil *ReadOptions means the store's
+// defaults.
+type ReadOptions struct {
+	// Read from this snapshot rather than the current state.
+	Snapshot Snapshot
+}
+
+// WriteOptions control writes.  A nil *WriteOptions means the
+// store's defaults (which might come from the configuration).
+type WriteOptions struct {
+	Sync       bool
+	DisableWAL bool
+}
+
+// A StoreOpener makes a Store based on the given configuration.
+type StoreOpener func(config *Options) (Store, error)
+
+var storeOpeners = make(map[string]StoreOpener)
+
+// DefaultStore is the store used when the configuration doesn't give
+// a "store".  It's "rocksdb" when RocksDB is compiled in.  Otherwise
+// it's empty, and a configuration has to ask for '"store": "memory"'
+// explicitly rather than quietly getting a database that isn't
+// persistent.
+var DefaultStore = ""
+
+var ErrNoStore = errors.New("Configuration doesn't give a \"store\", and RocksDB isn't compiled in")
+
+// RegisterStore makes a store available by name to OpenStore.
+func RegisterStore(name string, opener StoreOpener) {
+	storeOpeners[name] = opener
+}
+
+// OpenStore opens the store named by the configuration's "store"
+// key.  Without that key, OpenStore uses DefaultStore or returns
+// ErrNoStore if there isn't one.
+func OpenStore(config *Options) (Store, error) {
+	name := DefaultStore
+	if s, ok := config.StringKey("store"); ok {
+		name = s
+	}
+	if name == "" {
+		return nil, ErrNoStore
+	}
+	opener, ok := storeOpeners[name]
+	if !ok {
+		names := make([]string, 0, len(storeOpeners))
+		for name := range storeOpeners {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown store '%s' (have %s)", name, strings.Join(names, ","))
+	}
+	return opener(config)
+}
@@ -20,8 +20,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/robertkrimen/otto"
 	. "github.csv.comcast.com/jsteph206/tinygraph"
@@ -29,11 +34,26 @@ import (
 
 // We have a single Javascript interpreter, which we probably shouldn't.
 var httpVM *otto.Otto
+var httpEnv *Env
+
+// Requests take turns with the shared interpreter.
+var httpVMLock sync.Mutex
 
 func runHttpd() {
 	log.Printf("Opening config %s", *configFile)
 	SharedGraph, _ = GetGraph(*configFile)
 	http.HandleFunc("/js", handleJavascript)
+	http.HandleFunc("/changes", handleChanges)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/count", handleCount)
+	http.HandleFunc("/path", handlePath)
+	http.HandleFunc("/match", handleMatch)
+	http.HandleFunc("/sparql", handleSPARQL)
+	if *admin {
+		http.HandleFunc("/admin/backup", handleBackup)
+		http.HandleFunc("/admin/backups", handleBackups)
+		http.HandleFunc("/admin/checkpoint", handleCheckpoint)
+	}
 	log.Printf("Start HTTP server %s", *httpPort)
 	log.Printf("Done with HTTP server (%v)", http.ListenAndServe(*httpPort, nil))
 }
@@ -56,17 +76,28 @@ func handleJavascript(w http.ResponseWriter, r *http.Request) {
 	log.Printf("javascript: executing %s\n", js)
 
 	var vm *otto.Otto
+	var env *Env
 	if *sharedHttpVM {
+		httpVMLock.Lock()
+		defer httpVMLock.Unlock()
 		if httpVM == nil {
 			httpVM = otto.New()
-			InitEnv(httpVM)
+			httpEnv = InitEnv(httpVM)
 		}
 		vm = httpVM
+		env = httpEnv
 	} else {
 		vm = otto.New()
-		InitEnv(vm)
+		env = InitEnv(vm)
 	}
 
+	// Every read in this request sees the same data, and walks stop
+	// if the client goes away.
+	snap := SharedGraph.Snapshot()
+	defer snap.Release()
+	env.SetGraph(snap.WithContext(r.Context()))
+	defer env.SetGraph(nil)
+
 	o, err := vm.Run(js)
 
 	if err != nil {
@@ -99,3 +130,327 @@ func handleJavascript(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprintf(w, "%s\n", bs)
 }
+
+// handleChanges streams the changelog as newline-delimited JSON
+// starting at sequence number 'from' (default 1).  With
+// 'follow=false', it returns what's there now (up to 'limit') instead
+// of waiting for more.
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	from := uint64(1)
+	if s := r.FormValue("from"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad from '%s'", s), http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+	limit := 1000
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad limit '%s'", s), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	if r.FormValue("follow") == "false" {
+		changes, err := SharedGraph.Changes(from, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, c := range changes {
+			enc.Encode(c)
+		}
+		return
+	}
+
+	feed, err := SharedGraph.Subscribe(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer feed.Close()
+	log.Printf("changes: streaming from %d\n", from)
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case c, ok := <-feed.C:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(c); err != nil {
+				log.Printf("changes: stopping at %d (%v)", c.Seq, err)
+				return
+			}
+			if flusher != nil && len(feed.C) == 0 {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, x interface{}) {
+	bs, err := json.Marshal(x)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", bs)
+}
+
+// handleStats returns the graph's counts.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := SharedGraph.TripleStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// handleCount estimates the number of triples matching the pattern
+// given by the parameters 's', 'p', 'o', and 'g' (all optional).  With
+// 'exact=true', it counts them instead.  With 'group' ("s", "p", "o",
+// or "g"), it counts them for each term at that position.
+func handleCount(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	on := TripleFromStrings(r.FormValue("s"), r.FormValue("p"), r.FormValue("o"), r.FormValue("g"))
+	if position := r.FormValue("group"); position != "" || r.FormValue("exact") == "true" {
+		snap := SharedGraph.Snapshot()
+		defer snap.Release()
+		g := snap.WithContext(r.Context())
+		if position == "" {
+			n, err := g.CountMatching(on)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, map[string]interface{}{"count": n})
+			return
+		}
+		counts, err := g.GroupMatching(on, position)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"groups": counts})
+		return
+	}
+	n, index, err := SharedGraph.EstimateMatching(on)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"count": n, "index": index.String()})
+}
+
+// handlePath returns up to 'k' (default 1) shortest paths from
+// 'from' to 'to'.  Optional: 'max' edges, 'allow' and 'deny'
+// predicates (repeat them for more than one), and 'undirected=true'.
+// Each path is an array of [s,p,o,v] arrays.
+func handlePath(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	from, to := r.FormValue("from"), r.FormValue("to")
+	if from == "" || to == "" {
+		http.Error(w, "need 'from' and 'to'", http.StatusBadRequest)
+		return
+	}
+	k := 1
+	if s := r.FormValue("k"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "bad 'k'", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	opts := &PathOptions{Undirected: r.FormValue("undirected") == "true"}
+	if s := r.FormValue("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "bad 'max'", http.StatusBadRequest)
+			return
+		}
+		opts.MaxDepth = n
+	}
+	for _, p := range r.Form["allow"] {
+		opts.Only([]byte(p))
+	}
+	for _, p := range r.Form["deny"] {
+		opts.Except([]byte(p))
+	}
+
+	snap := SharedGraph.Snapshot()
+	defer snap.Release()
+	paths, err := snap.WithContext(r.Context()).KShortestPaths(Vertex(from), Vertex(to), k, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	acc := make([][][]string, 0, len(paths))
+	for _, path := range paths {
+		ts := make([][]string, 0, len(path))
+		for _, t := range path {
+			ts = append(ts, t.Strings())
+		}
+		acc = append(acc, ts)
+	}
+	writeJSON(w, acc)
+}
+
+// handleMatch returns the variable bindings for the triple patterns
+// 'q' (like '?x label "Africa" . ?x part_holonym ?y'), up to 'limit'
+// (default 1000) rows.
+func handleMatch(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	b, err := ParseBGP(r.FormValue("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := int64(1000)
+	if s := r.FormValue("limit"); s != "" {
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "bad 'limit'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	snap := SharedGraph.Snapshot()
+	defer snap.Release()
+	rows, err := snap.WithContext(r.Context()).MatchBGP(b, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	acc := make([]map[string]string, 0, len(rows))
+	for _, bs := range rows {
+		acc = append(acc, bs.Strings())
+	}
+	writeJSON(w, map[string]interface{}{"vars": b.Vars(), "rows": acc})
+}
+
+// handleSPARQL is a SPARQL protocol endpoint for SELECT and ASK
+// queries.  The query is the 'query' parameter (GET or a form POST) or
+// the body of an 'application/sparql-query' POST.
+func handleSPARQL(w http.ResponseWriter, r *http.Request) {
+	var query string
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/sparql-query") {
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = string(bs)
+	} else {
+		r.ParseForm()
+		query = r.FormValue("query")
+	}
+	q, err := ParseSPARQL(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("sparql: executing %s\n", query)
+
+	snap := SharedGraph.Snapshot()
+	defer snap.Release()
+	result, err := snap.WithContext(r.Context()).SPARQLResults(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bs, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sparql-results+json")
+	fmt.Fprintf(w, "%s\n", bs)
+}
+
+// adminDir gets the 'dir' parameter of a POST.
+func adminDir(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	r.ParseForm()
+	dir := r.FormValue("dir")
+	if dir == "" {
+		http.Error(w, "need a 'dir'", http.StatusBadRequest)
+		return "", false
+	}
+	return dir, true
+}
+
+// handleBackup backs up the graph to the backup directory 'dir'
+// while the server keeps serving.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	dir, ok := adminDir(w, r)
+	if !ok {
+		return
+	}
+	engine, err := OpenBackupEngine(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin: backup to %s\n", dir)
+	info, err := engine.CreateBackup(SharedGraph)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// handleBackups lists the backups in the backup directory 'dir'.
+func handleBackups(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	dir := r.FormValue("dir")
+	if dir == "" {
+		http.Error(w, "need a 'dir'", http.StatusBadRequest)
+		return
+	}
+	engine, err := OpenBackupDir(dir)
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	backups, err := engine.Backups()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, backups)
+}
+
+// handleCheckpoint writes a checkpoint to the new directory 'dir'.
+func handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	dir, ok := adminDir(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("admin: checkpoint to %s\n", dir)
+	if err := SharedGraph.Checkpoint(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"checkpoint": dir})
+}
@@ -34,6 +34,17 @@ var serve = flag.Bool("serve", false, "Start HTTPD server")
 var configFile = flag.String("config", "config.js", "Configuration file")
 var sharedHttpVM = flag.Bool("sharevm", true, "Use a shared Javascript VM for the HTTP service")
 var httpPort = flag.String("port", ":8080", "HTTP server port")
+var migrate = flag.Bool("migrate", false, "Migrate the database to the current key format")
+var backupDir = flag.String("backup", "", "Back up the database to this backup directory")
+var restoreDir = flag.String("restore", "", "Restore the database from this backup directory")
+var backupID = flag.Int("backupid", 0, "Backup to restore (0 for the latest)")
+var checkpointDir = flag.String("checkpoint", "", "Write a checkpoint of the database to this directory")
+var bulkLoad = flag.String("bulkload", "", "Files to bulk load (offline)")
+var verify = flag.Bool("verify", false, "Check that the indexes agree")
+var repair = flag.Bool("repair", false, "With -verify, fix what can be fixed")
+var reindex = flag.String("reindex", "", "Build an index from another one (e.g. 'spo:pos')")
+var dropIndex = flag.String("dropindex", "", "Delete an index (e.g. 'pos')")
+var admin = flag.Bool("admin", false, "Enable the HTTP admin endpoints")
 
 func RationalizeMaxProcs() {
 	if os.Getenv("GOMAXPROCS") == "" {
@@ -87,9 +98,191 @@ func Load() {
 	}
 }
 
+// BulkLoad sorts the triples from the given files and ingests them.
+// The config's "bulkload_scratch" (default the system temp directory)
+// holds sorted runs of "bulkload_run_size" keys.
+func BulkLoad() {
+	g, config := GetGraph(*configFile)
+
+	scratch, _ := config.StringKey("bulkload_scratch")
+	runSize := DefaultBulkLoadRunSize
+	if n, ok := config.IntKey("bulkload_run_size"); ok {
+		runSize = n
+	}
+
+	filenames := make([]string, 0, 4)
+	for _, filename := range strings.Split(*bulkLoad, ",") {
+		filenames = append(filenames, strings.TrimSpace(filename))
+	}
+	stats, err := g.BulkLoad(filenames, scratch, runSize)
+	if err != nil {
+		panic(err)
+	}
+	for _, phase := range stats.Phases {
+		log.Printf("bulkload phase %s %v\n", phase.Name, phase.Elapsed)
+	}
+	log.Printf("bulkload %s\n", stats)
+	log.Println(g.GetStats())
+
+	if err = g.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func Verify() {
+	g, _ := GetGraph(*configFile)
+	var report *VerifyReport
+	var err error
+	if *repair {
+		report, err = g.Repair()
+	} else {
+		report, err = g.Verify()
+	}
+	if err != nil {
+		panic(err)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("verify ok %v %s\n", report.OK(), report)
+	g.Close()
+}
+
+// Reindex builds the second index in "FROM:TO" from the first.  Run it
+// again to resume.  Afterwards the database maintains TO even if the
+// config's "indexes" doesn't list it.
+func Reindex() {
+	parts := strings.Split(*reindex, ":")
+	if len(parts) != 2 {
+		panic(fmt.Errorf("-reindex wants FROM:TO, not '%s'", *reindex))
+	}
+	from, err := ParseIndex(parts[0])
+	if err != nil {
+		panic(err)
+	}
+	to, err := ParseIndex(parts[1])
+	if err != nil {
+		panic(err)
+	}
+	g, _ := GetGraph(*configFile)
+	n, err := g.Reindex(from, to)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("reindex %s to %s wrote %d keys; indexes are now %v\n", from, to, n, g.Indexes())
+	g.Close()
+}
+
+// DropIndex deletes an index.  Afterwards remove it from the config's
+// "indexes", since the database won't open with it there.
+func DropIndex() {
+	index, err := ParseIndex(*dropIndex)
+	if err != nil {
+		panic(err)
+	}
+	g, _ := GetGraph(*configFile)
+	if err = g.DropIndex(index); err != nil {
+		panic(err)
+	}
+	log.Printf("dropped %s; indexes are now %v\n", index, g.Indexes())
+	g.Close()
+}
+
+func Migrate() {
+	config, err := LoadOptions(*configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	batchSize := 1000
+	if n, ok := config.IntKey("batch_size"); ok {
+		batchSize = n
+	}
+
+	dir := DBDir(config)
+	db, err := OpenStore(config)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("migrating %s to format %d\n", dir, FormatVersion)
+	if err = MigrateGraph(db, batchSize); err != nil {
+		panic(err)
+	}
+	log.Printf("migrated %s\n", dir)
+	db.Close()
+}
+
+func Backup() {
+	engine, err := OpenBackupEngine(*backupDir)
+	if err != nil {
+		panic(err)
+	}
+	g, _ := GetGraph(*configFile)
+	info, err := engine.CreateBackup(g)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("backup %d (full %v) of %d records, %d bytes in %s\n", info.ID, info.Full, info.Records, info.Bytes, *backupDir)
+	g.Close()
+}
+
+func Restore() {
+	config, err := LoadOptions(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	engine, err := OpenBackupDir(*restoreDir)
+	if err != nil {
+		panic(err)
+	}
+	db, err := OpenStore(config)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("restoring %s from %s\n", DBDir(config), *restoreDir)
+	if err = engine.Restore(*backupID, db); err != nil {
+		panic(err)
+	}
+	log.Printf("restored %s\n", DBDir(config))
+	db.Close()
+}
+
+func Checkpoint() {
+	g, _ := GetGraph(*configFile)
+	if err := g.Checkpoint(*checkpointDir); err != nil {
+		panic(err)
+	}
+	log.Printf("checkpoint in %s\n", *checkpointDir)
+	g.Close()
+}
+
 func main() {
 	flag.Parse()
 	RationalizeMaxProcs()
+	if *migrate {
+		Migrate()
+	}
+	if *restoreDir != "" {
+		Restore()
+	}
+	if *reindex != "" {
+		Reindex()
+	}
+	if *dropIndex != "" {
+		DropIndex()
+	}
+	if *verify {
+		Verify()
+	}
+	if *backupDir != "" {
+		Backup()
+	}
+	if *checkpointDir != "" {
+		Checkpoint()
+	}
+	if *bulkLoad != "" {
+		BulkLoad()
+	}
 	if *filesToLoad != "" {
 		Load()
 	}
@@ -77,6 +77,9 @@ func TinyTest(g *Graph) {
 }
 
 func TestTinygraph(t *testing.T) {
+	if DefaultStore == "" {
+		t.Skip("config.js is a RocksDB configuration")
+	}
 	g, _ := GetGraph(*configFile)
 	TinyTest(g)
 	g.Close()
@@ -15,7 +15,9 @@
 package tinygraph
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 )
 
 type Triple struct {
@@ -71,101 +73,366 @@ func (t Triple) String() string {
 		string(t.V) + "'>"
 }
 
-func TripleFromBytes(k []byte, v []byte) *Triple {
+// Keys are the concatenation of the quad's components: S, P, O, and
+// then the graph label V.  (Graph indexes put V first.)  Each
+// component is terminated by the two bytes 0x00 0x01, and any 0x00
+// inside a component is escaped as 0x00 0xff.  This encoding
+// preserves component order, so prefix scans still work, and it
+// allows components to contain any bytes.
+const (
+	keyMark       = byte(0x00)
+	keyTerminator = byte(0x01)
+	keyEscape     = byte(0xff)
+)
 
-	start := 0
+// FormatVersion is the version of the key encoding described above.
+// Version 1 separated components with a bare 0x00 byte.  Version 2
+// had only S, P, and O in the key and V in the value.
+const FormatVersion = 3
+
+// TripleFromBytes decodes a key (without an index prefix).  The value
+// isn't used since the graph label is in the key.  Returns an error
+// if the key is malformed.  Does not copy unless a component had
+// escaped bytes.
+func TripleFromBytes(k []byte, v []byte) (*Triple, error) {
+	parts, err := decodeComponents(k, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &Triple{parts[0], parts[1], parts[2], parts[3]}, nil
+}
+
+// decodeComponents decodes a key that should have exactly n
+// components.
+func decodeComponents(k []byte, n int) ([][]byte, error) {
+	parts := make([][]byte, n)
 	at := 0
+	for i := 0; i < n; i++ {
+		part, next, err := decodeComponent(k, at)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part
+		at = next
+	}
+	if at != len(k) {
+		return nil, fmt.Errorf("Trailing bytes in key %q", k)
+	}
+	return parts, nil
+}
 
-	for 0 < k[at] {
-		at++
+// decodeComponent decodes the component that starts at 'at'.  Returns
+// the component and the offset of the next component.
+func decodeComponent(k []byte, at int) ([]byte, int, error) {
+	start := at
+	var acc []byte // Only allocated if we see an escape.
+	for at < len(k) {
+		if k[at] != keyMark {
+			if acc != nil {
+				acc = append(acc, k[at])
+			}
+			at++
+			continue
+		}
+		if len(k) <= at+1 {
+			return nil, at, fmt.Errorf("Truncated key %q", k)
+		}
+		switch k[at+1] {
+		case keyTerminator:
+			if acc != nil {
+				return acc, at + 2, nil
+			}
+			return k[start:at], at + 2, nil
+		case keyEscape:
+			if acc == nil {
+				acc = make([]byte, at-start, len(k)-start)
+				copy(acc, k[start:at])
+			}
+			acc = append(acc, keyMark)
+			at += 2
+		default:
+			return nil, at, fmt.Errorf("Bad escape 0x%02x in key %q", k[at+1], k)
+		}
 	}
-	s := k[start:at]
-	at++
-	start = at
+	return nil, at, fmt.Errorf("Unterminated key %q", k)
+}
 
-	for 0 < k[at] {
-		at++
+func appendComponent(k []byte, bs []byte) []byte {
+	for _, b := range bs {
+		k = append(k, b)
+		if b == keyMark {
+			k = append(k, keyEscape)
+		}
 	}
-	p := k[start:at]
-	at++
-	start = at
+	return append(k, keyMark, keyTerminator)
+}
 
-	for 0 < k[at] {
-		at++
+// components returns the triple's components in the order they
+// appear in keys for the given index.  The triple should already be
+// permuted for that index.
+func (t *Triple) components(index Index) [4][]byte {
+	if index.IsGraphIndex() {
+		return [4][]byte{t.V, t.S, t.P, t.O}
 	}
-	o := k[start:at]
-	at++
+	return [4][]byte{t.S, t.P, t.O, t.V}
+}
 
-	return &Triple{s, p, o, v}
+func (t *Triple) key(index Index) []byte {
+	k := make([]byte, 0, len(t.S)+len(t.P)+len(t.O)+len(t.V)+8)
+	for _, c := range t.components(index) {
+		k = appendComponent(k, c)
+	}
+	return k
 }
 
 func (t *Triple) Key() []byte {
-	k := make([]byte, 0, len(t.S)+len(t.P)+len(t.O)+3)
-	k = append(k, t.S...)
-	k = append(k, byte(0))
-	k = append(k, t.P...)
-	k = append(k, byte(0))
-	k = append(k, t.O...)
-	k = append(k, byte(0))
-	return k
+	return t.key(SPO)
+}
+
+// IndexKey returns the key (with its index prefix) for this triple in
+// the given index.  The triple should be in natural (SPO) order.
+func (t *Triple) IndexKey(index Index) []byte {
+	return withIndex(index, t.Copy().Permute(index).key(index))
 }
 
 func (t *Triple) Val() []byte {
 	return t.V
 }
 
+// StartKey returns the key to seek to for a scan of the triples that
+// match the leading given components of this triple.
 func (t *Triple) StartKey() []byte {
-	k := make([]byte, 0, len(t.S)+len(t.P)+len(t.O)+3)
-	if len(t.S) == 0 {
-		return k
-	}
-	k = append(k, t.S...)
-	k = append(k, byte(0))
-
-	k = append(k, t.P...)
-	k = append(k, byte(0))
+	return t.KeyPrefix()
+}
 
-	k = append(k, t.O...)
-	k = append(k, byte(0))
+// KeyPrefix returns the prefix shared by all keys that match the
+// leading given components of this triple.
+func (t *Triple) KeyPrefix() []byte {
+	return t.keyPrefix(SPO)
+}
 
+// keyPrefix is KeyPrefix for keys in the given index.  The triple
+// should already be permuted for that index.
+func (t *Triple) keyPrefix(index Index) []byte {
+	k := make([]byte, 0, len(t.S)+len(t.P)+len(t.O)+len(t.V)+8)
+	cs := t.components(index)
+	for _, c := range cs[0:t.boundIn(index)] {
+		k = appendComponent(k, c)
+	}
 	return k
 }
 
-func (t *Triple) KeyPrefix() []byte {
-	prefix := t.StartKey()
-	i := len(prefix) - 1
-	for 0 <= i && prefix[i] == 0 {
-		i--
+// version2TripleFromBytes decodes a version 2 key, which had only S,
+// P, and O.
+func version2TripleFromBytes(k []byte, v []byte) (*Triple, error) {
+	parts, err := decodeComponents(k, 3)
+	if err != nil {
+		return nil, err
 	}
+	return &Triple{parts[0], parts[1], parts[2], v}, nil
+}
 
-	return prefix[0 : i+2]
+// legacyTripleFromBytes decodes a version 1 key, which separated
+// components with a bare 0x00.
+func legacyTripleFromBytes(k []byte, v []byte) (*Triple, error) {
+	var parts [3][]byte
+	start := 0
+	for n := 0; n < 3; n++ {
+		end := bytes.IndexByte(k[start:], keyMark)
+		if end < 0 {
+			return nil, fmt.Errorf("Unterminated legacy key %q", k)
+		}
+		parts[n] = k[start : start+end]
+		start += end + 1
+	}
+	return &Triple{parts[0], parts[1], parts[2], v}, nil
 }
 
+// An Index names the order of the triple components in its keys.
+// The byte value of an Index is the key prefix for that index, so
+// don't renumber these.
+//
+// GSPO and GPOS are graph indexes: their keys start with the graph
+// label, so they can scan a single named graph.  The other indexes
+// put the graph label last.
 type Index byte
 
 const (
-	SPO = iota
+	SPO Index = iota
 	OPS
 	PSO
+	POS
+	SOP
+	OSP
+	GSPO
+	GPOS
 )
 
-// Does not copy!
-func (t *Triple) Permute(index Index) *Triple {
+// DefaultIndexes are the indexes maintained when the configuration
+// doesn't say otherwise.
+var DefaultIndexes = []Index{SPO, OPS, PSO}
+
+// AllIndexes are all of the possible indexes.
+var AllIndexes = []Index{SPO, OPS, PSO, POS, SOP, OSP, GSPO, GPOS}
+
+var indexNames = []string{"spo", "ops", "pso", "pos", "sop", "osp", "gspo", "gpos"}
+
+func (index Index) String() string {
+	if int(index) < len(indexNames) {
+		return indexNames[index]
+	}
+	return fmt.Sprintf("index%d", index)
+}
+
+// ParseIndex returns the Index with the given name (e.g. "spo").
+func ParseIndex(name string) (Index, error) {
+	for i, s := range indexNames {
+		if s == strings.ToLower(strings.TrimSpace(name)) {
+			return Index(i), nil
+		}
+	}
+	return SPO, fmt.Errorf("Unknown index '%s'", name)
+}
+
+// ParseIndexes parses a comma-separated list of index names (e.g.
+// "spo,ops,pso").  SPO is always required.
+func ParseIndexes(names string) ([]Index, error) {
+	acc := make([]Index, 0, len(AllIndexes))
+	spo := false
+	for _, name := range strings.Split(names, ",") {
+		index, err := ParseIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, have := range acc {
+			if have == index {
+				return nil, fmt.Errorf("Duplicate index '%s'", name)
+			}
+		}
+		if index == SPO {
+			spo = true
+		}
+		acc = append(acc, index)
+	}
+	if !spo {
+		return nil, fmt.Errorf("Index list '%s' must include spo", names)
+	}
+	return acc, nil
+}
+
+// JoinIndexes is the inverse of ParseIndexes.
+func JoinIndexes(indexes []Index) string {
+	names := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		names = append(names, index.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// IsGraphIndex reports whether the index's keys start with the graph
+// label.
+func (index Index) IsGraphIndex() bool {
+	return index == GSPO || index == GPOS
+}
+
+// order returns the index with the same order of S, P, and O but
+// without a leading graph label.
+func (index Index) order() Index {
 	switch index {
+	case GSPO:
+		return SPO
+	case GPOS:
+		return POS
+	}
+	return index
+}
+
+// Permute reorders the triple's components into the order of the
+// given index.  The graph label V stays put.  Does not copy!
+func (t *Triple) Permute(index Index) *Triple {
+	switch index.order() {
 	case SPO:
 	case OPS:
-		s := t.S
-		t.S = t.O
-		t.O = s
+		t.S, t.O = t.O, t.S
 	case PSO:
-		s := t.S
-		t.S = t.P
-		t.P = s
+		t.S, t.P = t.P, t.S
+	case POS:
+		t.S, t.P, t.O = t.P, t.O, t.S
+	case SOP:
+		t.P, t.O = t.O, t.P
+	case OSP:
+		t.S, t.P, t.O = t.O, t.S, t.P
 	}
 
 	return t
 }
 
+// Unpermute undoes Permute.  Does not copy!
+func (t *Triple) Unpermute(index Index) *Triple {
+	switch index.order() {
+	case POS:
+		return t.Permute(OSP)
+	case OSP:
+		return t.Permute(POS)
+	}
+	return t.Permute(index)
+}
+
+// bound returns the number of leading components that are given.
+func (t *Triple) bound() int {
+	return t.boundIn(SPO)
+}
+
+// boundIn returns the number of leading components that are given
+// in the key order for the given index.  The triple should already be
+// permuted for that index.
+func (t *Triple) boundIn(index Index) int {
+	n := 0
+	for _, c := range t.components(index) {
+		if len(c) == 0 {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// leading returns a copy of the triple with only the components
+// that boundIn(index) counts.
+func (t *Triple) leading(index Index) *Triple {
+	acc := &Triple{}
+	cs := t.components(index)
+	n := t.boundIn(index)
+	parts := []*[]byte{&acc.S, &acc.P, &acc.O, &acc.V}
+	if index.IsGraphIndex() {
+		parts = []*[]byte{&acc.V, &acc.S, &acc.P, &acc.O}
+	}
+	for i := 0; i < n; i++ {
+		*parts[i] = cs[i]
+	}
+	return acc
+}
+
+// given returns the number of components that are given.
+func (t *Triple) given() int {
+	n := 0
+	for _, bs := range [][]byte{t.S, t.P, t.O, t.V} {
+		if 0 < len(bs) {
+			n++
+		}
+	}
+	return n
+}
+
+// Matches reports whether each component given in the pattern is
+// equal to the corresponding component of the triple.
+func (t *Triple) Matches(pattern *Triple) bool {
+	return (len(pattern.S) == 0 || bytes.Equal(t.S, pattern.S)) &&
+		(len(pattern.P) == 0 || bytes.Equal(t.P, pattern.P)) &&
+		(len(pattern.O) == 0 || bytes.Equal(t.O, pattern.O)) &&
+		(len(pattern.V) == 0 || bytes.Equal(t.V, pattern.V))
+}
+
 func PrintTriple(t *Triple) bool {
 	fmt.Println(t.Strings())
 	return true
@@ -0,0 +1,67 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	triples := []*Triple{
+		TripleFromStrings("a", "p", "b"),
+		TripleFromStrings("a\x00", "p", "b"),
+		TripleFromStrings("a\x00b", "p\x00\x00", "\x00"),
+		TripleFromStrings("", "", ""),
+		TripleFromStrings("a\xff\x01", "", "b"),
+		TripleFromStrings("a", "p", "b", "g\x00"),
+	}
+	for _, triple := range triples {
+		got, err := TripleFromBytes(triple.Key(), nil)
+		if err != nil {
+			t.Fatalf("%q: %v", triple.Key(), err)
+		}
+		if !bytes.Equal(got.S, triple.S) || !bytes.Equal(got.P, triple.P) || !bytes.Equal(got.O, triple.O) || !bytes.Equal(got.V, triple.V) {
+			t.Errorf("Expected %q but got %q", triple.Strings(), got.Strings())
+		}
+	}
+
+	// Order is preserved.
+	keys := make([]string, 0, len(triples))
+	for _, triple := range triples {
+		keys = append(keys, string(triple.Key()))
+	}
+	sort.Strings(keys)
+	expect := []string{"", "a", "a", "a\x00", "a\x00b", "a\xff\x01"}
+	for i, k := range keys {
+		got, _ := TripleFromBytes([]byte(k), nil)
+		if string(got.S) != expect[i] {
+			t.Errorf("Expected %q at %d but got %q", expect[i], i, got.S)
+		}
+	}
+
+	// A prefix for a subject doesn't match a longer subject.
+	prefix := TripleFromStrings("a").KeyPrefix()
+	if bytes.HasPrefix(TripleFromStrings("a\x00b", "p", "o").Key(), prefix) {
+		t.Error("Prefix for 'a' matched 'a\\x00b'")
+	}
+
+	for _, bad := range []string{"", "a", "a\x00", "a\x00\x01b\x00\x01", "a\x00\x02", "a\x00\x01b\x00\x01c\x00\x01d"} {
+		if _, err := TripleFromBytes([]byte(bad), nil); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
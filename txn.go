@@ -0,0 +1,255 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Optimistic transactions.
+//
+// A Txn reads from a snapshot taken when it started, and it
+// remembers what it read.  Writes are buffered (and visible to the
+// Txn's own reads).  Commit() repeats every read against the current
+// data.  If anything changed, Commit() returns ErrConflict and writes
+// nothing.  Otherwise all of the writes go out in one batch across
+// all indexes.
+//
+// Errors from reads and writes are remembered and returned by
+// Commit(), which makes a Txn easier to use from Javascript.
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+var ErrConflict = errors.New("Transaction conflict")
+var ErrTxnDone = errors.New("Transaction already committed or rolled back")
+
+type Txn struct {
+	g      *Graph
+	snap   *Graph
+	reads  []txnRead
+	writes map[string]*txnWrite
+	order  []string
+	err    error
+	done   bool
+}
+
+// A txnRead is a scan we'll repeat at commit time.
+type txnRead struct {
+	index Index
+	on    *Triple
+	seen  []Triple
+}
+
+type txnWrite struct {
+	triple *Triple
+	del    bool
+}
+
+// Txn starts a transaction.  Even if g is a snapshot, the
+// transaction commits to the live graph.
+func (g *Graph) Txn() *Txn {
+	live := g.live()
+	return &Txn{live, live.Snapshot(), nil, make(map[string]*txnWrite), nil, nil, false}
+}
+
+// Scan is like Graph.Scan, but it reads from the transaction's
+// snapshot with the transaction's own writes applied.
+func (t *Txn) Scan(index Index, on *Triple) []Triple {
+	if t.done {
+		t.fail(ErrTxnDone)
+		return nil
+	}
+	var pattern *Triple
+	if on != nil {
+		pattern = on.Copy()
+	}
+	seen := t.snap.Scan(index, pattern, nil)
+	t.reads = append(t.reads, txnRead{index, pattern, seen})
+	return t.overlay(index, pattern, seen)
+}
+
+// Find returns the quads with the given S, P, and O.  If the triple
+// has a graph label, only that graph is considered.
+func (t *Txn) Find(triple *Triple) []Triple {
+	acc := make([]Triple, 0, 1)
+	for _, have := range t.Scan(SPO, triple) {
+		if have.Matches(triple) {
+			acc = append(acc, have)
+		}
+	}
+	return acc
+}
+
+// Has reports whether the given triple exists.
+func (t *Txn) Has(triple *Triple) bool {
+	return 0 < len(t.Find(triple))
+}
+
+// Put buffers writing the given triple to all indexes.
+func (t *Txn) Put(triple *Triple) {
+	t.buffer(triple, false)
+}
+
+// Delete buffers deleting the given triple from all indexes.
+func (t *Txn) Delete(triple *Triple) {
+	t.buffer(triple, true)
+}
+
+// Replace replaces 'old' with 'new' if 'old' exists.  For example,
+// replacing the object of (S,P) only if it is currently X.  If 'old'
+// has no graph label, it's replaced in every graph.  Returns false if
+// 'old' doesn't exist.
+func (t *Txn) Replace(old *Triple, new *Triple) bool {
+	found := t.Find(old)
+	if len(found) == 0 {
+		return false
+	}
+	for i := range found {
+		t.Delete(&found[i])
+	}
+	t.Put(new)
+	return true
+}
+
+func (t *Txn) buffer(triple *Triple, del bool) {
+	if t.done {
+		t.fail(ErrTxnDone)
+		return
+	}
+	k := string(triple.Key())
+	if _, have := t.writes[k]; !have {
+		t.order = append(t.order, k)
+	}
+	t.writes[k] = &txnWrite{triple.Copy(), del}
+}
+
+func (t *Txn) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// overlay applies buffered writes to scan results.
+func (t *Txn) overlay(index Index, on *Triple, seen []Triple) []Triple {
+	if len(t.writes) == 0 {
+		return seen
+	}
+	var pattern *Triple
+	if on != nil {
+		// Like the scan, only use the leading given components.
+		pattern = on.leading(index).Unpermute(index)
+	}
+	acc := make(map[string]Triple, len(seen))
+	for _, triple := range seen {
+		acc[string(triple.Key())] = triple
+	}
+	for k, w := range t.writes {
+		if pattern != nil && !w.triple.Matches(pattern) {
+			continue
+		}
+		if w.del {
+			delete(acc, k)
+		} else {
+			acc[k] = *w.triple
+		}
+	}
+
+	// Back in index order.
+	keys := make([]string, 0, len(acc))
+	byKey := make(map[string]Triple, len(acc))
+	for _, triple := range acc {
+		k := string(triple.IndexKey(index))
+		keys = append(keys, k)
+		byKey[k] = triple
+	}
+	sort.Strings(keys)
+	triples := make([]Triple, 0, len(keys))
+	for _, k := range keys {
+		triples = append(triples, byKey[k])
+	}
+	return triples
+}
+
+func sameTriples(xs []Triple, ys []Triple) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		x, y := &xs[i], &ys[i]
+		if !bytes.Equal(x.S, y.S) || !bytes.Equal(x.P, y.P) ||
+			!bytes.Equal(x.O, y.O) || !bytes.Equal(x.V, y.V) {
+			return false
+		}
+	}
+	return true
+}
+
+// Commit checks for conflicts and writes.  Returns ErrConflict if
+// anything the transaction read has changed.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.Rollback()
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	g := t.g
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, r := range t.reads {
+		if !sameTriples(r.seen, g.Scan(r.index, r.on, nil)) {
+			return ErrConflict
+		}
+	}
+
+	puts := make([]*Triple, 0, len(t.writes))
+	dels := make([]*Triple, 0, len(t.writes))
+	for _, k := range t.order {
+		w := t.writes[k]
+		if w.del {
+			dels = append(dels, w.triple)
+		} else {
+			puts = append(puts, w.triple)
+		}
+	}
+	batch := g.db.NewBatch()
+	if err := g.batchDeletes(batch, dels); err != nil {
+		return err
+	}
+	if err := g.batchPuts(batch, puts); err != nil {
+		return err
+	}
+	changes := append(g.logged(true, dels), g.logged(false, puts)...)
+	// We already hold the write lock, so not g.write().
+	err := g.writeLocked(g.wopts, batch, changes)
+	if err == nil {
+		g.IncWrites(uint64(len(g.indexes) * len(t.writes)))
+	}
+	return err
+}
+
+// Rollback abandons the transaction.
+func (t *Txn) Rollback() {
+	if !t.done {
+		t.done = true
+		t.snap.Release()
+	}
+}
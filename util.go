@@ -25,6 +25,8 @@ import (
 	"time"
 )
 
+// ReadTriplesFile sends the file's triples to the channel and then
+// closes it, even if there's an error.
 func ReadTriplesFile(c chan *Triple, tripleFile string) error {
 	f, err := os.Open(tripleFile)
 	if err != nil {
@@ -45,7 +47,8 @@ func ReadTriplesFile(c chan *Triple, tripleFile string) error {
 	if strings.HasSuffix(tripleFile, ".gz") || *gzipin {
 		zin, err := gzip.NewReader(f)
 		if err != nil {
-			return nil
+			close(c)
+			return fmt.Errorf("Couldn't read gzipped file %s: %v", tripleFile, err)
 		}
 		in = bufio.NewReader(zin)
 	}
@@ -0,0 +1,212 @@
+// Copyright 2014 Comcast Cable Communications Management, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tinygraph
+
+// Index consistency checks.
+//
+// Verify streams every key in (a snapshot of) the database.  Every SPO
+// entry should have a matching entry in every other maintained index,
+// and every entry in another maintained index should have an SPO
+// entry.  Index entries don't have values, so only keys are checked.
+// Keys that aren't index keys or exactly one of the graph's own keys
+// are strays (probably from WriteTriple or WriteBatch, which don't
+// write index prefixes).
+//
+// Repair writes missing entries and deletes orphans and undecodable
+// index keys.  It leaves strays alone.
+//
+// Keys are checked as they are stored, so a graph with a dictionary
+// is checked in terms of IDs.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+// Maximum number of problems described in a VerifyReport.
+const verifyMaxProblems = 100
+
+type VerifyReport struct {
+	Keys         map[string]int // Per index.
+	Missing      int            // SPO entries missing from another index.
+	Orphans      int            // Entries without an SPO entry.
+	Bad          int            // Index keys that don't decode.
+	Unmaintained int            // Keys in indexes the graph doesn't maintain.
+	Stray        int            // Keys outside of every known key range.
+	Repaired     int            // Keys written or deleted by Repair.
+	Problems     []string       // Descriptions of the first problems.
+}
+
+// OK reports whether no inconsistencies were found.  Keys in
+// unmaintained indexes don't count.
+func (r *VerifyReport) OK() bool {
+	return r.Missing == 0 && r.Orphans == 0 && r.Bad == 0 && r.Stray == 0
+}
+
+// String summarizes the report without the problem descriptions.
+func (r *VerifyReport) String() string {
+	return fmt.Sprintf("keys %v missing %d orphans %d bad %d unmaintained %d stray %d repaired %d",
+		r.Keys, r.Missing, r.Orphans, r.Bad, r.Unmaintained, r.Stray, r.Repaired)
+}
+
+func (r *VerifyReport) problem(format string, args ...interface{}) {
+	if len(r.Problems) < verifyMaxProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verify checks the indexes without changing anything.
+func (g *Graph) Verify() (*VerifyReport, error) {
+	return g.verify(false)
+}
+
+// Repair checks the indexes and fixes what it can.
+func (g *Graph) Repair() (*VerifyReport, error) {
+	if g.snapshot != nil {
+		return nil, ErrSnapshotWrite
+	}
+	if err := g.noteUnlogged(); err != nil {
+		return nil, err
+	}
+	return g.verify(true)
+}
+
+// reservedKeys are the graph's keys outside of every index other
+// than dictionary entries, changes, and counts.
+var reservedKeys = [][]byte{formatKey, dictionaryKey, changelogKey, unloggedKey, reindexKey, indexesKey, statsEnabledKey, statsStaleKey}
+
+// knownKey reports whether the key is one of the graph's own keys
+// outside of the indexes.  Keys that merely start like one don't
+// count.
+func (g *Graph) knownKey(k []byte) bool {
+	for _, reserved := range reservedKeys {
+		if bytes.Equal(k, reserved) {
+			return true
+		}
+	}
+	switch k[0] {
+	case termPrefix:
+		return g.dict != nil && 1 < len(k)
+	case idPrefix:
+		_, n := binary.Uvarint(k[1:])
+		return g.dict != nil && 0 < n && n == len(k)-1
+	case changePrefix:
+		return len(k) == 9
+	case statsPrefix, statsDeltaPrefix:
+		return knownStatsKey(k)
+	}
+	return false
+}
+
+func (g *Graph) verify(repair bool) (*VerifyReport, error) {
+	live := g.live()
+	snap := live.Snapshot()
+	defer snap.Release()
+
+	r := &VerifyReport{Keys: make(map[string]int)}
+	batch := g.db.NewBatch()
+	pending := 0
+	fix := func(k []byte, v []byte, del bool) error {
+		if !repair {
+			return nil
+		}
+		if del {
+			batch.Delete(k)
+		} else {
+			batch.Put(k, v)
+		}
+		r.Repaired++
+		pending++
+		if pending < deleteBatchSize {
+			return nil
+		}
+		pending = 0
+		err := live.write(live.wopts, batch, nil)
+		batch.Clear()
+		return err
+	}
+
+	i := snap.db.NewIterator(snap.ropts)
+	defer i.Close()
+	for i.Seek([]byte{}); i.Valid(); i.Next() {
+		k := i.Key()
+		if len(k) == 0 || g.knownKey(k) {
+			continue
+		}
+		index := Index(k[0])
+		if int(index) >= len(indexNames) {
+			r.Stray++
+			r.problem("stray key %q", k)
+			continue
+		}
+		r.Keys[index.String()]++
+		if !g.HasIndex(index) {
+			r.Unmaintained++
+			continue
+		}
+		t, err := IndexedTripleFromBytes(index, k, nil)
+		if err != nil {
+			r.Bad++
+			r.problem("bad %s key %q: %v", index, k, err)
+			if err = fix(k, nil, true); err != nil {
+				return r, err
+			}
+			continue
+		}
+		t.Unpermute(index)
+
+		if index != SPO {
+			if have, err := snap.db.Get(snap.ropts, t.IndexKey(SPO)); err != nil {
+				return r, err
+			} else if have == nil {
+				r.Orphans++
+				r.problem("orphan %s key %q", index, k)
+				if err = fix(k, nil, true); err != nil {
+					return r, err
+				}
+			}
+			continue
+		}
+
+		for _, other := range g.indexes {
+			if other == SPO {
+				continue
+			}
+			ko := t.IndexKey(other)
+			have, err := snap.db.Get(snap.ropts, ko)
+			if err != nil {
+				return r, err
+			}
+			if have != nil {
+				continue
+			}
+			r.Missing++
+			r.problem("%s key %q missing from %s", index, k, other)
+			if err = fix(ko, nil, false); err != nil {
+				return r, err
+			}
+		}
+	}
+
+	if 0 < pending {
+		if err := live.write(live.wopts, batch, nil); err != nil {
+			return r, err
+		}
+	}
+	log.Printf("verify %s", r)
+	return r, nil
+}